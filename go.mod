@@ -17,8 +17,9 @@ require (
 	github.com/aws/aws-sdk-go v1.25.6
 	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e
 	github.com/cornelk/hashmap v1.0.0
-	github.com/docker/distribution v2.7.1+incompatible // indirect
+	github.com/docker/distribution v2.7.1+incompatible
 	github.com/docker/docker v1.13.1
+	github.com/docker/go-units v0.4.0
 	github.com/go-ini/ini v1.48.0
 	github.com/googleapis/gnostic v0.3.1 // indirect
 	github.com/gorilla/mux v1.7.3 // indirect
@@ -51,6 +52,8 @@ require (
 	gopkg.in/yaml.v2 v2.2.8
 	gopkg.in/yaml.v3 v3.0.0-20190924164351-c8b7dadae555
 	gotest.tools v2.2.0+incompatible
+	k8s.io/api v0.0.0-20190409092523-d687e77c8ae9
+	k8s.io/apimachinery v0.0.0-20190409092423-760d1845f48b
 	k8s.io/client-go v11.0.0+incompatible
 	k8s.io/klog v0.3.0 // indirect
 	sigs.k8s.io/yaml v1.1.0 // indirect
@@ -14,9 +14,11 @@ type Aws struct {
 }
 
 type Config struct {
-	AccessKey string
-	SecretKey string
-	Log       Logger
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Region       string
+	Log          Logger
 }
 
 type Logger interface {
@@ -1,10 +1,11 @@
 package aws
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"time"
 
-	"github.com/PremiereGlobal/stim/pkg/utils"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/sts"
 )
@@ -35,6 +36,15 @@ func (a *Aws) GetFederationToken(name string, duration time.Duration) *sts.Crede
 // This is useful when IAM credentials were just provisioned and we need to wait
 // until they're active to take the next step.
 func (a *Aws) WaitForActiveCreds() {
+	if err := a.WaitForActiveCredsContext(context.Background()); err != nil {
+		a.log.Fatal(err)
+	}
+}
+
+// WaitForActiveCredsContext waits for the current session to become valid,
+// returning an error if the credentials are invalid, do not become active
+// within the retry limit or the context is done
+func (a *Aws) WaitForActiveCredsContext(ctx context.Context) error {
 
 	retryInterval := time.Second * 2
 	retryLimit := 20
@@ -46,32 +56,34 @@ func (a *Aws) WaitForActiveCreds() {
 
 	// Here we retry a call to GetCallerIdentity which will return an
 	// InvalidClientTokenId error code until the credentials become active
-	err := utils.Retry(retryLimit, retryInterval, func() error {
+	for i := 0; i < retryLimit; i++ {
 
-		_, err := s.GetCallerIdentity(&sts.GetCallerIdentityInput{})
-		if awserr, ok := err.(awserr.Error); ok {
-			if awserr.Code() == "InvalidClientTokenId" {
-				a.log.Info("AWS credentials not yet active, waiting...")
-				successes = 0
-				return err
-			} else {
-				a.log.Fatal("Error validating AWS credentials: ", err)
+		_, err := s.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if awserr, ok := err.(awserr.Error); ok && awserr.Code() == "InvalidClientTokenId" {
+			a.log.Info("AWS credentials not yet active, waiting...")
+			successes = 0
+		} else if err != nil {
+			return errors.New(fmt.Sprintf("Error validating AWS credentials: %v", err))
+		} else {
+			successes += 1
+			a.log.Debug("Successful validation check {} of {} reached", successes, successesRequired)
+			if successes >= successesRequired {
+				a.log.Info("AWS credentials are active")
+				return nil
 			}
 		}
 
-		successes += 1
-		a.log.Debug("Successful validation check {} of {} reached", successes, successesRequired)
-		if successes < successesRequired {
-			return errors.New("Haven't reached the required number of consecutive success yet")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryInterval):
 		}
-
-		a.log.Info("AWS credentials are active")
-		return nil
-	})
+	}
 
 	// If we've reached this point, the credentials did not become active within
 	// the retry limit
-	if err != nil {
-		a.log.Fatal("Error validating AWS credentials (not active within "+string(retryLimit)+" seconds) ", err)
-	}
+	return errors.New(fmt.Sprintf("Error validating AWS credentials (not active within %s)", time.Duration(retryLimit)*retryInterval))
 }
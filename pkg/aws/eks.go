@@ -0,0 +1,28 @@
+package aws
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// eksTokenPrefix is the prefix of EKS bearer tokens
+const eksTokenPrefix = "k8s-aws-v1."
+
+// EKSToken returns a bearer token for the given EKS cluster using the current
+// session.  The token is a presigned STS GetCallerIdentity request which EKS
+// accepts for 15 minutes.
+func (a *Aws) EKSToken(clusterName string) (string, error) {
+
+	s := sts.New(a.session)
+
+	request, _ := s.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	request.HTTPRequest.Header.Add("x-k8s-aws-id", clusterName)
+	presignedURL, err := request.Presign(60 * time.Second)
+	if err != nil {
+		return "", err
+	}
+
+	return eksTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(presignedURL)), nil
+}
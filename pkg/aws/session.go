@@ -7,8 +7,12 @@ import (
 )
 
 func (a *Aws) CreateSession(accessKey string, secretKey string) error {
-	awsCreds := credentials.NewStaticCredentials(accessKey, secretKey, "")
-	session, err := session.NewSession(&aws.Config{Credentials: awsCreds})
+	awsCreds := credentials.NewStaticCredentials(accessKey, secretKey, a.config.SessionToken)
+	awsConfig := &aws.Config{Credentials: awsCreds}
+	if a.config.Region != "" {
+		awsConfig.Region = aws.String(a.config.Region)
+	}
+	session, err := session.NewSession(awsConfig)
 	if err != nil {
 		return err
 	}
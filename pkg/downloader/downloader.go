@@ -20,6 +20,7 @@ type Downloader interface {
 	Download() (DownloadResult, error)
 	SetVersion(version string)
 	GetVersion() string
+	SetOS(goos string)
 	GetDownloadURL() string
 	GetBinPath() string
 	GetBinName() string
@@ -27,8 +28,8 @@ type Downloader interface {
 }
 
 type baseDownloader struct {
-	version, name, path string
-	url                 utils.StringReplacer
+	version, name, path, goos string
+	url                       utils.StringReplacer
 }
 
 type DownloadResult struct {
@@ -47,6 +48,7 @@ func NewBaseDownloader(url, version, name, path string) Downloader {
 		url:  utils.StringReplacer(url),
 		name: name,
 		path: path,
+		goos: runtime.GOOS,
 	}
 
 	d.SetVersion(version)
@@ -64,10 +66,16 @@ func (bd *baseDownloader) GetVersion() string {
 	return bd.version
 }
 
+// SetOS sets the operating system to download the binary for
+// Defaults to the current operating system
+func (bd *baseDownloader) SetOS(goos string) {
+	bd.goos = goos
+}
+
 // GetDownloadURL returns the constructed download url
 func (bd *baseDownloader) GetDownloadURL() string {
 	return bd.url.ReplaceAll("{VERSION}", bd.version).
-		ReplaceAll("{OS}", runtime.GOOS).
+		ReplaceAll("{OS}", bd.goos).
 		ReplaceAll("{ARCH}", runtime.GOARCH).
 		ReplaceAll("{NAME}", bd.name).
 		String()
@@ -1,8 +1,10 @@
 package env
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -103,16 +105,52 @@ func (e *Env) GetEnvVars() []string {
 
 // Run runs a shell command in the environment
 func (e *Env) Run(cmdString string) (string, error) {
+	return e.RunContext(context.Background(), cmdString)
+}
+
+// RunContext runs a shell command in the environment, stopping it and any
+// processes it started when the context is done
+func (e *Env) RunContext(ctx context.Context, cmdString string) (string, error) {
 
 	fullCmd := fmt.Sprintf("cd %s && %s", e.config.WorkDir, cmdString)
 	s, err := shell.Run(shell.ShellCommand{
 		Command: []string{fullCmd},
 		Envs:    e.GetEnvVars(),
+		Context: ctx,
 	})
 
 	return s, err
 }
 
+// Streams are the standard streams a command is attached to when its output
+// is streamed rather than captured
+type Streams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Interactive commands are attached to the terminal of stim
+	Interactive bool
+}
+
+// RunStreams runs a shell command in the environment, writing its output to
+// the given streams as it runs.  The command is stopped when the context is done.
+func (e *Env) RunStreams(ctx context.Context, cmdString string, streams Streams) error {
+
+	fullCmd := fmt.Sprintf("cd %s && %s", e.config.WorkDir, cmdString)
+	_, err := shell.Run(shell.ShellCommand{
+		Command:     []string{fullCmd},
+		Envs:        e.GetEnvVars(),
+		Context:     ctx,
+		Stdin:       streams.Stdin,
+		Stdout:      streams.Stdout,
+		Stderr:      streams.Stderr,
+		Interactive: streams.Interactive,
+	})
+
+	return err
+}
+
 // SetWorkDir sets the current working directory
 func (e *Env) SetWorkDir(workDir string) {
 	e.config.WorkDir = workDir
@@ -121,6 +159,6 @@ func (e *Env) SetWorkDir(workDir string) {
 // Close cleans up resources created by the env
 func (e *Env) Close() {
 	if e.config.Path.RemoveOnClose {
-		os.Remove(e.config.Path.Directory)
+		os.RemoveAll(e.config.Path.Directory)
 	}
 }
@@ -1,6 +1,9 @@
 package kubernetes
 
 import (
+	"errors"
+	"fmt"
+
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
@@ -33,6 +36,12 @@ type ConfigOptions struct {
 	// AuthToken is the authentication token
 	AuthToken string
 
+	// AuthClientCertificate is the client certificate contents, used instead of a token
+	AuthClientCertificate string
+
+	// AuthClientKey is the client key contents, used with AuthClientCertificate
+	AuthClientKey string
+
 	// ContextName is the name of the context
 	ContextName string
 
@@ -73,14 +82,75 @@ func (c *Config) Modify(options *ConfigOptions) error {
 		return err
 	}
 
+	options.apply(newConfig)
+	clientcmd.ModifyConfig(c.configAccess, *newConfig, false)
+
+	return nil
+}
+
+// Write replaces the contents of the kubeconfig with the given config
+func (c *Config) Write(config *clientcmdapi.Config) error {
+	return clientcmd.WriteToFile(*config, c.configAccess.GetDefaultFilename())
+}
+
+// NewConfigFromOptions returns a new kubeconfig containing only the cluster,
+// auth and context of the given options
+func NewConfigFromOptions(options *ConfigOptions) *clientcmdapi.Config {
+
+	config := clientcmdapi.NewConfig()
+	options.apply(config)
+
+	return config
+}
+
+// LoadContext returns a single context of a kubeconfig file as a standalone
+// kubeconfig, with any referenced certificate files embedded.  The current
+// context is used if contextName is empty, and the default kubeconfig files
+// are used if kubeConfigFilePath is empty.
+func LoadContext(kubeConfigFilePath string, contextName string) (*clientcmdapi.Config, error) {
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeConfigFilePath
+	config, err := loadingRules.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	if contextName != "" {
+		if _, ok := config.Contexts[contextName]; !ok {
+			return nil, errors.New(fmt.Sprintf("Context '%s' not found in kubeconfig", contextName))
+		}
+		config.CurrentContext = contextName
+	}
+	if config.CurrentContext == "" {
+		return nil, errors.New("Kubeconfig has no current context")
+	}
+
+	if err := clientcmdapi.MinifyConfig(config); err != nil {
+		return nil, err
+	}
+	if err := clientcmdapi.FlattenConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// apply adds the cluster, auth and context of the options to the config
+func (options *ConfigOptions) apply(config *clientcmdapi.Config) {
+
 	cluster := clientcmdapi.NewCluster()
 	cluster.Server = options.ClusterServer
 	cluster.CertificateAuthorityData = []byte(options.ClusterCA)
-	newConfig.Clusters[options.ClusterName] = cluster
+	config.Clusters[options.ClusterName] = cluster
 
 	authInfo := clientcmdapi.NewAuthInfo()
 	authInfo.Token = options.AuthToken
-	newConfig.AuthInfos[options.AuthName] = authInfo
+	if options.AuthClientCertificate != "" {
+		authInfo.ClientCertificateData = []byte(options.AuthClientCertificate)
+		authInfo.ClientKeyData = []byte(options.AuthClientKey)
+	}
+	config.AuthInfos[options.AuthName] = authInfo
 
 	context := clientcmdapi.NewContext()
 	if options.ContextDefaultNamespace != "" {
@@ -88,15 +158,11 @@ func (c *Config) Modify(options *ConfigOptions) error {
 	}
 	context.Cluster = options.ClusterName
 	context.AuthInfo = options.AuthName
-	newConfig.Contexts[options.ContextName] = context
+	config.Contexts[options.ContextName] = context
 
 	if options.ContextSetCurrent {
-		newConfig.CurrentContext = options.ContextName
+		config.CurrentContext = options.ContextName
 	}
-
-	clientcmd.ModifyConfig(c.configAccess, *newConfig, false)
-
-	return nil
 }
 
 // GetRestClientConfig returns a rest.Config to be used in a Kubernetes client
@@ -116,3 +182,15 @@ func (c *Config) GetRestClientConfig() (*rest.Config, error) {
 
 	return clientConfig, nil
 }
+
+// Namespace returns the default namespace of the current context
+func (c *Config) Namespace() (string, error) {
+
+	clientcmdapiConfig, err := c.configAccess.GetStartingConfig()
+	if err != nil {
+		return "", err
+	}
+
+	namespace, _, err := clientcmd.NewDefaultClientConfig(*clientcmdapiConfig, &clientcmd.ConfigOverrides{}).Namespace()
+	return namespace, err
+}
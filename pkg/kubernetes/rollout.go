@@ -0,0 +1,335 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// Kinds of workloads whose rollout status can be checked
+const (
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindDaemonSet   = "DaemonSet"
+)
+
+// WorkloadKinds are the kinds of workloads whose rollout status can be checked
+var WorkloadKinds = []string{KindDeployment, KindStatefulSet, KindDaemonSet}
+
+// progressDeadlineExceeded is the reason of the Progressing condition of a
+// Deployment which has failed to make progress
+const progressDeadlineExceeded = "ProgressDeadlineExceeded"
+
+// maxEvents is the number of recent events shown for each object
+const maxEvents = 10
+
+// RolloutStatus is the rollout status of a single workload
+type RolloutStatus struct {
+
+	// Kind, Namespace and Name identify the workload
+	Kind      string
+	Namespace string
+	Name      string
+
+	// Done is true once the rollout has completed
+	Done bool
+
+	// Failed is true if the rollout can not complete without intervention
+	Failed bool
+
+	// Message describes the progress of the rollout
+	Message string
+
+	// podSelector selects the pods of the workload
+	podSelector *metav1.LabelSelector
+}
+
+// String returns the kind, namespace and name of the workload
+func (s *RolloutStatus) String() string {
+	return fmt.Sprintf("%s %s/%s", s.Kind, s.Namespace, s.Name)
+}
+
+// RolloutStatuses returns the rollout status of the workloads of the given
+// kind in the namespace, selected either by name or by label selector.
+// Returns an empty list if no workloads are found.
+func (k *Kubernetes) RolloutStatuses(kind string, namespace string, name string, selector string) ([]*RolloutStatus, error) {
+
+	clientset, err := k.GetClientset()
+	if err != nil {
+		return nil, err
+	}
+	apps := clientset.AppsV1()
+	options := metav1.ListOptions{LabelSelector: selector}
+
+	statuses := []*RolloutStatus{}
+	switch kind {
+	case KindDeployment:
+		var items []appsv1.Deployment
+		if name != "" {
+			var item *appsv1.Deployment
+			item, err = apps.Deployments(namespace).Get(name, metav1.GetOptions{})
+			if item != nil && err == nil {
+				items = append(items, *item)
+			}
+		} else {
+			var list *appsv1.DeploymentList
+			if list, err = apps.Deployments(namespace).List(options); err == nil {
+				items = list.Items
+			}
+		}
+		for i := range items {
+			statuses = append(statuses, DeploymentRolloutStatus(&items[i]))
+		}
+	case KindStatefulSet:
+		var items []appsv1.StatefulSet
+		if name != "" {
+			var item *appsv1.StatefulSet
+			item, err = apps.StatefulSets(namespace).Get(name, metav1.GetOptions{})
+			if item != nil && err == nil {
+				items = append(items, *item)
+			}
+		} else {
+			var list *appsv1.StatefulSetList
+			if list, err = apps.StatefulSets(namespace).List(options); err == nil {
+				items = list.Items
+			}
+		}
+		for i := range items {
+			statuses = append(statuses, StatefulSetRolloutStatus(&items[i]))
+		}
+	case KindDaemonSet:
+		var items []appsv1.DaemonSet
+		if name != "" {
+			var item *appsv1.DaemonSet
+			item, err = apps.DaemonSets(namespace).Get(name, metav1.GetOptions{})
+			if item != nil && err == nil {
+				items = append(items, *item)
+			}
+		} else {
+			var list *appsv1.DaemonSetList
+			if list, err = apps.DaemonSets(namespace).List(options); err == nil {
+				items = list.Items
+			}
+		}
+		for i := range items {
+			statuses = append(statuses, DaemonSetRolloutStatus(&items[i]))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported workload kind '%s'", kind))
+	}
+
+	if apierrors.IsNotFound(err) {
+		return statuses, nil
+	}
+	return statuses, err
+}
+
+// DeploymentRolloutStatus returns the rollout status of a Deployment, using
+// the same checks as 'kubectl rollout status'
+func DeploymentRolloutStatus(d *appsv1.Deployment) *RolloutStatus {
+
+	status := &RolloutStatus{Kind: KindDeployment, Namespace: d.Namespace, Name: d.Name, podSelector: d.Spec.Selector}
+
+	if d.Generation > d.Status.ObservedGeneration {
+		status.Message = "Waiting for the deployment spec update to be observed"
+		return status
+	}
+	for _, c := range d.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Reason == progressDeadlineExceeded {
+			status.Failed = true
+			status.Message = fmt.Sprintf("Deployment exceeded its progress deadline. %s", c.Message)
+			return status
+		}
+	}
+
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	switch {
+	case d.Status.UpdatedReplicas < replicas:
+		status.Message = fmt.Sprintf("Waiting for rollout to finish: %d of %d updated replicas are available", d.Status.UpdatedReplicas, replicas)
+	case d.Status.Replicas > d.Status.UpdatedReplicas:
+		status.Message = fmt.Sprintf("Waiting for rollout to finish: %d old replicas are pending termination", d.Status.Replicas-d.Status.UpdatedReplicas)
+	case d.Status.AvailableReplicas < d.Status.UpdatedReplicas:
+		status.Message = fmt.Sprintf("Waiting for rollout to finish: %d of %d updated replicas are available", d.Status.AvailableReplicas, d.Status.UpdatedReplicas)
+	default:
+		status.Done = true
+		status.Message = "Successfully rolled out"
+	}
+
+	return status
+}
+
+// StatefulSetRolloutStatus returns the rollout status of a StatefulSet, using
+// the same checks as 'kubectl rollout status'
+func StatefulSetRolloutStatus(s *appsv1.StatefulSet) *RolloutStatus {
+
+	status := &RolloutStatus{Kind: KindStatefulSet, Namespace: s.Namespace, Name: s.Name, podSelector: s.Spec.Selector}
+
+	if s.Generation > s.Status.ObservedGeneration {
+		status.Message = "Waiting for the statefulset spec update to be observed"
+		return status
+	}
+
+	replicas := int32(1)
+	if s.Spec.Replicas != nil {
+		replicas = *s.Spec.Replicas
+	}
+	if s.Status.ReadyReplicas < replicas {
+		status.Message = fmt.Sprintf("Waiting for %d pods to be ready", replicas-s.Status.ReadyReplicas)
+		return status
+	}
+
+	if s.Spec.UpdateStrategy.Type == appsv1.RollingUpdateStatefulSetStrategyType {
+		if s.Spec.UpdateStrategy.RollingUpdate != nil && s.Spec.UpdateStrategy.RollingUpdate.Partition != nil {
+			partition := *s.Spec.UpdateStrategy.RollingUpdate.Partition
+			if s.Status.UpdatedReplicas < replicas-partition {
+				status.Message = fmt.Sprintf("Waiting for partitioned rollout to finish: %d of %d new pods have been updated", s.Status.UpdatedReplicas, replicas-partition)
+				return status
+			}
+		} else if s.Status.UpdateRevision != s.Status.CurrentRevision {
+			status.Message = fmt.Sprintf("Waiting for rolling update to complete: %d pods at revision %s", s.Status.UpdatedReplicas, s.Status.UpdateRevision)
+			return status
+		}
+	}
+
+	status.Done = true
+	status.Message = "Successfully rolled out"
+	return status
+}
+
+// DaemonSetRolloutStatus returns the rollout status of a DaemonSet, using the
+// same checks as 'kubectl rollout status'
+func DaemonSetRolloutStatus(d *appsv1.DaemonSet) *RolloutStatus {
+
+	status := &RolloutStatus{Kind: KindDaemonSet, Namespace: d.Namespace, Name: d.Name, podSelector: d.Spec.Selector}
+
+	if d.Generation > d.Status.ObservedGeneration {
+		status.Message = "Waiting for the daemonset spec update to be observed"
+		return status
+	}
+
+	switch {
+	case d.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType && d.Status.UpdatedNumberScheduled < d.Status.DesiredNumberScheduled:
+		status.Message = fmt.Sprintf("Waiting for rollout to finish: %d of %d updated pods are scheduled", d.Status.UpdatedNumberScheduled, d.Status.DesiredNumberScheduled)
+	case d.Status.NumberAvailable < d.Status.DesiredNumberScheduled:
+		status.Message = fmt.Sprintf("Waiting for rollout to finish: %d of %d pods are available", d.Status.NumberAvailable, d.Status.DesiredNumberScheduled)
+	default:
+		status.Done = true
+		status.Message = "Successfully rolled out"
+	}
+
+	return status
+}
+
+// PodDiagnostics describes the recent events of a workload and the container
+// statuses and events of its pods which are not ready, to help find out why a
+// rollout did not complete
+func (k *Kubernetes) PodDiagnostics(status *RolloutStatus) (string, error) {
+
+	clientset, err := k.GetClientset()
+	if err != nil {
+		return "", err
+	}
+	core := clientset.CoreV1()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s\n", status, status.Message)
+
+	events, err := core.Events(status.Namespace).List(metav1.ListOptions{FieldSelector: eventSelector(status.Kind, status.Name)})
+	if err != nil {
+		return "", err
+	}
+	writeEvents(&b, "  ", events.Items)
+
+	if status.podSelector == nil {
+		return b.String(), nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(status.podSelector)
+	if err != nil {
+		return "", err
+	}
+	pods, err := core.Pods(status.Namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", err
+	}
+
+	for _, pod := range pods.Items {
+		if podReady(&pod) {
+			continue
+		}
+		fmt.Fprintf(&b, "  Pod %s (%s)\n", pod.Name, pod.Status.Phase)
+		writeContainerStatuses(&b, "    ", append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...))
+		events, err := core.Events(status.Namespace).List(metav1.ListOptions{FieldSelector: eventSelector("Pod", pod.Name)})
+		if err != nil {
+			return "", err
+		}
+		writeEvents(&b, "    ", events.Items)
+	}
+
+	return b.String(), nil
+}
+
+// eventSelector returns the field selector for the events of an object
+func eventSelector(kind string, name string) string {
+	return fields.Set{"involvedObject.kind": kind, "involvedObject.name": name}.AsSelector().String()
+}
+
+// podReady returns true if the pod has the Ready condition
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// writeContainerStatuses writes a line for each container that is not ready
+func writeContainerStatuses(b *strings.Builder, indent string, statuses []corev1.ContainerStatus) {
+	for _, c := range statuses {
+		if c.Ready {
+			continue
+		}
+		fmt.Fprintf(b, "%sContainer %s: %s, restarts: %d\n", indent, c.Name, describeContainerState(c.State), c.RestartCount)
+		if c.LastTerminationState.Terminated != nil {
+			fmt.Fprintf(b, "%s  Last state: %s\n", indent, describeContainerState(c.LastTerminationState))
+		}
+	}
+}
+
+// describeContainerState returns a description of a container state
+func describeContainerState(state corev1.ContainerState) string {
+	switch {
+	case state.Waiting != nil:
+		return strings.TrimSpace(fmt.Sprintf("waiting (%s) %s", state.Waiting.Reason, state.Waiting.Message))
+	case state.Terminated != nil:
+		return strings.TrimSpace(fmt.Sprintf("terminated (%s, exit code %d) %s", state.Terminated.Reason, state.Terminated.ExitCode, state.Terminated.Message))
+	case state.Running != nil:
+		return "running, not ready"
+	}
+	return "unknown"
+}
+
+// writeEvents writes the most recent events, oldest first
+func writeEvents(b *strings.Builder, indent string, events []corev1.Event) {
+	if len(events) == 0 {
+		return
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].LastTimestamp.Before(&events[j].LastTimestamp) })
+	if len(events) > maxEvents {
+		events = events[len(events)-maxEvents:]
+	}
+	fmt.Fprintf(b, "%sEvents:\n", indent)
+	for _, e := range events {
+		fmt.Fprintf(b, "%s  %s\t%s\t%s\n", indent, e.Type, e.Reason, strings.TrimSpace(e.Message))
+	}
+}
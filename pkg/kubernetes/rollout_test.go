@@ -0,0 +1,73 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func TestDeploymentRolloutStatus(t *testing.T) {
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "apps", Generation: 2},
+		Spec:       appsv1.DeploymentSpec{Replicas: int32Ptr(3)},
+		Status:     appsv1.DeploymentStatus{ObservedGeneration: 1},
+	}
+	status := DeploymentRolloutStatus(d)
+	assert.Assert(t, !status.Done && !status.Failed)
+	assert.Equal(t, "Deployment apps/api", status.String())
+
+	d.Status = appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 4, UpdatedReplicas: 3, AvailableReplicas: 3}
+	status = DeploymentRolloutStatus(d)
+	assert.Equal(t, "Waiting for rollout to finish: 1 old replicas are pending termination", status.Message)
+	assert.Assert(t, !status.Done)
+
+	d.Status.Replicas = 3
+	assert.Assert(t, DeploymentRolloutStatus(d).Done)
+
+	d.Status.UpdatedReplicas = 1
+	d.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Reason: progressDeadlineExceeded, Message: "ReplicaSet \"api-1\" has timed out progressing."}}
+	status = DeploymentRolloutStatus(d)
+	assert.Assert(t, status.Failed && !status.Done)
+}
+
+func TestStatefulSetRolloutStatus(t *testing.T) {
+	s := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "apps", Generation: 1},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:       int32Ptr(3),
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+		},
+		Status: appsv1.StatefulSetStatus{ObservedGeneration: 1, ReadyReplicas: 2},
+	}
+	assert.Equal(t, "Waiting for 1 pods to be ready", StatefulSetRolloutStatus(s).Message)
+
+	s.Status = appsv1.StatefulSetStatus{ObservedGeneration: 1, ReadyReplicas: 3, UpdatedReplicas: 1, CurrentRevision: "db-1", UpdateRevision: "db-2"}
+	assert.Assert(t, !StatefulSetRolloutStatus(s).Done)
+
+	s.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateStatefulSetStrategy{Partition: int32Ptr(2)}
+	assert.Assert(t, StatefulSetRolloutStatus(s).Done)
+
+	s.Spec.UpdateStrategy.RollingUpdate = nil
+	s.Status.CurrentRevision = "db-2"
+	assert.Assert(t, StatefulSetRolloutStatus(s).Done)
+}
+
+func TestDaemonSetRolloutStatus(t *testing.T) {
+	d := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "monitoring", Generation: 1},
+		Status:     appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 2, NumberAvailable: 3},
+	}
+	assert.Equal(t, "Waiting for rollout to finish: 2 of 3 updated pods are scheduled", DaemonSetRolloutStatus(d).Message)
+
+	d.Spec.UpdateStrategy.Type = appsv1.OnDeleteDaemonSetStrategyType
+	assert.Assert(t, DaemonSetRolloutStatus(d).Done)
+
+	d.Status.NumberAvailable = 1
+	assert.Equal(t, "Waiting for rollout to finish: 1 of 3 pods are available", DaemonSetRolloutStatus(d).Message)
+}
@@ -1,9 +1,14 @@
 package pagerduty
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	pdApi "github.com/PagerDuty/go-pagerduty"
 	"github.com/PremiereGlobal/stim/pkg/utils"
@@ -29,6 +34,24 @@ type Event struct {
 	DedupKey  string
 }
 
+// ChangeEvent contains the fields used to send a change event
+type ChangeEvent struct {
+	Service       string
+	Summary       string
+	Source        string
+	CustomDetails map[string]string
+}
+
+// Events API v2 endpoints for events and change events
+const (
+	eventURL       = "https://events.pagerduty.com/v2/enqueue"
+	changeEventURL = "https://events.pagerduty.com/v2/change/enqueue"
+)
+
+// httpClient is used for all requests to PagerDuty so that a stalled endpoint
+// can't block the caller indefinitely
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
 type Logger interface {
 	Debug(...interface{})
 	Warn(...interface{})
@@ -40,6 +63,7 @@ func New(apiKey string, log Logger) *Pagerduty {
 
 	// Initialize client
 	client := pdApi.NewClient(apiKey)
+	client.HTTPClient = httpClient
 	p := &Pagerduty{client: client, log: log}
 
 	return p
@@ -125,12 +149,12 @@ func (p *Pagerduty) SendEvent(e *Event) error {
 		DedupKey:   e.DedupKey,
 	}
 
-	_, err = pdApi.ManageEvent(event)
+	body, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return postEvent(eventURL, body)
 }
 
 func (p *Pagerduty) validateEventFields(e *Event) error {
@@ -200,3 +224,61 @@ func (p *Pagerduty) getServiceIntegrationID(servicename string) (string, error)
 
 	return integrationid, nil
 }
+
+// SendChangeEvent sends the provided ChangeEvent to Pagerduty.  It
+// automatically detects and sets the hostname as the `source`, if not set.
+func (p *Pagerduty) SendChangeEvent(e *ChangeEvent) error {
+
+	if e.Service == "" {
+		return errors.New("Pagerduty: Change Event Service Name must be set")
+	}
+	if e.Summary == "" {
+		return errors.New("Pagerduty: Change Event Summary must be set")
+	}
+
+	integrationid, err := p.getServiceIntegrationID(e.Service)
+	if err != nil {
+		return err
+	}
+
+	source := e.Source
+	if source == "" {
+		source, err = os.Hostname()
+		if err != nil {
+			source = "unknown"
+		}
+	}
+
+	event := map[string]interface{}{
+		"routing_key": integrationid,
+		"payload": map[string]interface{}{
+			"summary":        e.Summary,
+			"source":         source,
+			"timestamp":      time.Now().UTC().Format(time.RFC3339),
+			"custom_details": e.CustomDetails,
+		},
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return postEvent(changeEventURL, body)
+}
+
+// postEvent sends an event to the Events API v2 endpoint
+func postEvent(url string, body []byte) error {
+
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return errors.New(fmt.Sprintf("Pagerduty: Event failed with HTTP status %d", resp.StatusCode))
+	}
+
+	return nil
+}
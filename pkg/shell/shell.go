@@ -1,22 +1,57 @@
 package shell
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os/exec"
 	"syscall"
+	"time"
 )
 
+// killGracePeriod is how long a cancelled command has to exit after SIGTERM
+// before it is killed
+const killGracePeriod = 10 * time.Second
+
 // ShellCommand defines shell command parameters
 type ShellCommand struct {
 	Shell   []string
 	Envs    []string
 	Command []string
 	WorkDir string
+
+	// Context, if set, stops the command when it is done.  The command is run
+	// in its own process group so that any processes it starts are stopped too.
+	Context context.Context
+
+	// Stdout and Stderr, if set, receive the output of the command as it is
+	// written instead of it being captured and returned
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Stdin, if set, is connected to the command input
+	Stdin io.Reader
+
+	// Interactive commands stay in the process group of stim so they can use
+	// the terminal.  When cancelled, only the command process is stopped.
+	Interactive bool
+}
+
+// ExitError is returned when a shell command exits with a non-zero exit code
+type ExitError struct {
+	ExitCode int
+	Stderr   string
 }
 
-// Run runs a shell command and returns the output
+// Error implements the error interface
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Shell command exit with code %d. %v", e.ExitCode, e.Stderr)
+}
+
+// Run runs a shell command and returns the output.  If Stdout is set the
+// output is written there instead and the returned output is empty.
 func Run(shellCommand ShellCommand) (string, error) {
 
 	// Set default shell
@@ -31,30 +66,63 @@ func Run(shellCommand ShellCommand) (string, error) {
 	fullCommand := append(shellCommand.Shell, shellCommand.Command...)
 	cmd := exec.Command(fullCommand[0], fullCommand[1:]...)
 	cmd.Env = shellCommand.Envs
+	cmd.Stdin = shellCommand.Stdin
 
-	// Capture stdout messages
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
+	// Capture stdout messages, unless they are streamed
+	var stdoutMessage, stderrMessage []byte
+	var stdout, stderr io.Reader = eofReader{}, eofReader{}
+	var err error
+	if shellCommand.Stdout != nil {
+		cmd.Stdout = shellCommand.Stdout
+	} else if stdout, err = cmd.StdoutPipe(); err != nil {
 		return "", errors.New(fmt.Sprintf("Error creating stdout pipe. %v", err))
 	}
 
-	// Capture stderr messages
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
+	// Capture stderr messages, unless they are streamed
+	if shellCommand.Stderr != nil {
+		cmd.Stderr = shellCommand.Stderr
+	} else if stderr, err = cmd.StderrPipe(); err != nil {
 		return "", errors.New(fmt.Sprintf("Error creating stderr pipe. %v", err))
 	}
 
+	// Contexts which can never be done (ex. context.Background) are ignored
+	cancellable := shellCommand.Context != nil && shellCommand.Context.Done() != nil
+	pgid := cancellable && !shellCommand.Interactive
+	if pgid {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
 	// Run the command (async)
 	if err := cmd.Start(); err != nil {
 		return "", errors.New(fmt.Sprintf("Error starting command %v", err))
 	}
 
-	// Output strings
-	stdoutMessage, _ := ioutil.ReadAll(stdout)
-	stderrMessage, _ := ioutil.ReadAll(stderr)
+	if cancellable {
+		done := make(chan struct{})
+		defer close(done)
+		pid := cmd.Process.Pid
+		if pgid {
+			pid = -pid
+		}
+		go killOnDone(shellCommand.Context, pid, done)
+	}
+
+	// Output strings.  Both pipes are read at once so that a command filling
+	// the stderr pipe does not block while stdout is read.
+	stderrDone := make(chan struct{})
+	go func() {
+		stderrMessage, _ = ioutil.ReadAll(stderr)
+		close(stderrDone)
+	}()
+	stdoutMessage, _ = ioutil.ReadAll(stdout)
+	<-stderrDone
 
 	// Wait for command to finish
-	if err := cmd.Wait(); err != nil {
+	err = cmd.Wait()
+	if cancellable && shellCommand.Context.Err() != nil {
+		return string(stdoutMessage), shellCommand.Context.Err()
+	}
+	if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			// The program has exited with an exit code != 0
 
@@ -63,10 +131,43 @@ func Run(shellCommand ShellCommand) (string, error) {
 			// defined for both Unix and Windows and in both cases has
 			// an ExitStatus() method with the same signature.
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				return "", errors.New(fmt.Sprintf("Shell command exit with code %d. %v", status.ExitStatus(), string(stderrMessage)))
+				exitCode := status.ExitStatus()
+				if status.Signaled() {
+					// Follow the shell convention for commands killed by a signal
+					exitCode = 128 + int(status.Signal())
+				}
+				return "", &ExitError{ExitCode: exitCode, Stderr: string(stderrMessage)}
 			}
 		}
+		return "", errors.New(fmt.Sprintf("Error running command. %v", err))
 	}
 
 	return string(stdoutMessage), nil
 }
+
+// killOnDone stops the process (or process group, if pid is negative) when the
+// context is done, first with SIGTERM then with SIGKILL if it has not exited
+// after the grace period
+func killOnDone(ctx context.Context, pid int, exited chan struct{}) {
+	select {
+	case <-exited:
+		return
+	case <-ctx.Done():
+	}
+
+	syscall.Kill(pid, syscall.SIGTERM)
+
+	select {
+	case <-exited:
+	case <-time.After(killGracePeriod):
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// eofReader is an io.Reader with nothing to read, used for streamed output
+type eofReader struct{}
+
+// Read implements io.Reader
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,41 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The background sleep keeps the output pipes open unless the whole process group is stopped
+	start := time.Now()
+	_, err := Run(ShellCommand{Command: []string{"sleep 30 & sleep 30"}, Context: ctx})
+	assert.Equal(t, context.DeadlineExceeded, err, "Values not Equal")
+	assert.Assert(t, time.Since(start) < 10*time.Second, "Command was not stopped")
+
+	out, err := Run(ShellCommand{Command: []string{"echo done"}, Context: context.Background()})
+	assert.NilError(t, err)
+	assert.Equal(t, "done\n", out, "Values not Equal")
+}
+
+func TestRunStreams(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	out, err := Run(ShellCommand{Command: []string{"echo out; echo err >&2; exit 3"}, Stdout: &stdout, Stderr: &stderr})
+	assert.Equal(t, "", out, "Values not Equal")
+	assert.Equal(t, "out\n", stdout.String(), "Values not Equal")
+	assert.Equal(t, "err\n", stderr.String(), "Values not Equal")
+	exitErr, ok := err.(*ExitError)
+	assert.Assert(t, ok, "Expected an ExitError")
+	assert.Equal(t, 3, exitErr.ExitCode, "Values not Equal")
+
+	_, err = Run(ShellCommand{Command: []string{"kill -TERM $$"}})
+	exitErr, ok = err.(*ExitError)
+	assert.Assert(t, ok, "Expected an ExitError")
+	assert.Equal(t, 143, exitErr.ExitCode, "Values not Equal")
+}
@@ -2,6 +2,8 @@ package slack
 
 import (
 	"errors"
+	"net/http"
+	"time"
 
 	"github.com/PremiereGlobal/stim/pkg/stimlog"
 	"github.com/nlopes/slack"
@@ -37,7 +39,7 @@ type Logger interface {
 // New builds a slack client from the provided config
 func New(config *Config) (*Slack, error) {
 
-	client := slack.New(config.Token)
+	client := slack.New(config.Token, slack.OptionHTTPClient(&http.Client{Timeout: 30 * time.Second}))
 
 	s := &Slack{config: config, client: client}
 	if config.Log != nil {
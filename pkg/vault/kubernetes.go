@@ -0,0 +1,32 @@
+package vault
+
+import (
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// KubernetesCredentials generates a service account token using the Vault
+// Kubernetes secrets engine mounted at mount
+func (v *Vault) KubernetesCredentials(mount string, role string, namespace string, ttl string) (*api.Secret, error) {
+
+	data := map[string]interface{}{
+		"kubernetes_namespace": namespace,
+	}
+	if ttl != "" {
+		data["ttl"] = ttl
+	}
+
+	path := strings.Trim(mount, "/") + "/creds/" + role
+	v.log.Debug("Getting Kubernetes credentials via path: " + path)
+
+	secret, err := v.client.Logical().Write(path, data)
+	if err != nil {
+		return nil, v.parseError(err).(error)
+	}
+	if secret == nil {
+		return nil, v.newError("No Kubernetes credentials returned from `" + path + "`").(error)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,356 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrCheckAndSet is returned when a check-and-set write fails because the
+// secret was changed since it was read
+var ErrCheckAndSet = errors.New("Vault: check-and-set version did not match the current version of the secret")
+
+// KVVersion returns the version of the key-value secrets engine that the given
+// secret path is in.  Returns 0 if the path is not in a key-value mount.
+func (v *Vault) KVVersion(secretPath string) (int, error) {
+
+	mountPath, mountType, options, err := v.findMount(secretPath)
+	if err != nil {
+		return 0, err
+	}
+
+	if mountPath == "" || (mountType != "kv" && mountType != "generic") {
+		return 0, nil
+	}
+
+	if options["version"] == "2" {
+		return 2, nil
+	}
+
+	return 1, nil
+}
+
+// MountType returns the type of the mount (ex. kv, aws, database) that the
+// given secret path is in.  Returns an empty string if no mount matches.
+func (v *Vault) MountType(secretPath string) (string, error) {
+	_, mountType, _, err := v.findMount(secretPath)
+	return mountType, err
+}
+
+// SecretDataPath returns the API path used to read the given secret.  For
+// key-value version 2 mounts the 'data' sub-path is added if not present.
+func (v *Vault) SecretDataPath(secretPath string) (string, error) {
+	return v.kvSubPath(secretPath, "data")
+}
+
+// SecretMetadataPath returns the API path of the metadata for the given
+// key-value version 2 secret.  Other secrets are returned unchanged.
+func (v *Vault) SecretMetadataPath(secretPath string) (string, error) {
+	return v.kvSubPath(secretPath, "metadata")
+}
+
+// kvSubPath inserts the given sub-path after the mount for key-value version 2 secrets
+func (v *Vault) kvSubPath(secretPath string, subPath string) (string, error) {
+
+	version, err := v.KVVersion(secretPath)
+	if err != nil {
+		return "", err
+	}
+	if version != 2 {
+		return secretPath, nil
+	}
+
+	mountPath, _, _, err := v.findMount(secretPath)
+	if err != nil {
+		return "", err
+	}
+
+	rest := strings.TrimPrefix(strings.TrimPrefix(secretPath, "/"), mountPath)
+	for _, p := range []string{"data/", "metadata/"} {
+		rest = strings.TrimPrefix(rest, p)
+	}
+
+	return path.Join(mountPath, subPath, rest), nil
+}
+
+// findMount returns the path (with trailing slash), type and options of the
+// mount containing the given path.  The mount path is empty if no mount matches.
+func (v *Vault) findMount(secretPath string) (string, string, map[string]string, error) {
+
+	v.mountsLock.Lock()
+	defer v.mountsLock.Unlock()
+
+	if v.mounts == nil {
+		mounts, err := v.client.Sys().ListMounts()
+		if err != nil {
+			return "", "", nil, v.parseError(err).(error)
+		}
+		v.mounts = mounts
+	}
+
+	secretPath = strings.TrimPrefix(secretPath, "/")
+	mountPath := ""
+	for p := range v.mounts {
+		if strings.HasPrefix(secretPath, p) && len(p) > len(mountPath) {
+			mountPath = p
+		}
+	}
+
+	if mountPath == "" {
+		return "", "", nil, nil
+	}
+
+	return mountPath, v.mounts[mountPath].Type, v.mounts[mountPath].Options, nil
+}
+
+// ReadKV returns the data of the given key-value secret.  For key-value version
+// 2 mounts the latest version of the secret is returned.
+func (v *Vault) ReadKV(secretPath string) (map[string]interface{}, error) {
+
+	version, err := v.KVVersion(secretPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dataPath, err := v.SecretDataPath(secretPath)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := v.client.Logical().Read(dataPath)
+	if err != nil {
+		return nil, v.parseError(err).(error)
+	}
+
+	if secret == nil || secret.Data == nil {
+		return nil, v.newError("Could not find secret `" + secretPath + "`").(error)
+	}
+
+	if version != 2 {
+		return secret.Data, nil
+	}
+
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, v.newError("Could not find secret `" + secretPath + "`").(error)
+	}
+
+	return data, nil
+}
+
+// WriteKV writes the given data to a key-value secret.  For key-value version
+// 2 mounts a new version of the secret is created.
+func (v *Vault) WriteKV(secretPath string, data map[string]interface{}) error {
+
+	version, err := v.KVVersion(secretPath)
+	if err != nil {
+		return err
+	}
+
+	dataPath, err := v.SecretDataPath(secretPath)
+	if err != nil {
+		return err
+	}
+
+	if version == 2 {
+		data = map[string]interface{}{"data": data}
+	}
+
+	_, err = v.client.Logical().Write(dataPath, data)
+	if err != nil {
+		return v.parseError(err).(error)
+	}
+
+	return nil
+}
+
+// ListKV returns the keys under the given key-value secret path.  Returns an
+// empty list if there are no keys.
+func (v *Vault) ListKV(secretPath string) ([]string, error) {
+
+	listPath, err := v.SecretMetadataPath(secretPath)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := v.client.Logical().List(listPath)
+	if err != nil {
+		return nil, v.parseError(err).(error)
+	}
+
+	if secret == nil || secret.Data["keys"] == nil {
+		return []string{}, nil
+	}
+
+	var keys []string
+	for _, key := range secret.Data["keys"].([]interface{}) {
+		keys = append(keys, key.(string))
+	}
+
+	return keys, nil
+}
+
+// ReadKVVersion returns the data and current version of the given key-value
+// version 2 secret.  Returns version 0 if the secret does not exist, and nil
+// data if the secret does not exist or its current version is deleted.
+func (v *Vault) ReadKVVersion(secretPath string) (map[string]interface{}, int, error) {
+
+	if err := v.requireKV2(secretPath); err != nil {
+		return nil, 0, err
+	}
+
+	metadataPath, err := v.SecretMetadataPath(secretPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	metadata, err := v.client.Logical().Read(metadataPath)
+	if err != nil {
+		return nil, 0, v.parseError(err).(error)
+	}
+	if metadata == nil || metadata.Data == nil {
+		return nil, 0, nil
+	}
+
+	version, err := toInt(metadata.Data["current_version"])
+	if err != nil {
+		return nil, 0, v.newError("Invalid version of secret `" + secretPath + "`").(error)
+	}
+
+	dataPath, err := v.SecretDataPath(secretPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	secret, err := v.client.Logical().Read(dataPath)
+	if err != nil {
+		return nil, 0, v.parseError(err).(error)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, version, nil
+	}
+
+	data, _ := secret.Data["data"].(map[string]interface{})
+
+	return data, version, nil
+}
+
+// ResolveKVVersion returns the version of the given key-value version 2
+// secret that is read for the requested version.  Version 0 is the current
+// version and negative versions count back from the current version, skipping
+// deleted and destroyed versions.  Returns 0 if the secret is not in a
+// key-value version 2 mount.
+func (v *Vault) ResolveKVVersion(secretPath string, version int) (int, error) {
+
+	kvVersion, err := v.KVVersion(secretPath)
+	if err != nil {
+		return 0, err
+	}
+	if kvVersion != 2 {
+		return 0, nil
+	}
+	if version > 0 {
+		return version, nil
+	}
+
+	metadataPath, err := v.SecretMetadataPath(secretPath)
+	if err != nil {
+		return 0, err
+	}
+
+	metadata, err := v.client.Logical().Read(metadataPath)
+	if err != nil {
+		return 0, v.parseError(err).(error)
+	}
+	if metadata == nil || metadata.Data == nil {
+		return 0, v.newError("Secret `" + secretPath + "` does not exist").(error)
+	}
+
+	if version == 0 {
+		current, err := toInt(metadata.Data["current_version"])
+		if err != nil {
+			return 0, v.newError("Invalid version of secret `" + secretPath + "`").(error)
+		}
+		return current, nil
+	}
+
+	versions, _ := metadata.Data["versions"].(map[string]interface{})
+	keys := make([]int, 0, len(versions))
+	for key := range versions {
+		if n, err := strconv.Atoi(key); err == nil {
+			keys = append(keys, n)
+		}
+	}
+	sort.Ints(keys)
+
+	for i := len(keys) - 1 + version; i >= 0; i-- {
+		data, _ := versions[strconv.Itoa(keys[i])].(map[string]interface{})
+		deletionTime, _ := data["deletion_time"].(string)
+		destroyed, _ := data["destroyed"].(bool)
+		if deletionTime == "" && !destroyed {
+			return keys[i], nil
+		}
+	}
+
+	return 0, v.newError(fmt.Sprintf("Unable to find version %d of secret `%s`", version, secretPath)).(error)
+}
+
+// WriteKVCAS writes the given data to a key-value version 2 secret only if the
+// current version of the secret matches the given version (0 if the secret
+// must not exist).  Returns ErrCheckAndSet if the version does not match.
+func (v *Vault) WriteKVCAS(secretPath string, data map[string]interface{}, version int) error {
+
+	if err := v.requireKV2(secretPath); err != nil {
+		return err
+	}
+
+	dataPath, err := v.SecretDataPath(secretPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = v.client.Logical().Write(dataPath, map[string]interface{}{
+		"options": map[string]interface{}{"cas": version},
+		"data":    data,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "check-and-set") {
+			return ErrCheckAndSet
+		}
+		return v.parseError(err).(error)
+	}
+
+	return nil
+}
+
+// requireKV2 returns an error if the given path is not in a key-value version 2 mount
+func (v *Vault) requireKV2(secretPath string) error {
+
+	version, err := v.KVVersion(secretPath)
+	if err != nil {
+		return err
+	}
+	if version != 2 {
+		return v.newError("Secret path `" + secretPath + "` must be in a key-value version 2 mount").(error)
+	}
+
+	return nil
+}
+
+// toInt converts a number returned by the Vault API to an int
+func toInt(value interface{}) (int, error) {
+	switch n := value.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err
+	case float64:
+		return int(n), nil
+	case int:
+		return n, nil
+	}
+	return 0, errors.New(fmt.Sprintf("Invalid number %v", value))
+}
@@ -18,3 +18,10 @@ func (v *Vault) RenewLease(leaseID string, duration time.Duration) (time.Duratio
 
 	return leaseDuration, nil
 }
+
+// RevokeLease takes a Vault lease ID and revokes it immediately
+func (v *Vault) RevokeLease(leaseID string) error {
+
+	v.log.Debug("Revoking lease " + leaseID)
+	return v.client.Sys().Revoke(leaseID)
+}
@@ -2,6 +2,7 @@ package vault
 
 import (
 	"encoding/json"
+	"path"
 	"time"
 )
 
@@ -29,3 +30,78 @@ func (v *Vault) GetCurrentTokenTTL() (time.Duration, error) {
 
 	return duration, nil
 }
+
+// TokenIdentity describes who a token belongs to
+type TokenIdentity struct {
+	Username string
+	EntityID string
+	Policies []string
+}
+
+// GetTokenIdentity returns the identity of the current token, including the
+// policies granted through its identity entity and groups
+func (v *Vault) GetTokenIdentity() (*TokenIdentity, error) {
+
+	secret, err := v.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, v.parseError(err).(error)
+	}
+
+	identity := &TokenIdentity{}
+	if metadata, err := secret.TokenMetadata(); err == nil {
+		identity.Username = metadata["username"]
+	}
+	identity.EntityID, _ = secret.Data["entity_id"].(string)
+
+	policies, err := secret.TokenPolicies()
+	if err != nil {
+		return nil, v.parseError(err).(error)
+	}
+	identity.Policies = policies
+	if identityPolicies, ok := secret.Data["identity_policies"].([]interface{}); ok {
+		for _, policy := range identityPolicies {
+			if p, ok := policy.(string); ok {
+				identity.Policies = append(identity.Policies, p)
+			}
+		}
+	}
+
+	return identity, nil
+}
+
+// VerifyUser authenticates another user with the configured auth method,
+// without replacing the current token, and returns the identity of the user
+// The token obtained for the user is revoked straight away.
+func (v *Vault) VerifyUser(username string, password string) (*TokenIdentity, error) {
+
+	authPath := path.Join("auth/", v.config.AuthPath, "/login/", username)
+	secret, err := v.client.Logical().Write(authPath, map[string]interface{}{
+		"password": password,
+	})
+	if err != nil {
+		return nil, v.parseError(err).(error)
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, v.newError("No token returned when authenticating `" + username + "`").(error)
+	}
+
+	identity := &TokenIdentity{
+		Username: secret.Auth.Metadata["username"],
+		EntityID: secret.Auth.EntityID,
+		Policies: secret.Auth.Policies,
+	}
+	if identity.Username == "" {
+		identity.Username = username
+	}
+
+	client, err := v.client.Clone()
+	if err == nil {
+		client.SetToken(secret.Auth.ClientToken)
+		err = client.Auth().Token().RevokeSelf("")
+	}
+	if err != nil {
+		v.log.Warn("Unable to revoke token for `" + username + "`")
+	}
+
+	return identity, nil
+}
@@ -1,6 +1,7 @@
 package vault
 
 import (
+	"sync"
 	"time"
 
 	"github.com/PremiereGlobal/stim/pkg/stimlog"
@@ -14,6 +15,8 @@ type Vault struct {
 	tokenHelper token.InternalTokenHelper
 	newLogin    bool
 	log         Logger
+	mounts      map[string]*api.MountOutput
+	mountsLock  sync.Mutex
 }
 
 type Config struct {
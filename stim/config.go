@@ -51,6 +51,20 @@ func (stim *Stim) ConfigGetString(configKey string) string {
 	return configValue
 }
 
+// ConfigGetStringSlice takes a config key and returns the list of strings
+func (stim *Stim) ConfigGetStringSlice(configKey string) []string {
+	var envCV []string
+	configValue := stim.config.GetStringSlice(configKey)
+	if strings.Contains(configKey, ".") {
+		envCK := strings.ReplaceAll(configKey, ".", "-")
+		envCV = stim.config.GetStringSlice(envCK)
+	}
+	if len(envCV) > 0 {
+		return envCV
+	}
+	return configValue
+}
+
 func (stim *Stim) ConfigGetDuration(configKey string) time.Duration {
 	var envCV time.Duration
 	configValue := stim.config.GetDuration(configKey)
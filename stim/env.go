@@ -1,16 +1,16 @@
 package stim
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
 
-	"github.com/PremiereGlobal/stim/pkg/downloader"
 	"github.com/PremiereGlobal/stim/pkg/env"
 	"github.com/PremiereGlobal/stim/pkg/kubernetes"
 	"github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 // EnvConfig represets a environment configuration
@@ -31,6 +31,9 @@ type EnvConfig struct {
 
 	// Tools should contains a list of supported binary tools to install and link
 	Tools map[string]EnvTool
+
+	// ToolVersions is set by Env to the versions of the tools that were linked
+	ToolVersions map[string]string
 }
 
 // EnvConfig represets a environment's Kubernetes configuration
@@ -44,6 +47,14 @@ type EnvConfigKubernetes struct {
 
 	// DefaultNamespace to use when setting up Kubernetes
 	DefaultNamespace string
+
+	// VaultPath is the Vault secret holding the cluster credentials.  Defaults
+	// to the path given by KubeConfigVaultPath
+	VaultPath string
+
+	// KubeConfig, if set, is written as the kubeconfig instead of reading the
+	// cluster credentials from Vault
+	KubeConfig *clientcmdapi.Config
 }
 
 // EnvConfig represets a environment's Vault configuration
@@ -61,13 +72,24 @@ type EnvTool struct {
 
 // Env sets up an environment based on the given config
 // Shell commands can be executed against the environment
-func (stim *Stim) Env(config *EnvConfig) *env.Env {
+func (stim *Stim) Env(config *EnvConfig) (*env.Env, error) {
 
 	e, err := env.New(env.Config{})
 	if err != nil {
-		stim.log.Fatal("Stim: Error creating new environment.", err)
+		return nil, errors.New(fmt.Sprintf("Stim: Error creating new environment. %v", err))
+	}
+
+	if err := stim.setupEnv(e, config); err != nil {
+		e.Close()
+		return nil, err
 	}
 
+	return e, nil
+}
+
+// setupEnv sets up the Kubernetes config, secrets and tools of the environment
+func (stim *Stim) setupEnv(e *env.Env, config *EnvConfig) error {
+
 	e.SetWorkDir(config.WorkDir)
 	e.AddEnvVars(config.EnvVars...)
 
@@ -77,37 +99,10 @@ func (stim *Stim) Env(config *EnvConfig) *env.Env {
 
 		// This is the path where the kubeconfig will be written
 		kubeConfigFilePath := filepath.Join(e.GetPath(), "kubeconfig")
-
-		vault := stim.Vault()
-
-		// Get the Kubernetes creds from Vault
-		secretValues, err := vault.GetSecretKeys("secret/kubernetes/" + config.Kubernetes.Cluster + "/" + config.Kubernetes.ServiceAccount + "/kube-config")
-		if err != nil {
-			stim.log.Fatal("Stim: Error getting kubeconfig secrets for environment. {}", err)
-		}
-
-		// If namespace not set use the default from Vault
-		defaultNamespace := config.Kubernetes.DefaultNamespace
-		if defaultNamespace == "" {
-			defaultNamespace = secretValues["default-namespace"]
-		}
-
-		// Build the Kube config options
-		kubeConfigOptions := &kubernetes.ConfigOptions{
-			ClusterName:             config.Kubernetes.Cluster,
-			ClusterServer:           secretValues["cluster-server"],
-			ClusterCA:               secretValues["cluster-ca"],
-			AuthName:                config.Kubernetes.Cluster + "-" + config.Kubernetes.ServiceAccount,
-			AuthToken:               secretValues["user-token"],
-			ContextName:             config.Kubernetes.Cluster,
-			ContextSetCurrent:       true,
-			ContextDefaultNamespace: defaultNamespace,
-		}
-
-		kc = kubernetes.NewConfigFromPath(kubeConfigFilePath)
-		err = kc.Modify(kubeConfigOptions)
+		var err error
+		kc, err = stim.KubeConfig(kubeConfigFilePath, config.Kubernetes)
 		if err != nil {
-			stim.log.Fatal("Stim: Error writing kubeconfig for environment. {}", err)
+			return err
 		}
 
 		// Tell the environment to use the kubeconfig in the environment PATH
@@ -121,12 +116,12 @@ func (stim *Stim) Env(config *EnvConfig) *env.Env {
 
 		vaultAddress, err := vault.GetAddress()
 		if err != nil {
-			stim.log.Fatal("Stim: Unable to get Vault address for environment. {}", err)
+			return errors.New(fmt.Sprintf("Stim: Unable to get Vault address for environment. %v", err))
 		}
 
 		vaultToken, err := vault.GetToken()
 		if err != nil {
-			stim.log.Fatal("Stim: Unable to get Vault token for environment. {}", err)
+			return errors.New(fmt.Sprintf("Stim: Unable to get Vault token for environment. %v", err))
 		}
 
 		v2e := vaulttoenvs.NewVaultToEnvs(&vaulttoenvs.Config{
@@ -148,72 +143,27 @@ func (stim *Stim) Env(config *EnvConfig) *env.Env {
 					sleepTime += sleepTime
 					continue
 				}
-				stim.log.Fatal("Stim: Unable to get Vault secrets for environment. {}", err)
+				return errors.New(fmt.Sprintf("Stim: Unable to get Vault secrets for environment. %v", err))
 			}
 			break
 		}
 		if err != nil {
-			stim.log.Fatal("Stim: Unable to get Vault secrets for environment. {}", err)
+			return errors.New(fmt.Sprintf("Stim: Unable to get Vault secrets for environment. %v", err))
 		}
 
 		e.AddEnvVars(secretEnvs...)
 	}
 
 	// if requiring any CLI tools, download and link them here
-	for toolName, toolParams := range config.Tools {
-
-		version := toolParams.Version
-		if version == "" {
-			stim.log.Debug("Detecting tool version for: {}", toolName)
-		} else {
-			stim.log.Debug("Setting tool version {}/{} based on configuration", toolName, version)
-		}
-
-		var dl downloader.Downloader
-		cacheDir := stim.ConfigGetCacheDir(filepath.Join("bin", runtime.GOOS))
-		switch toolName {
-		case "vault":
-			if version == "" {
-				version, err = stim.Vault().Version()
-				if err != nil {
-					stim.log.Fatal("Unable to determine version for {}: {}", toolName, err)
-				}
-			}
-			dl = downloader.NewVaultDownloader(version, cacheDir)
-		case "kubectl":
-			if version == "" {
-				if kc == nil {
-					stim.log.Fatal("Kubernetes server not specified, cannot determine version")
-				}
-				k, err := kubernetes.New(kc)
-				if err != nil {
-					stim.log.Fatal("Unable to load Kube config, cannot determine version")
-				}
-				version, err = k.Version()
-				if err != nil {
-					stim.log.Fatal("Unable to determine version for {}: {}", toolName, err)
-				}
-			}
-			dl = downloader.NewKubeDownloader(version, cacheDir)
-		case "helm":
-			if version == "" {
-				stim.log.Fatal("Version detection not supported for helm, please specify a version in the config")
-			}
-			dl = downloader.NewHelmDownloader(version, cacheDir)
-		default:
-			stim.log.Fatal("Unknown deploy tool: {}", toolName)
-		}
-
-		result, err := dl.Download()
-		if err != nil {
-			stim.log.Fatal("Download failed: {} {}", result, err)
-		}
-		if !result.FileExists {
-			stim.log.Debug("Downloaded {} in {}", result.RenderedURL, result.DownloadDuration)
-		}
-		stim.log.Debug("Linking binary from {} to PATH location {}/{}", dl.GetBinPath(), e.GetPath(), toolName)
-		e.Link(dl.GetBinPath(), toolName)
+	versions, err := stim.LinkTools(&ToolsConfig{
+		Tools:      config.Tools,
+		LinkDir:    e.GetPath(),
+		Kubernetes: kc,
+	})
+	if err != nil {
+		return err
 	}
+	config.ToolVersions = versions
 
-	return e
+	return nil
 }
@@ -2,6 +2,7 @@ package stim
 
 import (
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/PremiereGlobal/stim/pkg/utils"
@@ -94,6 +95,17 @@ func (stim *Stim) PromptString(label string, defaultvalue string) (string, error
 	return result, nil
 }
 
+// PromptPassword prompts the user for a secret value, masking the input
+func (stim *Stim) PromptPassword(label string) (string, error) {
+
+	prompt := promptui.Prompt{
+		Label: label,
+		Mask:  '*',
+	}
+
+	return prompt.Run()
+}
+
 // PromptList prompts the user to select from the list of string provided
 // If override string is not empty it will be returned without
 func (stim *Stim) PromptList(label string, list []string, override string) (string, error) {
@@ -117,6 +129,52 @@ func (stim *Stim) PromptList(label string, list []string, override string) (stri
 	return result, nil
 }
 
+// PromptMultiSelect prompts the user to select any number of items from the
+// list of strings provided.  Items are toggled one at a time until the user
+// selects 'Done'.  Returns the selected items in the order of the list.
+func (stim *Stim) PromptMultiSelect(label string, list []string) ([]string, error) {
+
+	selected := make([]bool, len(list))
+	for {
+		count := 0
+		items := make([]string, len(list)+1)
+		for i, item := range list {
+			if selected[i] {
+				items[i+1] = "[x] " + item
+				count++
+			} else {
+				items[i+1] = "[ ] " + item
+			}
+		}
+		items[0] = "Done (" + strconv.Itoa(count) + " selected)"
+
+		prompt := promptui.Select{
+			Label: label,
+			Items: items,
+			Size:  10,
+		}
+
+		index, _, err := prompt.Run()
+		if err != nil {
+			return nil, err
+		}
+
+		if index == 0 {
+			break
+		}
+		selected[index-1] = !selected[index-1]
+	}
+
+	result := []string{}
+	for i, item := range list {
+		if selected[i] {
+			result = append(result, item)
+		}
+	}
+
+	return result, nil
+}
+
 // PromptListVault uses a path from vault and prompts to select the list
 // of secrets within that list.  Returns the value selected.
 // If override string is not empty it will be returned without
@@ -0,0 +1,235 @@
+package stim
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/PremiereGlobal/stim/pkg/downloader"
+	"github.com/PremiereGlobal/stim/pkg/kubernetes"
+	"github.com/PremiereGlobal/stim/pkg/utils"
+)
+
+// toolDownloadLock ensures that only one environment downloads tool binaries
+// at a time, as concurrent environments may share the same cache paths
+var toolDownloadLock sync.Mutex
+
+// ToolsConfig represents a set of CLI tools to download and link
+type ToolsConfig struct {
+
+	// Tools to download and link, keyed by tool name
+	Tools map[string]EnvTool
+
+	// OS to download the tool binaries for.  Defaults to the current OS
+	OS string
+
+	// LinkDir is the directory the tool symlinks are created in
+	LinkDir string
+
+	// LinkSourceDir, if set, is used as the target directory of the symlinks
+	// instead of the cache directory.  This is used when the links are mounted
+	// into a container which has the cache directory mounted at LinkSourceDir.
+	LinkSourceDir string
+
+	// Kubernetes is used to detect the kubectl version if it is not set
+	Kubernetes *kubernetes.Config
+}
+
+// KubeConfigVaultPath returns the Vault secret holding the Kubernetes
+// credentials for the given cluster and service account, according to the
+// kube.config.path and kube.config.keyname settings
+func (stim *Stim) KubeConfigVaultPath(cluster string, serviceAccount string) string {
+	return strings.Join([]string{strings.TrimSuffix(stim.ConfigGetString("kube.config.path"), "/"), cluster, serviceAccount, stim.ConfigGetString("kube.config.keyname")}, "/")
+}
+
+// KubeClusters lists the clusters with Kubernetes credentials in Vault under
+// kube.config.path, filtered by the given regex
+func (stim *Stim) KubeClusters(filter string) ([]string, error) {
+	clusters, err := stim.Vault().ListSecrets(strings.TrimSuffix(stim.ConfigGetString("kube.config.path"), "/"))
+	if err != nil {
+		return nil, err
+	}
+	return utils.Filter(clusters, filter)
+}
+
+// KubeServiceAccounts lists the service accounts of the cluster with
+// Kubernetes credentials in Vault, filtered by the given regex.  If
+// filterByToken is set, only the service accounts whose credentials can be
+// read with the current Vault token are returned.
+func (stim *Stim) KubeServiceAccounts(cluster string, filter string, filterByToken bool) ([]string, error) {
+
+	path := strings.TrimSuffix(stim.ConfigGetString("kube.config.path"), "/") + "/" + cluster
+	serviceAccounts, err := stim.Vault().ListSecrets(path)
+	if err != nil {
+		return nil, err
+	}
+	regexFilteredServiceAccounts, err := utils.Filter(serviceAccounts, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !filterByToken {
+		return regexFilteredServiceAccounts, nil
+	}
+
+	var paths []string
+	for _, serviceAccount := range regexFilteredServiceAccounts {
+		paths = append(paths, stim.KubeConfigVaultPath(cluster, serviceAccount))
+	}
+
+	filteredPaths, err := stim.Vault().Filter(paths, []string{"read"})
+	if err != nil {
+		return nil, err
+	}
+
+	kubeKeyName := stim.ConfigGetString("kube.config.keyname")
+	tokenFilteredServiceAccounts := []string{}
+	for _, filteredPath := range filteredPaths {
+		sa := strings.TrimSuffix(filteredPath, "/"+kubeKeyName)
+		sa = strings.TrimPrefix(sa, path+"/")
+		tokenFilteredServiceAccounts = append(tokenFilteredServiceAccounts, sa)
+	}
+
+	sort.Strings(tokenFilteredServiceAccounts)
+	return tokenFilteredServiceAccounts, nil
+}
+
+// KubeConfig writes a kubeconfig file to the given path using the given
+// kubeconfig, or otherwise the Kubernetes credentials in Vault for the given
+// cluster and service account
+func (stim *Stim) KubeConfig(kubeConfigFilePath string, config *EnvConfigKubernetes) (*kubernetes.Config, error) {
+
+	kc := kubernetes.NewConfigFromPath(kubeConfigFilePath)
+
+	if config.KubeConfig != nil {
+		if err := kc.Write(config.KubeConfig); err != nil {
+			return nil, errors.New(fmt.Sprintf("Stim: Error writing kubeconfig for environment. %v", err))
+		}
+		return kc, nil
+	}
+
+	vault := stim.Vault()
+
+	vaultPath := config.VaultPath
+	if vaultPath == "" {
+		vaultPath = stim.KubeConfigVaultPath(config.Cluster, config.ServiceAccount)
+	}
+
+	// Get the Kubernetes creds from Vault
+	secretValues, err := vault.GetSecretKeys(vaultPath)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Stim: Error getting kubeconfig secrets for environment. %v", err))
+	}
+
+	// If namespace not set use the default from Vault
+	defaultNamespace := config.DefaultNamespace
+	if defaultNamespace == "" {
+		defaultNamespace = secretValues["default-namespace"]
+	}
+
+	// Build the Kube config options
+	kubeConfigOptions := &kubernetes.ConfigOptions{
+		ClusterName:             config.Cluster,
+		ClusterServer:           secretValues["cluster-server"],
+		ClusterCA:               secretValues["cluster-ca"],
+		AuthName:                config.Cluster + "-" + config.ServiceAccount,
+		AuthToken:               secretValues["user-token"],
+		ContextName:             config.Cluster,
+		ContextSetCurrent:       true,
+		ContextDefaultNamespace: defaultNamespace,
+	}
+
+	err = kc.Modify(kubeConfigOptions)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Stim: Error writing kubeconfig for environment. %v", err))
+	}
+
+	return kc, nil
+}
+
+// LinkTools downloads the configured tools and links them into the link
+// directory.  Tool versions which are not set are detected where possible.
+// Returns the version used for each tool.
+func (stim *Stim) LinkTools(config *ToolsConfig) (map[string]string, error) {
+
+	goos := config.OS
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	cacheDir := stim.ConfigGetCacheDir(filepath.Join("bin", goos))
+
+	versions := make(map[string]string)
+	for toolName, toolParams := range config.Tools {
+
+		var err error
+		version := toolParams.Version
+		if version == "" {
+			stim.log.Debug("Detecting tool version for: {}", toolName)
+		} else {
+			stim.log.Debug("Setting tool version {}/{} based on configuration", toolName, version)
+		}
+
+		var dl downloader.Downloader
+		switch toolName {
+		case "vault":
+			if version == "" {
+				version, err = stim.Vault().Version()
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("Unable to determine version for %s: %v", toolName, err))
+				}
+			}
+			dl = downloader.NewVaultDownloader(version, cacheDir)
+		case "kubectl":
+			if version == "" {
+				if config.Kubernetes == nil {
+					return nil, errors.New("Kubernetes server not specified, cannot determine version")
+				}
+				k, err := kubernetes.New(config.Kubernetes)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("Unable to load Kube config, cannot determine version. %v", err))
+				}
+				version, err = k.Version()
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("Unable to determine version for %s: %v", toolName, err))
+				}
+			}
+			dl = downloader.NewKubeDownloader(version, cacheDir)
+		case "helm":
+			if version == "" {
+				return nil, errors.New("Version detection not supported for helm, please specify a version in the config")
+			}
+			dl = downloader.NewHelmDownloader(version, cacheDir)
+		default:
+			return nil, errors.New(fmt.Sprintf("Unknown deploy tool: %s", toolName))
+		}
+		dl.SetOS(goos)
+
+		toolDownloadLock.Lock()
+		result, err := dl.Download()
+		toolDownloadLock.Unlock()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Download of %s failed. %v", toolName, err))
+		}
+		if !result.FileExists {
+			stim.log.Debug("Downloaded {} in {}", result.RenderedURL, result.DownloadDuration)
+		}
+
+		source := dl.GetBinPath()
+		if config.LinkSourceDir != "" {
+			source = filepath.Join(config.LinkSourceDir, dl.GetBinName())
+		}
+		stim.log.Debug("Linking binary from {} to PATH location {}/{}", source, config.LinkDir, toolName)
+		err = utils.EnsureLink(source, filepath.Join(config.LinkDir, toolName))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unable to link %s: %v", toolName, err))
+		}
+
+		versions[toolName] = dl.GetVersion()
+	}
+
+	return versions, nil
+}
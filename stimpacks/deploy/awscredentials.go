@@ -0,0 +1,93 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PremiereGlobal/stim/pkg/aws"
+)
+
+// awsEnvVarNames are the environment variables set to the AWS credentials
+var awsEnvVarNames = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"}
+
+// AWS describes the AWS credentials issued by Vault for the deployment
+type AWS struct {
+	Account string `yaml:"account" json:"account"`
+	Role    string `yaml:"role" json:"role"`
+	TTL     string `yaml:"ttl" json:"ttl,omitempty"`
+}
+
+// validateAWS ensures the AWS config is valid
+func (d *Deploy) validateAWS(awsConfig *AWS, awsPath configPath) {
+
+	if awsConfig == nil {
+		return
+	}
+
+	if awsConfig.Account == "" {
+		d.addConfigError(awsPath.with("account"), "AWS account is required")
+	}
+	if awsConfig.Role == "" {
+		d.addConfigError(awsPath.with("role"), "AWS role is required")
+	}
+	if awsConfig.TTL != "" {
+		if ttl, err := time.ParseDuration(awsConfig.TTL); err != nil || ttl <= 0 {
+			d.addConfigError(awsPath.with("ttl"), "Invalid AWS ttl '%s'. Must be a positive duration (ex. 1h)", awsConfig.TTL)
+		}
+	}
+}
+
+// resolveAWSCredentials gets AWS credentials for the instance from Vault and
+// waits for IAM user credentials to become active (STS credentials are active
+// immediately).  The lease is revoked at the end of the deployment run.
+func (d *Deploy) resolveAWSCredentials(ctx context.Context, instance *Instance) error {
+
+	awsConfig := instance.Spec.AWS
+	if awsConfig == nil {
+		return nil
+	}
+
+	secret, err := d.stim.Vault().AWScredentials(awsConfig.Account, awsConfig.Role)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to get AWS credentials from Vault for '%s'. %v", instance.Name, err))
+	}
+	d.trackLease(secret.LeaseID)
+
+	if awsConfig.TTL != "" {
+		ttl, _ := time.ParseDuration(awsConfig.TTL)
+		leaseDuration, err := d.stim.Vault().RenewLease(secret.LeaseID, ttl)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to renew AWS credentials lease for '%s'. %v", instance.Name, err))
+		}
+		d.log.Debug("AWS credentials for '{}' expire in {}", instance.Name, leaseDuration)
+	}
+
+	accessKey, _ := secret.Data["access_key"].(string)
+	secretKey, _ := secret.Data["secret_key"].(string)
+	sessionToken, _ := secret.Data["security_token"].(string)
+	if accessKey == "" || secretKey == "" {
+		return errors.New(fmt.Sprintf("No AWS credentials returned for account '%s' role '%s'", awsConfig.Account, awsConfig.Role))
+	}
+
+	a, err := aws.New(&aws.Config{AccessKey: accessKey, SecretKey: secretKey, SessionToken: sessionToken, Region: defaultAWSRegion, Log: d.stim.GetLogger()})
+	if err != nil {
+		return err
+	}
+	if sessionToken == "" {
+		if err := a.WaitForActiveCredsContext(ctx); err != nil {
+			return errors.New(fmt.Sprintf("AWS credentials for '%s' did not become active. %v", instance.Name, err))
+		}
+	}
+
+	instance.awsEnvs = []string{
+		fmt.Sprintf("AWS_ACCESS_KEY_ID=%s", accessKey),
+		fmt.Sprintf("AWS_SECRET_ACCESS_KEY=%s", secretKey),
+	}
+	if sessionToken != "" {
+		instance.awsEnvs = append(instance.awsEnvs, fmt.Sprintf("AWS_SESSION_TOKEN=%s", sessionToken))
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errInterrupted is returned for deployments stopped by a signal
+var errInterrupted = errors.New("Deployment was interrupted")
+
+// errDeclined is returned when the user does not confirm the deployment
+var errDeclined = errors.New("Deployment was not confirmed")
+
+// timeoutError is returned when a deployment takes longer than its timeout
+type timeoutError struct {
+	instance string
+	timeout  time.Duration
+}
+
+// Error implements the error interface
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("Deployment to '%s' timed out after %s", e.instance, e.timeout)
+}
+
+// leaseTracker keeps the Vault leases obtained for a deployment run so they
+// can be revoked once it has finished or is interrupted
+type leaseTracker struct {
+	lock sync.Mutex
+	ids  []string
+}
+
+// handleSignals returns a context which is cancelled when SIGINT or SIGTERM is
+// received, so that running deployments can stop and clean up.  A second
+// signal exits immediately.  The returned function stops handling signals.
+func (d *Deploy) handleSignals() (context.Context, func()) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			d.log.Warn("Received {}, stopping deployments and cleaning up.  Send again to exit immediately.", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			if d.rollback != nil {
+				removeWorktree(d.rollback.repoRoot, d.rollback.worktree)
+			}
+			d.exit(exitCodeInterrupted, "Exiting without cleaning up")
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+// deployContext returns the context for a single instance deployment, which
+// is cancelled after the instance timeout if one is set
+func deployContext(ctx context.Context, instance *Instance) (context.Context, context.CancelFunc) {
+	if instance.Spec.Timeout == "" {
+		return context.WithCancel(ctx)
+	}
+	timeout, _ := time.ParseDuration(instance.Spec.Timeout)
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError returns the error for a deployment stopped by its context
+func contextError(ctx context.Context, instance *Instance) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		timeout, _ := time.ParseDuration(instance.Spec.Timeout)
+		return &timeoutError{instance: instance.Name, timeout: timeout}
+	}
+	return errInterrupted
+}
+
+// trackLease records a Vault lease obtained for the deployment run
+func (d *Deploy) trackLease(leaseID string) {
+	d.leases.lock.Lock()
+	defer d.leases.lock.Unlock()
+	d.leases.ids = append(d.leases.ids, leaseID)
+}
+
+// revokeLeases revokes all Vault leases obtained for the deployment run
+// Failures are only logged as the leases will expire on their own
+func (d *Deploy) revokeLeases() {
+	d.leases.lock.Lock()
+	defer d.leases.lock.Unlock()
+
+	for _, leaseID := range d.leases.ids {
+		if err := d.stim.Vault().RevokeLease(leaseID); err != nil {
+			d.log.Warn("Unable to revoke Vault lease '{}': {}", leaseID, err)
+		}
+	}
+	d.leases.ids = nil
+}
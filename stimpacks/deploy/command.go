@@ -29,8 +29,143 @@ func (d *Deploy) Command(viper *viper.Viper) *cobra.Command {
 	viper.BindPFlag("deploy.environment", deployCmd.PersistentFlags().Lookup("environment"))
 	deployCmd.PersistentFlags().StringP("instance", "i", "", "Instance to deploy to")
 	viper.BindPFlag("deploy.instance", deployCmd.PersistentFlags().Lookup("instance"))
+	deployCmd.PersistentFlags().StringP("selector", "l", "", "Label selector of the instances to deploy to (ex. 'region=us,tier in (edge,api)').  Cannot be used with --instance.")
+	viper.BindPFlag("deploy.selector", deployCmd.PersistentFlags().Lookup("selector"))
 	deployCmd.PersistentFlags().StringP("method", "m", "auto", "Method to use for deployment.  Valid values are 'auto' 'docker' or 'shell'.  Auto will use docker if it is available or fall back to shell if not.")
 	viper.BindPFlag("deploy.method", deployCmd.PersistentFlags().Lookup("method"))
+	deployCmd.PersistentFlags().IntP("parallel", "p", 0, "Maximum number of instances to deploy at once when deploying to 'all' instances.  Overrides 'deployment.parallelism' in the deployment file.")
+	viper.BindPFlag("deploy.parallel", deployCmd.PersistentFlags().Lookup("parallel"))
+	deployCmd.PersistentFlags().String("override-protection", "", "Deploy to a protected environment without its checks.  Requires the reason, which is logged and recorded in the deploy history.")
+	viper.BindPFlag("deploy.override-protection", deployCmd.PersistentFlags().Lookup("override-protection"))
+	deployCmd.PersistentFlags().Bool("tty", false, "Allocate a TTY for the Docker deploy container, merging stdout and stderr and keeping colors.  Shell deployments are attached to the terminal when not deploying in parallel.")
+	viper.BindPFlag("deploy.tty", deployCmd.PersistentFlags().Lookup("tty"))
+	deployCmd.PersistentFlags().Bool("timestamps", false, "Prefix each line of deploy output with a timestamp")
+	viper.BindPFlag("deploy.timestamps", deployCmd.PersistentFlags().Lookup("timestamps"))
+	deployCmd.PersistentFlags().Bool("save-logs", false, "Save the output of each deployment to a log file in the stim cache.  Not used for interactive shell deployments.")
+	viper.BindPFlag("deploy.save-logs", deployCmd.PersistentFlags().Lookup("save-logs"))
+
+	var planCmd = &cobra.Command{
+		Use:   "plan",
+		Short: "Show the effective deployment spec",
+		Long:  "Shows the fully merged deployment spec for each selected instance without deploying",
+		Run: func(cmd *cobra.Command, args []string) {
+			d.Plan()
+		},
+	}
+	planCmd.Flags().StringP("output", "o", "table", "Output format.  Valid values are 'table', 'yaml' or 'json'")
+	viper.BindPFlag("deploy.plan.output", planCmd.Flags().Lookup("output"))
+	d.stim.BindCommand(planCmd, deployCmd)
+
+	var validateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the deployment file",
+		Long:  "Checks the deployment file for errors, including unknown fields and unreadable Vault secret paths.  Exits non-zero if any errors are found.",
+		Run: func(cmd *cobra.Command, args []string) {
+			d.Validate()
+		},
+	}
+	validateCmd.Flags().StringP("output", "o", "table", "Output format.  Valid values are 'table' or 'json'")
+	viper.BindPFlag("deploy.validate.output", validateCmd.Flags().Lookup("output"))
+	validateCmd.Flags().Bool("schema", false, "Print the JSON Schema of the deployment file and exit")
+	viper.BindPFlag("deploy.validate.schema", validateCmd.Flags().Lookup("schema"))
+	validateCmd.Flags().Bool("skip-vault", false, "Skip checking that Vault secret paths are readable")
+	viper.BindPFlag("deploy.validate.skip-vault", validateCmd.Flags().Lookup("skip-vault"))
+	d.stim.BindCommand(validateCmd, deployCmd)
+
+	var historyCmd = &cobra.Command{
+		Use:   "history",
+		Short: "Show deployment history",
+		Long:  "Shows the history of deployments made with 'stim deploy', optionally filtered by environment, instance, user and time",
+		Run: func(cmd *cobra.Command, args []string) {
+			d.DeployHistory()
+		},
+	}
+	historyCmd.Flags().StringP("output", "o", "table", "Output format.  Valid values are 'table' or 'json'")
+	viper.BindPFlag("deploy.history.output", historyCmd.Flags().Lookup("output"))
+	historyCmd.Flags().String("source", "local", "Where to read the history from.  Valid values are 'local' or 'vault'")
+	viper.BindPFlag("deploy.history.source", historyCmd.Flags().Lookup("source"))
+	historyCmd.Flags().String("vault-path", "", "Vault path to read the history from.  Defaults to 'deployment.history.vaultPath' in the deployment file")
+	viper.BindPFlag("deploy.history.vault-path", historyCmd.Flags().Lookup("vault-path"))
+	historyCmd.Flags().String("user", "", "Only show deployments by this user")
+	viper.BindPFlag("deploy.history.user", historyCmd.Flags().Lookup("user"))
+	historyCmd.Flags().String("since", "", "Only show deployments after this time.  Can be a duration (ex. 24h), date (ex. 2006-01-02) or RFC3339 timestamp")
+	viper.BindPFlag("deploy.history.since", historyCmd.Flags().Lookup("since"))
+	historyCmd.Flags().String("until", "", "Only show deployments before this time.  Can be a duration (ex. 24h), date (ex. 2006-01-02) or RFC3339 timestamp")
+	viper.BindPFlag("deploy.history.until", historyCmd.Flags().Lookup("until"))
+	historyCmd.Flags().Int("limit", 0, "Only show the most recent number of deployments")
+	viper.BindPFlag("deploy.history.limit", historyCmd.Flags().Lookup("limit"))
+	d.stim.BindCommand(historyCmd, deployCmd)
+
+	var rollbackCmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "Roll back an instance to a previous deployment",
+		Long:  "Re-runs the deployment of an instance with the inputs recorded for a previous successful deployment, using a temporary git worktree of the recorded commit.  Requires --environment and --instance.",
+		Run: func(cmd *cobra.Command, args []string) {
+			d.DeployRollback()
+		},
+	}
+	rollbackCmd.Flags().String("to", "", "Roll back to the last successful deployment at or before this time, instead of the one before the current deployment.  Can be a duration (ex. 24h), date (ex. 2006-01-02) or RFC3339 timestamp")
+	viper.BindPFlag("deploy.rollback.to", rollbackCmd.Flags().Lookup("to"))
+	rollbackCmd.Flags().String("source", "local", "Where to read the deploy history from.  Valid values are 'local' or 'vault'")
+	viper.BindPFlag("deploy.rollback.source", rollbackCmd.Flags().Lookup("source"))
+	rollbackCmd.Flags().String("vault-path", "", "Vault path to read the deploy history from.  Defaults to 'deployment.history.vaultPath' in the deployment file")
+	viper.BindPFlag("deploy.rollback.vault-path", rollbackCmd.Flags().Lookup("vault-path"))
+	d.stim.BindCommand(rollbackCmd, deployCmd)
+
+	var initCmd = &cobra.Command{
+		Use:   "init",
+		Short: "Create a deployment file",
+		Long:  "Writes a starter deployment file and deploy.sh script.  Prompts for the environments, instances, namespaces and tools, listing the clusters and service accounts from the Kubernetes credentials in Vault, unless --instances is given.",
+		Run: func(cmd *cobra.Command, args []string) {
+			d.DeployInit()
+		},
+	}
+	initCmd.Flags().StringSlice("instances", nil, "Instances to create without prompting, as '<environment>/<instance>=<cluster>[/<service account>]' (ex. 'prod/us-west-2=prod-cluster')")
+	viper.BindPFlag("deploy.init.instances", initCmd.Flags().Lookup("instances"))
+	initCmd.Flags().String("service-account", "", "Service account of instances which don't set one in --instances")
+	viper.BindPFlag("deploy.init.service-account", initCmd.Flags().Lookup("service-account"))
+	initCmd.Flags().StringSlice("namespaces", nil, "Namespace of each environment, as '<environment>=<namespace>'.  Defaults to the name of the deployment directory.")
+	viper.BindPFlag("deploy.init.namespaces", initCmd.Flags().Lookup("namespaces"))
+	initCmd.Flags().StringSlice("tools", []string{"kubectl"}, "Tools to install, as '<tool>[=<version>]'.  kubectl without a version is matched to the cluster.")
+	viper.BindPFlag("deploy.init.tools", initCmd.Flags().Lookup("tools"))
+	initCmd.Flags().Bool("filter-by-token", false, "Only list the service accounts whose credentials can be read with the current Vault token")
+	viper.BindPFlag("deploy.init.filter-by-token", initCmd.Flags().Lookup("filter-by-token"))
+	initCmd.Flags().Bool("force", false, "Overwrite an existing deployment file and script")
+	viper.BindPFlag("deploy.init.force", initCmd.Flags().Lookup("force"))
+	d.stim.BindCommand(initCmd, deployCmd)
+
+	var lockCmd = &cobra.Command{
+		Use:   "lock",
+		Short: "Manage deploy locks",
+		Long:  "Lists and releases the Vault locks which stop two deployments to the same instance running at once",
+	}
+	lockCmd.PersistentFlags().String("vault-path", "", "Vault path of the deploy locks.  Defaults to 'deployment.lock.vaultPath' in the deployment file")
+	viper.BindPFlag("deploy.lock.vault-path", lockCmd.PersistentFlags().Lookup("vault-path"))
+	d.stim.BindCommand(lockCmd, deployCmd)
+
+	var lockListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List deploy locks",
+		Long:  "Lists the deploy locks, optionally filtered by environment",
+		Run: func(cmd *cobra.Command, args []string) {
+			d.DeployLockList()
+		},
+	}
+	lockListCmd.Flags().StringP("output", "o", "table", "Output format.  Valid values are 'table' or 'json'")
+	viper.BindPFlag("deploy.lock.output", lockListCmd.Flags().Lookup("output"))
+	d.stim.BindCommand(lockListCmd, lockCmd)
+
+	var lockReleaseCmd = &cobra.Command{
+		Use:   "release",
+		Short: "Release a deploy lock",
+		Long:  "Releases the deploy lock of an instance.  Locks held by another user or host are only released with --force.",
+		Run: func(cmd *cobra.Command, args []string) {
+			d.DeployLockRelease()
+		},
+	}
+	lockReleaseCmd.Flags().Bool("force", false, "Release the lock even if it is held by another user or host")
+	viper.BindPFlag("deploy.lock.force", lockReleaseCmd.Flags().Lookup("force"))
+	d.stim.BindCommand(lockReleaseCmd, lockCmd)
 
 	return deployCmd
 }
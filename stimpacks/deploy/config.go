@@ -1,18 +1,18 @@
 package deploy
 
 import (
-	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/PremiereGlobal/stim/pkg/utils"
 	"github.com/PremiereGlobal/stim/stim"
 	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
 	"golang.org/x/mod/semver"
-	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 const (
@@ -26,6 +26,9 @@ const (
 // Config is the root structure for the deployment configuration
 type Config struct {
 	configFilePath string
+	root           *yaml3.Node
+	errors         []*configError
+	Include        []string       `yaml:"include"`
 	Deployment     Deployment     `yaml:"deployment"`
 	Global         Global         `yaml:"global"`
 	Environments   []*Environment `yaml:"environments"`
@@ -39,13 +42,11 @@ type Deployment struct {
 	Container         Container `yaml:"container"`
 	RequiredVersion   string    `yaml:"requiredVersion"`
 	MinimumVersion    string    `yaml:"minimumVersion"`
+	Parallelism       int       `yaml:"parallelism"`
+	History           History   `yaml:"history"`
+	Lock              Lock      `yaml:"lock"`
 	fullDirectoryPath string
-}
-
-// Container describes the container used for Docker deployments
-type Container struct {
-	Repo string `yaml:"repo"`
-	Tag  string `yaml:"tag"`
+	configDirectory   string
 }
 
 // Global describes global environment specs
@@ -57,71 +58,165 @@ type Global struct {
 type Spec struct {
 	Kubernetes            Kubernetes              `yaml:"kubernetes"`
 	Secrets               []*v2e.SecretItem       `yaml:"secrets"`
+	SecretFiles           []*SecretFile           `yaml:"secretFiles"`
 	EnvironmentVars       []*EnvironmentVar       `yaml:"env"`
-	AddConfirmationPrompt bool                    `yaml:"addConfirmationPrompt"`
+	AddConfirmationPrompt *bool                   `yaml:"addConfirmationPrompt"`
 	Tools                 map[string]stim.EnvTool `yaml:"tools"`
+	Hooks                 Hooks                   `yaml:"hooks"`
+	Timeout               string                  `yaml:"timeout"`
+	AWS                   *AWS                    `yaml:"aws"`
+	Verify                *Verify                 `yaml:"verify"`
+	origins               *specOrigins
+}
+
+// confirmationPrompt returns true if deployments using the spec must be
+// confirmed
+func (s *Spec) confirmationPrompt() bool {
+	return s.AddConfirmationPrompt != nil && *s.AddConfirmationPrompt
 }
 
 // Kubernetes describes the Kubernetes configuration to use
 type Kubernetes struct {
-	ServiceAccount string `yaml:"serviceAccount"`
-	Cluster        string `yaml:"cluster"`
+	ServiceAccount string                 `yaml:"serviceAccount"`
+	Cluster        string                 `yaml:"cluster"`
+	Credentials    *KubernetesCredentials `yaml:"credentials"`
 }
 
 // Environment describes a deployment environment (i.e. dev, stage, prod, etc.)
 type Environment struct {
-	Name            string      `yaml:"name"`
-	Spec            *Spec       `yaml:"spec"`
-	Instances       []*Instance `yaml:"instances"`
-	RemoveAllPrompt bool        `yaml:"removeAllPrompt"`
+	Name            string        `yaml:"name"`
+	Extends         string        `yaml:"extends"`
+	Spec            *Spec         `yaml:"spec"`
+	Instances       []*Instance   `yaml:"instances"`
+	RemoveAllPrompt bool          `yaml:"removeAllPrompt"`
+	Hooks           Hooks         `yaml:"hooks"`
+	Rollout         Rollout       `yaml:"rollout"`
+	Notifications   Notifications `yaml:"notifications"`
+	Protection      *Protection   `yaml:"protection"`
+	Container       *Container    `yaml:"container"`
 	instanceMap     map[string]int
+
+	// hooksInstance runs the environment-level hooks, if there are any
+	hooksInstance *Instance
 }
 
 // Instance describes an instance of a deployment within an environment (i.e. us-west-2 for env prod)
 type Instance struct {
-	Name string `yaml:"name"`
-	Spec *Spec  `yaml:"spec"`
+	Name      string            `yaml:"name"`
+	Labels    map[string]string `yaml:"labels"`
+	Spec      *Spec             `yaml:"spec"`
+	DependsOn []string          `yaml:"dependsOn"`
+	origins   *specOrigins
+	container Container
+
+	// kubeConfig is the kubeconfig generated by the Kubernetes credential
+	// provider when deploying, if it is not the static token in Vault
+	kubeConfig *clientcmdapi.Config
+
+	// resolver expands the variable references of the instance.  deferred are
+	// the config values referencing valueFrom variables, which are expanded
+	// once the valueFrom values are read when deploying.
+	resolver *variableResolver
+	deferred []*deferredValue
+
+	// awsEnvs are the AWS credential environment variables issued when deploying
+	awsEnvs []string
+
+	// secretEnvs are the environment variables set from leased Vault secrets,
+	// which are read by stim when deploying so their leases can be revoked
+	secretEnvs []string
+
+	// toolVersions and imageDigest are the tool versions and deploy image
+	// digest used when deploying, which are recorded in the deploy snapshot
+	toolVersions map[string]string
+	imageDigest  string
+}
+
+// deferredValue is a config value which is expanded when deploying
+type deferredValue struct {
+	target   *string
+	template string
 }
 
 // EnvironmentVar describes a shell env var to be injected into the deployment environment
 type EnvironmentVar struct {
-	Name  string `yaml:"name"`
-	Value string `yaml:"value"`
+	Name      string     `yaml:"name"`
+	Value     string     `yaml:"value"`
+	ValueFrom *ValueFrom `yaml:"valueFrom"`
+	resolved  bool
+
+	// secret is set if the value references a value read from Vault
+	secret bool
+}
+
+// isSecret returns true if the value is, or includes, a value read from Vault
+// and should not be shown
+func (e *EnvironmentVar) isSecret() bool {
+	return e.secret || e.ValueFrom.isSecret()
 }
 
 // parseConfig opens the deployment config file and ensures it is valid
+// Exits if any problems are found with the config
 func (d *Deploy) parseConfig() {
 
+	d.loadConfig(false)
+
+	if len(d.config.errors) == 1 {
+		d.log.Fatal("Error in deployment config {}", d.config.errors[0])
+	} else if len(d.config.errors) > 1 {
+		messages := make([]string, len(d.config.errors))
+		for i, err := range d.config.errors {
+			messages[i] = "  " + err.Error()
+		}
+		d.log.Fatal("Found {} errors in deployment config:\n{}", len(d.config.errors), strings.Join(messages, "\n"))
+	}
+}
+
+// loadConfig opens and processes the deployment config file, collecting any
+// problems found in d.config.errors.  If strict is set, unknown fields in the
+// config are also treated as errors
+func (d *Deploy) loadConfig(strict bool) {
+
 	d.config = Config{}
 
 	configFile := d.stim.ConfigGetString("deploy.file")
 
+	// Rollbacks use the deployment file in the worktree of the recorded commit
+	if d.rollback != nil {
+		configFile = d.rollback.deployFile
+	}
+
 	if configFile == "" {
 		setConfigDefault(&configFile, defaultConfigFile)
 		d.log.Debug("Deployment file not specified, using {}", defaultConfigFile)
 	}
 
+	d.config.configFilePath = configFile
+
 	_, err := os.Stat(configFile)
 	if err != nil && !os.IsExist(err) {
-		d.log.Fatal("No deployment config file exists at: {}", configFile)
+		d.addConfigError(nil, "No deployment config file exists")
+		return
 	}
 
-	contentstring, err := ioutil.ReadFile(configFile)
+	content, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		d.log.Fatal("Deployment config file could not be read: {}", err)
+		d.addConfigError(nil, "Deployment config file could not be read: %v", err)
+		return
 	}
 
-	if ok, err := utils.IsYaml(contentstring); !ok {
-		d.log.Fatal("Deployment config file ({}) is not valid YAML: {}", configFile, err)
+	config, ok := d.decodeConfigSource(configFile, content, strict, nil)
+	if !ok {
+		return
 	}
 
-	err = yaml.Unmarshal([]byte(contentstring), &d.config)
-	if err != nil {
-		d.log.Fatal("Error parsing deployment config {}", err)
-	}
-
-	d.config.configFilePath = configFile
+	// Keep the details of the deployment file when using the merged config
+	config.configFilePath = d.config.configFilePath
+	config.root = d.config.root
+	config.errors = d.config.errors
+	d.config = *config
 
+	d.resolveExtends()
 	d.processConfig()
 
 }
@@ -135,39 +230,82 @@ func (d *Deploy) processConfig() {
 	setConfigDefault(&d.config.Deployment.Directory, defaultDeployDirectory)
 	setConfigDefault(&d.config.Deployment.Script, defaultDeployScript)
 
+	// Determine the full directory path, which valueFrom sources are relative to
+	configAbs, err := filepath.Abs(d.config.configFilePath)
+	if err != nil {
+		d.log.Fatal("Error fetching deploy filepath '{}'", err)
+	}
+	d.config.Deployment.configDirectory = filepath.Dir(configAbs)
+	d.config.Deployment.fullDirectoryPath = filepath.Join(d.config.Deployment.configDirectory, d.config.Deployment.Directory)
+
 	// Create our global spec if it doesn't exist so we don't have to keep checking if it exists
 	if d.config.Global.Spec == nil {
 		d.config.Global.Spec = &Spec{}
 	}
 
+	deploymentPath := configPath{"deployment"}
 	if d.config.Deployment.RequiredVersion != "" {
 		if d.config.Deployment.MinimumVersion != "" {
-			log.Fatal("Can not use both MinimumVersion and RequiredVersion, Choose one.")
+			d.addConfigError(deploymentPath, "Can not use both minimumVersion and requiredVersion, Choose one.")
 		}
 		if !semver.IsValid(d.config.Deployment.RequiredVersion) {
-			d.log.Fatal("Bad RequiredVersion set:{}, exiting...", d.config.Deployment.RequiredVersion)
+			d.addConfigError(deploymentPath.with("requiredVersion"), "Bad requiredVersion set: %s", d.config.Deployment.RequiredVersion)
 		}
 	}
 
 	if d.config.Deployment.MinimumVersion != "" {
 		if !semver.IsValid(d.config.Deployment.MinimumVersion) {
-			d.log.Fatal("Bad MinimumVersion set:{}, exiting...", d.config.Deployment.MinimumVersion)
+			d.addConfigError(deploymentPath.with("minimumVersion"), "Bad minimumVersion set: %s", d.config.Deployment.MinimumVersion)
 		}
 	}
 
-	d.validateSpec(d.config.Global.Spec)
+	if d.config.Deployment.Lock.TTL != "" {
+		if ttl, err := time.ParseDuration(d.config.Deployment.Lock.TTL); err != nil || ttl <= 0 {
+			d.addConfigError(deploymentPath.with("lock", "ttl"), "Invalid lock ttl '%s'. Must be a positive duration (ex. 30m)", d.config.Deployment.Lock.TTL)
+		}
+	}
+
+	d.validateContainer(&d.config.Deployment.Container, deploymentPath.with("container"))
+
+	if d.config.Deployment.Parallelism < 0 {
+		d.addConfigError(deploymentPath.with("parallelism"), "Invalid deployment parallelism '%d'. Must be a positive integer", d.config.Deployment.Parallelism)
+	}
+
+	if len(d.config.Environments) == 0 {
+		d.addConfigError(nil, "No environments found in config")
+	}
+
+	d.validateSpec(d.config.Global.Spec, configPath{"global", "spec"})
+
+	// Get Vault details, these are not needed when only validating the config offline
+	var vaultToken, vaultAddress string
+	if !d.stim.ConfigGetBool("deploy.validate.skip-vault") {
+		vault := d.stim.Vault()
+		var err error
+		vaultToken, err = vault.GetToken()
+		if err != nil {
+			d.log.Fatal("Error fetching Vault token for deploy '{}'", err)
+		}
+
+		vaultAddress, err = vault.GetAddress()
+		if err != nil {
+			d.log.Fatal("Error fetching Vault address for deploy '{}'", err)
+		}
+	}
 
 	d.config.environmentMap = make(map[string]int)
 	for i, environment := range d.config.Environments {
 
+		environmentPath := configPath{"environments", i}
+
 		// Check to make sure that we don't have multiple environments with the same name
 		if _, ok := d.config.environmentMap[environment.Name]; ok {
-			d.log.Fatal("Error parsing config, duplicate environment name `{}` found", environment.Name)
+			d.addConfigError(environmentPath.with("name"), "Duplicate environment name '%s' found", environment.Name)
 		}
 
 		// Ensure there are instances for this environment
 		if len(environment.Instances) <= 0 {
-			d.log.Fatal("No instances found for environment: `{}`", environment.Name)
+			d.addConfigError(environmentPath, "No instances found for environment: '%s'", environment.Name)
 		}
 
 		d.config.environmentMap[environment.Name] = i
@@ -177,104 +315,160 @@ func (d *Deploy) processConfig() {
 			environment.Spec = &Spec{}
 		}
 
-		d.validateSpec(environment.Spec)
+		d.validateSpec(environment.Spec, environmentPath.with("spec"))
+		d.validateHooks(environment.Hooks, environmentPath.with("hooks"))
+		d.validateNotifications(environment.Notifications, environmentPath.with("notifications"))
+		d.validateProtection(environment.Protection, environmentPath.with("protection"))
+		d.validateContainer(environment.Container, environmentPath.with("container"))
 
 		environment.instanceMap = make(map[string]int)
 		for j, instance := range environment.Instances {
 
+			instancePath := environmentPath.with("instances", j)
+
 			// Check to make sure that we don't have multiple instances with the same name
 			if _, ok := environment.instanceMap[instance.Name]; ok {
-				d.log.Fatal("Error parsing config, duplicate instance name '{}' for environment '{}'", instance.Name, environment.Name)
+				d.addConfigError(instancePath.with("name"), "Duplicate instance name '%s' for environment '%s'", instance.Name, environment.Name)
 			}
 
-			// Ensure the instance name does not conflict with the ALL option name.  This is a reserved name for designating a deployment to all instances in an environment via the manual prompt list
-			if strings.ToLower(instance.Name) == strings.ToLower(allOptionPrompt) || strings.ToLower(instance.Name) == strings.ToLower(allOptionCli) {
-				d.log.Fatal("Deployment config cannot have an instance named '{}'. It is a reserved name.", instance.Name)
+			// Ensure the instance name does not conflict with the ALL and multiple selection option names.  These are reserved names for designating deployments to several instances in an environment via the manual prompt list
+			if strings.ToLower(instance.Name) == strings.ToLower(allOptionPrompt) || strings.ToLower(instance.Name) == strings.ToLower(allOptionCli) || strings.ToLower(instance.Name) == strings.ToLower(multipleOptionPrompt) {
+				d.addConfigError(instancePath.with("name"), "Deployment config cannot have an instance named '%s'. It is a reserved name.", instance.Name)
 			}
 
 			environment.instanceMap[instance.Name] = j
 
+			d.validateLabels(instance.Labels, instancePath.with("labels"))
+
 			// Create our instance spec if it doesn't exist so we don't have to keep checking if it exists
 			if instance.Spec == nil {
 				instance.Spec = &Spec{}
 			}
 
-			d.validateSpec(instance.Spec)
-
-			// Merge all of the secrets and environment variables
-			// Instance-level specs take precedence, followed by environment-level then global-level
-			if instance.Spec.Kubernetes.ServiceAccount == "" {
-				if environment.Spec.Kubernetes.ServiceAccount != "" {
-					instance.Spec.Kubernetes.ServiceAccount = environment.Spec.Kubernetes.ServiceAccount
-				} else if d.config.Global.Spec.Kubernetes.ServiceAccount != "" {
-					instance.Spec.Kubernetes.ServiceAccount = d.config.Global.Spec.Kubernetes.ServiceAccount
-				} else {
-					d.log.Fatal("Kubernetes service account is not set for instance '{}' in environment '{}'", instance.Name, environment.Name)
-				}
-			}
-			if instance.Spec.Kubernetes.Cluster == "" {
-				if environment.Spec.Kubernetes.Cluster != "" {
-					instance.Spec.Kubernetes.Cluster = environment.Spec.Kubernetes.Cluster
-				} else if d.config.Global.Spec.Kubernetes.Cluster != "" {
-					instance.Spec.Kubernetes.Cluster = d.config.Global.Spec.Kubernetes.Cluster
-				} else {
-					d.log.Fatal("Kubernetes cluster is not set for instance '{}' in environment '{}'", instance.Name, environment.Name)
-				}
-			}
+			d.validateSpec(instance.Spec, instancePath.with("spec"))
 
-			instance.Spec.Tools = mergeTools(instance.Spec.Tools, environment.Spec.Tools, d.config.Global.Spec.Tools)
-			instance.Spec.EnvironmentVars = mergeEnvVars(instance.Spec.EnvironmentVars, environment.Spec.EnvironmentVars, d.config.Global.Spec.EnvironmentVars)
-			instance.Spec.Secrets = mergeSecrets(instance.Spec.Secrets, environment.Spec.Secrets, d.config.Global.Spec.Secrets)
+			d.processInstance(environment, instance, i, j, vaultAddress, vaultToken)
+		}
 
-			// Get Vault details
-			vault := d.stim.Vault()
-			vaultToken, err := vault.GetToken()
-			if err != nil {
-				d.log.Fatal("Error fetching Vault token for deploy '{}'", err)
-			}
+		// Environment-level hooks are run with the environment and global specs,
+		// as an instance named after the environment.  Problems in these specs are
+		// reported for the environment's instances, so they are not checked again.
+		if !environment.Hooks.isEmpty() {
+			environment.hooksInstance = &Instance{Name: environment.Name, Spec: &Spec{}}
+			configErrors := d.config.errors
+			d.processInstance(environment, environment.hooksInstance, i, -1, vaultAddress, vaultToken)
+			d.config.errors = configErrors
+		}
 
-			vaultAddress, err := vault.GetAddress()
-			if err != nil {
-				d.log.Fatal("Error fetching Vault address for deploy '{}'", err)
-			}
+		d.validateRollout(environment, environmentPath)
+	}
+}
+
+// processInstance merges the environment and global specs into the spec of
+// the instance and adds the stim environment variables and secrets
+func (d *Deploy) processInstance(environment *Environment, instance *Instance, i int, j int, vaultAddress string, vaultToken string) {
 
-			// Generate stim env vars
-			stimEnvs := []*EnvironmentVar{}
-
-			stimEnvs = append(stimEnvs, []*EnvironmentVar{
-				&EnvironmentVar{Name: "VAULT_ADDR", Value: vaultAddress},
-				&EnvironmentVar{Name: "VAULT_TOKEN", Value: vaultToken},
-				&EnvironmentVar{Name: "DEPLOY_ENVIRONMENT", Value: environment.Name},
-				&EnvironmentVar{Name: "DEPLOY_INSTANCE", Value: instance.Name},
-				&EnvironmentVar{Name: "DEPLOY_CLUSTER", Value: instance.Spec.Kubernetes.Cluster},
-			}...)
-
-			// Generate the Kube config secret
-			var stimSecrets []*v2e.SecretItem
-			secretMap := make(map[string]string)
-			secretMap["CLUSTER_SERVER"] = "cluster-server"
-			secretMap["CLUSTER_CA"] = "cluster-ca"
-			secretMap["USER_TOKEN"] = "user-token"
-			stimSecrets = append(stimSecrets, &v2e.SecretItem{
-				SecretPath: fmt.Sprintf("secret/kubernetes/%s/%s/kube-config", instance.Spec.Kubernetes.Cluster, instance.Spec.Kubernetes.ServiceAccount),
-				SecretMaps: secretMap,
-			})
-
-			// Add stim envs/secrets and ensure no reserved env vars have been set
-			d.finalizeEnv(instance, stimEnvs, stimSecrets)
+	instancePath := configPath{"environments", i, "instances", j}
+
+	// Keep track of where each spec item came from before merging
+	instance.origins = newSpecOrigins()
+	instance.origins.add(d.config.Global.Spec, originGlobal)
+	instance.origins.add(environment.Spec, originEnvironment)
+	instance.origins.add(instance.Spec, originInstance)
+
+	// Merge all of the secrets and environment variables
+	// Instance-level specs take precedence, followed by environment-level then global-level
+	if instance.Spec.Kubernetes.Credentials == nil {
+		if environment.Spec.Kubernetes.Credentials != nil {
+			instance.Spec.Kubernetes.Credentials = environment.Spec.Kubernetes.Credentials
+		} else {
+			instance.Spec.Kubernetes.Credentials = d.config.Global.Spec.Kubernetes.Credentials
+		}
+	}
+	if instance.Spec.Kubernetes.ServiceAccount == "" {
+		if environment.Spec.Kubernetes.ServiceAccount != "" {
+			instance.Spec.Kubernetes.ServiceAccount = environment.Spec.Kubernetes.ServiceAccount
+		} else if d.config.Global.Spec.Kubernetes.ServiceAccount != "" {
+			instance.Spec.Kubernetes.ServiceAccount = d.config.Global.Spec.Kubernetes.ServiceAccount
+		} else if instance.Spec.Kubernetes.needsServiceAccount() {
+			d.addConfigError(instancePath, "Kubernetes service account is not set for instance '%s' in environment '%s'", instance.Name, environment.Name)
+		}
+	}
+	if instance.Spec.Kubernetes.Cluster == "" {
+		if environment.Spec.Kubernetes.Cluster != "" {
+			instance.Spec.Kubernetes.Cluster = environment.Spec.Kubernetes.Cluster
+		} else if d.config.Global.Spec.Kubernetes.Cluster != "" {
+			instance.Spec.Kubernetes.Cluster = d.config.Global.Spec.Kubernetes.Cluster
+		} else {
+			d.addConfigError(instancePath, "Kubernetes cluster is not set for instance '%s' in environment '%s'", instance.Name, environment.Name)
 		}
 	}
 
-	// Determine the full directory path
-	configAbs, err := filepath.Abs(d.config.configFilePath)
-	if err != nil {
-		d.log.Fatal("Error fetching deploy filepath '{}'", err)
+	instance.Spec.Tools = mergeTools(instance.Spec.Tools, environment.Spec.Tools, d.config.Global.Spec.Tools)
+	instance.Spec.EnvironmentVars = mergeEnvVars(instance.Spec.EnvironmentVars, environment.Spec.EnvironmentVars, d.config.Global.Spec.EnvironmentVars)
+	instance.Spec.Secrets = mergeSecrets(instance.Spec.Secrets, environment.Spec.Secrets, d.config.Global.Spec.Secrets)
+	instance.Spec.SecretFiles = mergeSecretFiles(instance.Spec.SecretFiles, environment.Spec.SecretFiles, d.config.Global.Spec.SecretFiles)
+	instance.Spec.Hooks = mergeHooks(instance.Spec.Hooks, environment.Spec.Hooks, d.config.Global.Spec.Hooks)
+	if instance.Spec.Timeout == "" {
+		instance.Spec.Timeout = environment.Spec.Timeout
 	}
-	d.config.Deployment.fullDirectoryPath = filepath.Join(filepath.Dir(configAbs), d.config.Deployment.Directory)
+	if instance.Spec.AWS == nil {
+		instance.Spec.AWS = environment.Spec.AWS
+	}
+	if instance.Spec.AWS == nil {
+		instance.Spec.AWS = d.config.Global.Spec.AWS
+	}
+	if instance.Spec.Verify == nil {
+		instance.Spec.Verify = environment.Spec.Verify
+	}
+	if instance.Spec.Verify == nil {
+		instance.Spec.Verify = d.config.Global.Spec.Verify
+	}
+	if instance.Spec.Timeout == "" {
+		instance.Spec.Timeout = d.config.Global.Spec.Timeout
+	}
+
+	// Expand any variable references now that the spec is merged.  Values
+	// using valueFrom are read when deploying.
+	d.interpolateInstance(environment, instance, i, j)
+
+	// Generate stim env vars
+	stimEnvs := []*EnvironmentVar{}
+
+	stimEnvs = append(stimEnvs, []*EnvironmentVar{
+		&EnvironmentVar{Name: "VAULT_ADDR", Value: vaultAddress},
+		&EnvironmentVar{Name: "VAULT_TOKEN", Value: vaultToken},
+		&EnvironmentVar{Name: "DEPLOY_ENVIRONMENT", Value: environment.Name},
+	}...)
+	if instance == environment.hooksInstance {
+		// The deployed instances are set when the hooks are run
+		stimEnvs = append(stimEnvs, &EnvironmentVar{Name: "DEPLOY_INSTANCES"})
+	} else {
+		stimEnvs = append(stimEnvs, &EnvironmentVar{Name: "DEPLOY_INSTANCE", Value: instance.Name})
+	}
+	stimEnvs = append(stimEnvs, &EnvironmentVar{Name: "DEPLOY_CLUSTER", Value: instance.Spec.Kubernetes.Cluster})
+
+	// Generate the Kube config secret.  Other credential providers are
+	// resolved when deploying and only provide a kubeconfig.  Environment hooks
+	// have no Kubernetes credentials if the environment has no cluster.
+	var stimSecrets []*v2e.SecretItem
+	if instance.Spec.Kubernetes.usesVaultToken() && instance.Spec.Kubernetes.Cluster != "" {
+		secretMap := make(map[string]string)
+		secretMap["CLUSTER_SERVER"] = "cluster-server"
+		secretMap["CLUSTER_CA"] = "cluster-ca"
+		secretMap["USER_TOKEN"] = "user-token"
+		stimSecrets = append(stimSecrets, &v2e.SecretItem{
+			SecretPath: pick(instance.Spec.Kubernetes.vaultTokenPath(), d.stim.KubeConfigVaultPath(instance.Spec.Kubernetes.Cluster, instance.Spec.Kubernetes.ServiceAccount)),
+			SecretMaps: secretMap,
+		})
+	}
+
+	// Add stim envs/secrets and ensure no reserved env vars have been set
+	d.finalizeEnv(instance, i, j, stimEnvs, stimSecrets)
 }
 
 // Generate the list of reserved env var names
-func (d *Deploy) finalizeEnv(instance *Instance, stimEnvs []*EnvironmentVar, stimSecrets []*v2e.SecretItem) {
+func (d *Deploy) finalizeEnv(instance *Instance, environmentIndex int, instanceIndex int, stimEnvs []*EnvironmentVar, stimSecrets []*v2e.SecretItem) {
 
 	// Generate the list of reserved env var names (additionally SECRET_CONFIG as we'll add that one at the end)
 	reservedVarNames := []string{"SECRET_CONFIG", "STIM_DEPLOY"}
@@ -282,33 +476,55 @@ func (d *Deploy) finalizeEnv(instance *Instance, stimEnvs []*EnvironmentVar, sti
 	for _, s := range stimEnvs {
 		reservedVarNames = append(reservedVarNames, s.Name)
 	}
+	if instance.Spec.AWS != nil {
+		reservedVarNames = append(reservedVarNames, awsEnvVarNames...)
+	}
 	for _, s := range stimSecrets {
 		for m := range s.SecretMaps {
 			reservedVarNames = append(reservedVarNames, m)
 		}
 	}
 
-	// Exit if any user-provided environment vars conflict with reserved ones
+	// Flag any user-provided environment vars that conflict with reserved ones
 	for _, e := range instance.Spec.EnvironmentVars {
 		if utils.Contains(reservedVarNames, e.Name) {
-			d.log.Fatal("Reserved environment variable name '{}' found in config", e.Name)
+			level := instance.origins.envVar(e.Name)
+			d.addConfigError(originPath(level, environmentIndex, instanceIndex).with("env"), "Reserved environment variable name '%s' found in %s config", e.Name, level)
 		}
 	}
 	for _, s := range instance.Spec.Secrets {
 		for m := range s.SecretMaps {
 			if utils.Contains(reservedVarNames, m) {
-				d.log.Fatal("Reserved environment variable name '{}' found in config", m)
+				level := instance.origins.secret(s)
+				d.addConfigError(originPath(level, environmentIndex, instanceIndex).with("secrets"), "Reserved environment variable name '%s' found in %s secret '%s'", m, level, s.SecretPath)
 			}
 		}
 	}
 
+	// Secret file names are set to the file paths, so they can't be used by any other variable
+	usedVarNames := append([]string{}, reservedVarNames...)
+	for _, e := range instance.Spec.EnvironmentVars {
+		usedVarNames = append(usedVarNames, e.Name)
+	}
+	for _, s := range instance.Spec.Secrets {
+		for m := range s.SecretMaps {
+			usedVarNames = append(usedVarNames, m)
+		}
+	}
+	for _, name := range instance.Spec.secretFileNames() {
+		if utils.Contains(usedVarNames, name) {
+			level := instance.origins.secretFile(name)
+			d.addConfigError(originPath(level, environmentIndex, instanceIndex).with("secretFiles"), "Secret file name '%s' found in %s config conflicts with another environment variable", name, level)
+		}
+	}
+
 	// Combine our secrets
 	instance.Spec.Secrets = append(instance.Spec.Secrets, stimSecrets...)
 
 	// Create the secret config
 	secretConfig, err := d.makeSecretConfig(instance)
 	if err != nil {
-		d.log.Fatal("Error making secret config '{}'", err)
+		d.addConfigError(originPath(originStim, environmentIndex, instanceIndex), "Error making secret config '%v'", err)
 	}
 	stimEnvs = append(stimEnvs, &EnvironmentVar{Name: "SECRET_CONFIG", Value: secretConfig})
 	stimEnvs = append(stimEnvs, &EnvironmentVar{Name: "STIM_DEPLOY", Value: "true"})
@@ -320,10 +536,21 @@ func (d *Deploy) finalizeEnv(instance *Instance, stimEnvs []*EnvironmentVar, sti
 
 // validateSpec validates fields in a config 'spec' section to ensure that it
 // meets all requirements
-func (d *Deploy) validateSpec(spec *Spec) {
+func (d *Deploy) validateSpec(spec *Spec, specPath configPath) {
 	for toolName, toolSpec := range spec.Tools {
 		if toolName == "helm" && toolSpec.Version == "" {
-			d.log.Fatal("Version detection not supported for helm, please specify a version in the `spec.tools.helm` config")
+			d.addConfigError(specPath.with("tools", "helm"), "Version detection not supported for helm, please specify a version in the `spec.tools.helm` config")
+		}
+	}
+	d.validateHooks(spec.Hooks, specPath.with("hooks"))
+	d.validateEnvVars(spec.EnvironmentVars, specPath.with("env"))
+	d.validateSecretFiles(spec.SecretFiles, specPath.with("secretFiles"))
+	d.validateKubernetesCredentials(spec.Kubernetes.Credentials, specPath.with("kubernetes", "credentials"))
+	d.validateAWS(spec.AWS, specPath.with("aws"))
+	d.validateVerify(spec.Verify, specPath.with("verify"))
+	if spec.Timeout != "" {
+		if timeout, err := time.ParseDuration(spec.Timeout); err != nil || timeout <= 0 {
+			d.addConfigError(specPath.with("timeout"), "Invalid timeout '%s'. Must be a positive duration (ex. 30m)", spec.Timeout)
 		}
 	}
 }
@@ -0,0 +1,166 @@
+package deploy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// yamlErrorLine matches the line number prefix of YAML decoding errors
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// configPath is a path to an item in the deployment config
+// Elements are either mapping keys (string) or sequence indexes (int)
+type configPath []interface{}
+
+// String returns the path in dotted notation (ex. environments[0].spec.env)
+func (p configPath) String() string {
+	var sb strings.Builder
+	for _, e := range p {
+		switch v := e.(type) {
+		case int:
+			sb.WriteString("[" + strconv.Itoa(v) + "]")
+		default:
+			if sb.Len() > 0 {
+				sb.WriteString(".")
+			}
+			sb.WriteString(fmt.Sprintf("%v", v))
+		}
+	}
+	return sb.String()
+}
+
+// with returns a new path with the given elements appended
+func (p configPath) with(elements ...interface{}) configPath {
+	result := make(configPath, 0, len(p)+len(elements))
+	result = append(result, p...)
+	return append(result, elements...)
+}
+
+// configError describes a problem found in the deployment config
+type configError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface
+func (e *configError) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", location, e.Line, e.Column)
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("%s: %s (%s)", location, e.Message, e.Path)
+	}
+	return fmt.Sprintf("%s: %s", location, e.Message)
+}
+
+// addConfigError records a problem with the deployment config at the given path
+func (d *Deploy) addConfigError(path configPath, format string, args ...interface{}) {
+	d.addFileError(d.config.configFilePath, d.config.root, path, format, args...)
+}
+
+// addFileError records a problem at the given path of a config file, where
+// root is the parsed document of the file
+func (d *Deploy) addFileError(file string, root *yaml3.Node, path configPath, format string, args ...interface{}) {
+	err := &configError{
+		File:    file,
+		Path:    path.String(),
+		Message: fmt.Sprintf(format, args...),
+	}
+	err.Line, err.Column = nodePosition(root, path)
+
+	// Items set at the global or environment level are checked once per
+	// instance so avoid reporting the same problem multiple times
+	for _, e := range d.config.errors {
+		if *e == *err {
+			return
+		}
+	}
+
+	d.config.errors = append(d.config.errors, err)
+}
+
+// addYamlErrors records errors returned from decoding a config file, where
+// root is the parsed document of the file (if it could be parsed)
+func (d *Deploy) addYamlErrors(file string, root *yaml3.Node, err error) {
+	messages := []string{err.Error()}
+	if terr, ok := err.(*yaml.TypeError); ok {
+		messages = terr.Errors
+	}
+
+	for _, message := range messages {
+		cerr := &configError{File: file, Message: message}
+		if m := yamlErrorLine.FindStringSubmatch(message); m != nil {
+			cerr.Line, _ = strconv.Atoi(m[1])
+			cerr.Column = lineColumn(root, cerr.Line)
+			cerr.Message = m[2]
+		}
+		d.config.errors = append(d.config.errors, cerr)
+	}
+}
+
+// nodePosition finds the line and column of the given path in the YAML
+// document.  If the full path does not exist, the position of the deepest
+// existing parent is returned.
+func nodePosition(root *yaml3.Node, path configPath) (int, int) {
+	if root == nil {
+		return 0, 0
+	}
+
+	node := root
+	if node.Kind == yaml3.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line, column := node.Line, node.Column
+
+	for _, e := range path {
+		var next *yaml3.Node
+		switch v := e.(type) {
+		case int:
+			if node.Kind == yaml3.SequenceNode && v < len(node.Content) {
+				next = node.Content[v]
+				line, column = next.Line, next.Column
+			}
+		case string:
+			if node.Kind == yaml3.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == v {
+						next = node.Content[i+1]
+						line, column = node.Content[i].Line, node.Content[i].Column
+						break
+					}
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+
+	return line, column
+}
+
+// lineColumn returns the column of the first node found on the given line
+func lineColumn(node *yaml3.Node, line int) int {
+	if node == nil {
+		return 0
+	}
+	if node.Line == line && node.Kind != yaml3.DocumentNode {
+		return node.Column
+	}
+	for _, child := range node.Content {
+		if column := lineColumn(child, line); column > 0 {
+			return column
+		}
+	}
+	return 0
+}
@@ -0,0 +1,35 @@
+package deploy
+
+import (
+	"testing"
+
+	yaml3 "gopkg.in/yaml.v3"
+	"gotest.tools/assert"
+)
+
+func TestNodePosition(t *testing.T) {
+	doc := `deployment:
+  script: deploy.sh
+environments:
+  - name: dev
+    instances:
+      - name: us-west-2
+        spec:
+          tools:
+            helm: {}
+`
+	root := &yaml3.Node{}
+	assert.NilError(t, yaml3.Unmarshal([]byte(doc), root))
+
+	path := configPath{"environments", 0, "instances", 0, "spec", "tools", "helm"}
+	assert.Equal(t, "environments[0].instances[0].spec.tools.helm", path.String(), "Values not Equal")
+
+	line, column := nodePosition(root, path)
+	assert.Equal(t, 9, line, "Values not Equal")
+	assert.Equal(t, 13, column, "Values not Equal")
+
+	// Missing items should resolve to the deepest existing parent
+	line, column = nodePosition(root, configPath{"environments", 0, "spec", "env"})
+	assert.Equal(t, 4, line, "Values not Equal")
+	assert.Equal(t, 5, column, "Values not Equal")
+}
@@ -0,0 +1,159 @@
+package deploy
+
+import (
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// defaultContainerWorkDir is where the deployment directory is mounted in
+// the deploy container
+const defaultContainerWorkDir = "/scripts"
+
+// Container describes the container used for Docker deployments
+type Container struct {
+	Repo       string            `yaml:"repo"`
+	Tag        string            `yaml:"tag"`
+	Mounts     []*ContainerMount `yaml:"mounts"`
+	Tmpfs      []*ContainerTmpfs `yaml:"tmpfs"`
+	Network    string            `yaml:"network"`
+	User       string            `yaml:"user"`
+	CPUs       float64           `yaml:"cpus"`
+	Memory     string            `yaml:"memory"`
+	ExtraHosts []string          `yaml:"extraHosts"`
+	WorkDir    string            `yaml:"workDir"`
+	Entrypoint []string          `yaml:"entrypoint"`
+
+	// Image pull settings
+	Digest          string        `yaml:"digest"`
+	ImagePullPolicy string        `yaml:"imagePullPolicy"`
+	RegistryAuth    *RegistryAuth `yaml:"registryAuth"`
+}
+
+// ContainerMount describes a host directory or file bind mounted in the
+// deploy container
+type ContainerMount struct {
+	Source   string `yaml:"source"`
+	Target   string `yaml:"target"`
+	ReadOnly bool   `yaml:"readOnly"`
+}
+
+// ContainerTmpfs describes a tmpfs mount in the deploy container
+type ContainerTmpfs struct {
+	Target string `yaml:"target"`
+	Size   string `yaml:"size"`
+}
+
+// mergeContainer returns the container settings of base with any settings
+// set in override replacing them.  Lists are replaced rather than merged.
+func mergeContainer(override *Container, base Container) Container {
+
+	result := base
+	if override == nil {
+		return result
+	}
+
+	// A pinned digest is for the base image, so changing the image unpins it
+	if override.Repo != "" || override.Tag != "" {
+		result.Digest = ""
+	}
+	overrideString(&result.Repo, override.Repo)
+	overrideString(&result.Tag, override.Tag)
+	overrideString(&result.Digest, override.Digest)
+	overrideString(&result.ImagePullPolicy, override.ImagePullPolicy)
+	if override.RegistryAuth != nil {
+		result.RegistryAuth = override.RegistryAuth
+	}
+	overrideString(&result.Network, override.Network)
+	overrideString(&result.User, override.User)
+	overrideString(&result.Memory, override.Memory)
+	overrideString(&result.WorkDir, override.WorkDir)
+	if override.CPUs != 0 {
+		result.CPUs = override.CPUs
+	}
+	if len(override.Mounts) > 0 {
+		result.Mounts = override.Mounts
+	}
+	if len(override.Tmpfs) > 0 {
+		result.Tmpfs = override.Tmpfs
+	}
+	if len(override.ExtraHosts) > 0 {
+		result.ExtraHosts = override.ExtraHosts
+	}
+	if len(override.Entrypoint) > 0 {
+		result.Entrypoint = override.Entrypoint
+	}
+
+	return result
+}
+
+// validateContainer ensures the container config is valid
+func (d *Deploy) validateContainer(container *Container, containerPath configPath) {
+
+	if container == nil {
+		return
+	}
+
+	for i, m := range container.Mounts {
+		mountPath := containerPath.with("mounts", i)
+		if m.Source == "" {
+			d.addConfigError(mountPath.with("source"), "Container mount source is required")
+		}
+		if !path.IsAbs(m.Target) {
+			d.addConfigError(mountPath.with("target"), "Container mount target '%s' must be an absolute path", m.Target)
+		}
+	}
+
+	for i, t := range container.Tmpfs {
+		tmpfsPath := containerPath.with("tmpfs", i)
+		if !path.IsAbs(t.Target) {
+			d.addConfigError(tmpfsPath.with("target"), "Container tmpfs target '%s' must be an absolute path", t.Target)
+		}
+		if t.Size != "" {
+			if _, err := units.RAMInBytes(t.Size); err != nil {
+				d.addConfigError(tmpfsPath.with("size"), "Invalid container tmpfs size '%s'. Must be a size (ex. 64m)", t.Size)
+			}
+		}
+	}
+
+	if container.Memory != "" {
+		if _, err := units.RAMInBytes(container.Memory); err != nil {
+			d.addConfigError(containerPath.with("memory"), "Invalid container memory limit '%s'. Must be a size (ex. 512m)", container.Memory)
+		}
+	}
+
+	if container.CPUs < 0 {
+		d.addConfigError(containerPath.with("cpus"), "Invalid container cpus '%g'. Must be a positive number", container.CPUs)
+	}
+
+	for i, host := range container.ExtraHosts {
+		parts := strings.SplitN(host, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+			d.addConfigError(containerPath.with("extraHosts", i), "Invalid container extra host '%s'. Must be in the form 'hostname:ip'", host)
+		}
+	}
+
+	if container.WorkDir != "" && !path.IsAbs(container.WorkDir) {
+		d.addConfigError(containerPath.with("workDir"), "Container workDir '%s' must be an absolute path", container.WorkDir)
+	}
+
+	d.validateRegistry(container, containerPath)
+}
+
+// containerWorkDir returns where the deployment directory is mounted and the
+// deployment script is run in the container
+func (c Container) containerWorkDir() string {
+	return pick(c.WorkDir, defaultContainerWorkDir)
+}
+
+// hostSource returns the host path of a mount.  Relative paths are relative
+// to the directory of the deployment file.
+func (m *ContainerMount) hostSource(configDirectory string) string {
+	if filepath.IsAbs(m.Source) {
+		return m.Source
+	}
+	return filepath.Join(configDirectory, m.Source)
+}
@@ -0,0 +1,27 @@
+package deploy
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestMergeContainer(t *testing.T) {
+	base := Container{
+		Repo:   "premiereglobal/kube-vault-deploy",
+		Tag:    "0.3.4",
+		Memory: "512m",
+		Mounts: []*ContainerMount{{Source: "./charts", Target: "/charts"}},
+	}
+
+	merged := mergeContainer(&Container{Tag: "1.0.0", Network: "host", Mounts: []*ContainerMount{{Source: "/etc/ssl", Target: "/etc/ssl", ReadOnly: true}}}, base)
+	assert.Equal(t, "premiereglobal/kube-vault-deploy", merged.Repo, "Values not Equal")
+	assert.Equal(t, "1.0.0", merged.Tag, "Values not Equal")
+	assert.Equal(t, "512m", merged.Memory, "Values not Equal")
+	assert.Equal(t, "host", merged.Network, "Values not Equal")
+	assert.Equal(t, 1, len(merged.Mounts), "Values not Equal")
+	assert.Equal(t, "/etc/ssl", merged.Mounts[0].Target, "Values not Equal")
+	assert.Equal(t, "/scripts", merged.containerWorkDir(), "Values not Equal")
+
+	assert.DeepEqual(t, base, mergeContainer(nil, base))
+}
@@ -1,20 +1,37 @@
 package deploy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/PremiereGlobal/stim/pkg/docker"
 	log "github.com/PremiereGlobal/stim/pkg/stimlog"
 	"github.com/PremiereGlobal/stim/stim"
 	"golang.org/x/mod/semver"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
 	allOptionPrompt = "--ALL--"
 	allOptionCli    = "all"
+
+	// multipleOptionPrompt is the prompt list option to select multiple instances
+	multipleOptionPrompt = "--SELECT MULTIPLE--"
+)
+
+// Exit codes for failed deployments, so that script failures can be told
+// apart from problems with Docker.  Other errors exit with the stim default.
+const (
+	exitCodeDeclined         = 1
+	exitCodeScriptFailure    = 2
+	exitCodeContainerFailure = 3
+	exitCodeTimeout          = 4
+	exitCodeVerifyFailure    = 6
+	exitCodeInterrupted      = 130
 )
 
 const (
@@ -25,10 +42,19 @@ const (
 
 // Deploy is the primary type for the stim deploy subcommand
 type Deploy struct {
-	name   string
-	stim   *stim.Stim
-	config Config
-	log    log.StimLogger
+	name     string
+	stim     *stim.Stim
+	config   Config
+	log      log.StimLogger
+	notifier *notifier
+	leases   leaseTracker
+	locks    lockTracker
+
+	// protection records how environment protection was satisfied
+	protection *protectionResult
+
+	// rollback is set when rolling back to a previous deployment
+	rollback *rollbackState
 }
 
 // New creates a new 'Deploy' object
@@ -49,6 +75,152 @@ func (d *Deploy) Run() {
 
 	// Read in the config file and set up defaults
 	d.parseConfig()
+	d.checkStimVersion()
+
+	selectedEnvironment := d.selectEnvironment()
+	instances, multiple := d.selectInstances(selectedEnvironment)
+
+	if code, err := d.deployInstances(selectedEnvironment, instances, multiple); err != nil {
+		d.exitWithError(code, err)
+	}
+}
+
+// deployInstances deploys to the selected instances of the environment.  The
+// environment rollout and hooks are used if multiple instances were selected.
+// Returns an error, along with the exit code to use (0 for the default), if
+// any of the deployments did not succeed.
+func (d *Deploy) deployInstances(selectedEnvironment *Environment, instances []*Instance, multiple bool) (int, error) {
+
+	// Protected environments are checked before any other prompts
+	protection, err := d.checkProtection(selectedEnvironment)
+	if err != nil {
+		return 0, err
+	}
+	d.protection = protection
+
+	// Confirmation prompts are skipped if the instances are passed on the cli
+	cliSelected := d.stim.ConfigGetString("deploy.instance") != "" || d.stim.ConfigGetString("deploy.selector") != ""
+	if multiple {
+		if len(instances) == len(selectedEnvironment.Instances) {
+			d.log.Info("Deploying to all clusters in environment: {}", selectedEnvironment.Name)
+		} else {
+			d.log.Info("Deploying to {} of {} clusters in environment {}: {}", len(instances), len(selectedEnvironment.Instances), selectedEnvironment.Name, strings.Join(instanceNames(instances), ", "))
+		}
+		if !selectedEnvironment.Rollout.isEmpty() {
+			d.log.Info("Rollout plan for environment '{}':\n{}", selectedEnvironment.Name, describeRollout(selectedEnvironment.Rollout, planRollout(selectedEnvironment.Rollout, instances)))
+		}
+		//Check if confirmation prompt is required
+		if selectedEnvironment.Spec.confirmationPrompt() {
+			proceed, _ := d.stim.PromptBool("Proceed?", cliSelected, false)
+			if !proceed {
+				return exitCodeDeclined, errDeclined
+			}
+		}
+		for _, inst := range instances {
+			if inst.Spec.confirmationPrompt() {
+				proceed, _ := d.stim.PromptBool(fmt.Sprintf("Proceed with instance '%s'?", inst.Name), cliSelected, false)
+				if !proceed {
+					return exitCodeDeclined, errDeclined
+				}
+			}
+		}
+	} else {
+		inst := instances[0]
+		if selectedEnvironment.Spec.confirmationPrompt() || inst.Spec.confirmationPrompt() {
+			proceed, _ := d.stim.PromptBool("Proceed?", cliSelected, false)
+			if !proceed {
+				return exitCodeDeclined, errDeclined
+			}
+		}
+	}
+
+	d.notifier = d.newNotifier(selectedEnvironment.Notifications)
+
+	// Stop and clean up running deployments on SIGINT/SIGTERM
+	ctx, stopSignals := d.handleSignals()
+	defer stopSignals()
+
+	// Lock the instances so no one else deploys to them at the same time
+	if err := d.acquireLocks(selectedEnvironment, instances); err != nil {
+		return 0, err
+	}
+
+	// Environment-level hooks and rollout settings only apply to deployments to
+	// all instances or a selection of instances
+	var rolloutHooks Hooks
+	var rollout Rollout
+	if multiple {
+		rolloutHooks = selectedEnvironment.Hooks
+		rollout = selectedEnvironment.Rollout
+	}
+
+	failures := 0
+	var results []*deployResult
+	var hooksErr error
+	if !rolloutHooks.isEmpty() {
+		hooksErr = d.resolveRolloutHooks(ctx, selectedEnvironment, instances)
+	}
+	rolloutErr := hooksErr
+	if rolloutErr == nil {
+		rolloutErr = d.runRolloutHooks(ctx, selectedEnvironment, "preDeploy", rolloutHooks.PreDeploy, rolloutHooks.policy())
+	}
+	if rolloutErr == nil {
+
+		// Run the deployment(s)
+		parallelism := d.getParallelism()
+		if len(instances) > 1 && parallelism > 1 {
+			d.log.Info("Deploying up to {} instances in parallel", parallelism)
+		}
+		results = d.deployRollout(ctx, selectedEnvironment, rollout, instances, parallelism)
+
+		if len(results) > 1 {
+			failures = d.printSummary(selectedEnvironment, results)
+		} else if results[0].err != nil {
+			failures = 1
+		}
+
+		if failures == 0 {
+			rolloutErr = d.runRolloutHooks(ctx, selectedEnvironment, "postDeploy", rolloutHooks.PostDeploy, rolloutHooks.policy())
+		}
+	}
+
+	if hooksErr == nil && (rolloutErr != nil || failures > 0) {
+		// onFailure hooks still run if the deployment was interrupted, but not
+		// if the hooks could not be set up
+		err := d.runRolloutHooks(context.Background(), selectedEnvironment, "onFailure", rolloutHooks.OnFailure, hookPolicyWarn)
+		if err != nil {
+			d.log.Warn("{}", err)
+		}
+	}
+
+	d.revokeLeases()
+	d.releaseLocks()
+	if ctx.Err() != nil {
+		return exitCodeInterrupted, errInterrupted
+	}
+
+	if rolloutErr != nil {
+		return 0, rolloutErr
+	}
+	if failures > 0 {
+		return failureExitCode(results), errors.New(fmt.Sprintf("%d of %d deployment(s) in environment '%s' did not succeed", failures, len(instances), selectedEnvironment.Name))
+	}
+
+	return 0, nil
+}
+
+// exitWithError logs the error and exits with the given exit code, or the
+// stim default if the code is 0
+func (d *Deploy) exitWithError(code int, err error) {
+	if code != 0 {
+		d.exit(code, err.Error())
+	}
+	d.log.Fatal("{}", err)
+}
+
+// checkStimVersion ensures that the running version of stim meets the
+// requirements of the deployment config
+func (d *Deploy) checkStimVersion() {
 	if d.config.Deployment.RequiredVersion != "" {
 		d.log.Info("Deploy has set RequiredVersion to:{}, currently:{}", d.config.Deployment.RequiredVersion, d.stim.GetVersion())
 		if semver.Compare(d.stim.GetVersion(), d.config.Deployment.RequiredVersion) != 0 {
@@ -61,8 +233,10 @@ func (d *Deploy) Run() {
 			d.log.Fatal("Stim is not at the Required version for deploy, current:{}, minimum:{}\n\t Please check https://github.com/PremiereGlobal/stim/releases for new versions", d.stim.GetVersion(), d.config.Deployment.MinimumVersion)
 		}
 	}
+}
 
-	// Determine the selected environment (via cli param) or prompt the user
+// selectEnvironment determines the selected environment (via cli param) or prompts the user
+func (d *Deploy) selectEnvironment() *Environment {
 	selectedEnvironmentName := ""
 	environmentArg := d.stim.ConfigGetString("deploy.environment")
 	if environmentArg != "" {
@@ -82,81 +256,202 @@ func (d *Deploy) Run() {
 			os.Exit(0)
 		}
 	}
-	selectedEnvironment := d.config.Environments[d.config.environmentMap[selectedEnvironmentName]]
 
-	// Determine the selected instance (via cli param) or prompt the user
+	return d.config.Environments[d.config.environmentMap[selectedEnvironmentName]]
+}
+
+// selectInstances determines the selected instances (via cli params) or prompts
+// the user.  Returns the instances in config order and whether they were
+// selected as a group (all instances, a selector or multiple selection) rather
+// than a single instance
+func (d *Deploy) selectInstances(selectedEnvironment *Environment) ([]*Instance, bool) {
+
+	instanceArg := d.stim.ConfigGetString("deploy.instance")
+	selectorArg := d.stim.ConfigGetString("deploy.selector")
+	if selectorArg != "" {
+		if instanceArg != "" {
+			d.log.Fatal("The --instance and --selector arguments cannot be used together")
+		}
+		selector, err := labels.Parse(selectorArg)
+		if err != nil {
+			d.log.Fatal("Invalid selector '{}'. {}", selectorArg, err)
+		}
+		instances := filterInstances(selector, selectedEnvironment.Instances)
+		if len(instances) == 0 {
+			d.log.Fatal("No instances in environment '{}' match selector '{}'", selectedEnvironment.Name, selectorArg)
+		}
+		return instances, true
+	}
+
 	instanceList := make([]string, 0)
+	names := make([]string, 0)
 
 	//Check if we should remove all prompt or not
 	if !selectedEnvironment.RemoveAllPrompt {
 		instanceList = append(instanceList, allOptionPrompt)
 	}
 	for _, inst := range selectedEnvironment.Instances {
-		instanceList = append(instanceList, inst.Name)
+		names = append(names, inst.Name)
 	}
-	selectedInstanceName, _ := d.stim.PromptList("Which instance?", instanceList, d.stim.ConfigGetString("deploy.instance"))
+	instanceList = append(instanceList, names...)
+	if len(names) > 1 {
+		instanceList = append(instanceList, multipleOptionPrompt)
+	}
+
+	selectedInstanceName, _ := d.stim.PromptList("Which instance?", instanceList, instanceArg)
 	if selectedInstanceName == "" {
 		d.log.Info("No instance selected! exiting")
 		os.Exit(0)
 	}
 	if strings.ToLower(selectedInstanceName) == strings.ToLower(allOptionPrompt) || strings.ToLower(selectedInstanceName) == strings.ToLower(allOptionCli) {
-		selectedInstanceName = allOptionCli
-	} else if _, ok := selectedEnvironment.instanceMap[selectedInstanceName]; !ok {
-		d.log.Fatal("Provided instance value '{}' is not in config file under environment '{}'", selectedInstanceName, selectedEnvironmentName)
+		return selectedEnvironment.Instances, true
 	}
-
-	// Run the deployment(s)
-	if selectedInstanceName == allOptionCli {
-		d.log.Info("Deploying to all clusters in environment: {}", selectedEnvironment.Name)
-		//Check if confirmation prompt is required
-		if selectedEnvironment.Spec.AddConfirmationPrompt {
-			//Do AddConfirmationPrompt, only if the instance is not passed on the cli
-			proceed, _ := d.stim.PromptBool("Proceed?", d.stim.ConfigGetString("deploy.instance") != "", false)
-			if !proceed {
-				os.Exit(1)
-			}
+	if instanceArg == "" && selectedInstanceName == multipleOptionPrompt {
+		selectedNames, _ := d.stim.PromptMultiSelect("Which instances?", names)
+		if len(selectedNames) == 0 {
+			d.log.Info("No instance selected! exiting")
+			os.Exit(0)
 		}
-		for _, inst := range selectedEnvironment.Instances {
-			if inst.Spec.AddConfirmationPrompt {
-				//Do AddConfirmationPrompt, only if the instance is not passed on the cli
-				proceed, _ := d.stim.PromptBool("Proceed?", d.stim.ConfigGetString("deploy.instance") != "", false)
-				if !proceed {
-					os.Exit(1)
-				}
-			}
-			d.Deploy(selectedEnvironment, inst)
+		instances := make([]*Instance, len(selectedNames))
+		for i, name := range selectedNames {
+			instances[i] = selectedEnvironment.Instances[selectedEnvironment.instanceMap[name]]
 		}
-	} else {
-		inst := selectedEnvironment.Instances[selectedEnvironment.instanceMap[selectedInstanceName]]
-		if selectedEnvironment.Spec.AddConfirmationPrompt || inst.Spec.AddConfirmationPrompt {
-			proceed, _ := d.stim.PromptBool("Proceed?", d.stim.ConfigGetString("deploy.instance") != "", false)
-			if !proceed {
-				os.Exit(1)
-			}
-		}
-		d.Deploy(selectedEnvironment, inst)
+		return instances, true
+	}
+	if _, ok := selectedEnvironment.instanceMap[selectedInstanceName]; !ok {
+		d.log.Fatal("Provided instance value '{}' is not in config file under environment '{}'", selectedInstanceName, selectedEnvironment.Name)
 	}
 
+	return []*Instance{selectedEnvironment.Instances[selectedEnvironment.instanceMap[selectedInstanceName]]}, false
 }
 
 // Deploy runs the deployment in the way that the user wants
-func (d *Deploy) Deploy(environment *Environment, instance *Instance) {
+func (d *Deploy) Deploy(ctx context.Context, environment *Environment, instance *Instance) error {
+
+	start := time.Now()
+	ctx, cancel := deployContext(ctx, instance)
+	defer cancel()
 
 	d.log.Info("Deploying to '{}' environment in instance: {}", environment.Name, instance.Name)
+	d.logSources(instance)
+	d.notify(environment, instance, notifyStart, start, nil)
 
 	deployMethod, err := d.DetermineDeployMethod()
+	if err == nil {
+		err = d.resolveInstance(ctx, instance)
+	}
+	if err == nil {
+		err = d.startDeployment(ctx, environment, instance, deployMethod, deployCommand(instance.Spec.Hooks, d.config.Deployment.Script))
+	}
+	if err == nil {
+		err = d.verifyRollout(ctx, instance)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		err = contextError(ctx, instance)
+	}
+
+	d.recordHistory(environment, instance, deployMethod, start, err)
 	if err != nil {
-		d.log.Fatal(err)
+		d.notify(environment, instance, notifyFailure, start, err)
+	} else {
+		d.notify(environment, instance, notifySuccess, start, nil)
 	}
 
+	return err
+}
+
+// resolveInstance reads the valueFrom values and credentials of the instance
+// which are only available when deploying
+func (d *Deploy) resolveInstance(ctx context.Context, instance *Instance) error {
+
+	if err := d.resolveValueFrom(instance); err != nil {
+		return err
+	}
+	if err := d.resolveKubeCredentials(ctx, instance); err != nil {
+		return err
+	}
+	if err := d.resolveAWSCredentials(ctx, instance); err != nil {
+		return err
+	}
+	if err := d.resolveLeasedSecrets(ctx, instance); err != nil {
+		return err
+	}
+	d.pinSecretVersions(instance)
+
+	return nil
+}
+
+// startDeployment runs the shell command of the instance in a deploy
+// container or the local shell, depending on the deploy method
+func (d *Deploy) startDeployment(ctx context.Context, environment *Environment, instance *Instance, deployMethod int, command string) error {
 	if deployMethod == DEPLOY_METHOD_DOCKER {
-		d.startDeployContainer(instance)
+		return d.startDeployContainer(ctx, environment, instance, command)
 	} else if deployMethod == DEPLOY_METHOD_SHELL {
-		d.startDeployShell(instance)
-	} else {
-		d.log.Fatal("Could not determine deployment method")
+		return d.startDeployShell(ctx, environment, instance, command)
+	}
+	return errors.New("Could not determine deployment method")
+}
+
+// scriptError is returned when the deployment script (or one of its hooks)
+// exits with a non-zero exit code
+type scriptError struct {
+	instance string
+	exitCode int
+	detail   string
+}
+
+// Error implements the error interface
+func (e *scriptError) Error() string {
+	message := fmt.Sprintf("Deployment to '%s' resulted in non-zero exit code %d", e.instance, e.exitCode)
+	if e.detail != "" {
+		message += ". " + e.detail
 	}
+	return message
+}
+
+// containerError is returned when the Docker daemon or the deploy container
+// fails, as opposed to the deployment script
+type containerError struct {
+	instance string
+	message  string
+}
+
+// Error implements the error interface
+func (e *containerError) Error() string {
+	return fmt.Sprintf("Deploy container for '%s' failed. %s", e.instance, e.message)
+}
+
+// failureExitCode returns the exit code for the failed deployment results, or
+// 0 if the failures were not script, container, timeout or rollout verification
+// failures.  Container failures take precedence as they mean the script may not
+// have run at all, followed by timeouts, then script failures.
+func failureExitCode(results []*deployResult) int {
+	code := 0
+	for _, r := range results {
+		switch r.err.(type) {
+		case *containerError:
+			return exitCodeContainerFailure
+		case *timeoutError:
+			code = exitCodeTimeout
+		case *scriptError:
+			if code == 0 || code == exitCodeVerifyFailure {
+				code = exitCodeScriptFailure
+			}
+		case *verifyError:
+			if code == 0 {
+				code = exitCodeVerifyFailure
+			}
+		}
+	}
+	return code
+}
 
+// exit logs the message and exits with the given exit code
+func (d *Deploy) exit(code int, message string) {
+	d.log.Warn(message)
+	log.GetLoggerConfig().Flush()
+	os.Exit(code)
 }
 
 // DetermineDeployMethod figures out the deploy method based on user input
@@ -1,137 +1,404 @@
 package deploy
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/PremiereGlobal/stim/pkg/docker"
 	"github.com/PremiereGlobal/stim/pkg/downloader"
+	"github.com/PremiereGlobal/stim/pkg/kubernetes"
+	"github.com/PremiereGlobal/stim/stim"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
-func (d *Deploy) startDeployContainer(instance *Instance) {
+// newContainerError returns a containerError with a formatted message
+func newContainerError(instance *Instance, format string, args ...interface{}) error {
+	return &containerError{instance: instance.Name, message: fmt.Sprintf(format, args...)}
+}
+
+// startDeployContainer starts an instance deployment using a Docker container,
+// which runs the given shell command
+func (d *Deploy) startDeployContainer(ctx context.Context, environment *Environment, instance *Instance, command string) error {
 
 	dockerClient, err := docker.NewClient()
 	if err != nil {
-		d.log.Fatal("Error creating docker client. {}", err)
+		return newContainerError(instance, "Error creating docker client. %v", err)
 	}
 
-	ctx := context.Background()
-
 	// Pull the deploy image
-	image := fmt.Sprintf("%s:%s", d.config.Deployment.Container.Repo, d.config.Deployment.Container.Tag)
-	reader, err := dockerClient.ImagePull(ctx, image, types.ImagePullOptions{})
+	image := d.containerImage(instance)
+	if err := d.pullImage(ctx, dockerClient, instance); err != nil {
+		return newContainerError(instance, "%v", err)
+	}
+
+	envs := d.containerEnvs(instance)
+
+	// Since we're using Docker, we need to mount the Linux binaries
+	hostCacheDir := d.stim.ConfigGetCacheDir("bin/linux")
+	cacheDir := "/bin-cache"
+	workDir := instance.container.containerWorkDir()
+	pathDir := "/stim/path"
+
+	// Link the tools the same way as shell deployments, pointing at the binaries in the mounted cache
+	hostPathDir, err := d.linkContainerTools(instance, cacheDir)
 	if err != nil {
-		d.log.Fatal("Failed to pull deploy image. {}", err)
+		return newContainerError(instance, "%v", err)
 	}
+	defer os.RemoveAll(hostPathDir)
+
+	// Without a TTY, stdout and stderr are kept separate
+	tty := d.stim.ConfigGetBool("deploy.tty")
 
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		d.log.Debug(scanner.Text())
+	// Create the container spec
+	command = fmt.Sprintf("export PATH=%s:${PATH}; %s", pathDir, command)
+	mounts := []mount.Mount{
+		mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   d.config.Deployment.fullDirectoryPath,
+			Target:   workDir,
+			ReadOnly: false, // This could be set to false when the downloads don't go here
+		},
+		mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   hostCacheDir,
+			Target:   cacheDir,
+			ReadOnly: false,
+		},
+		mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   hostPathDir,
+			Target:   pathDir,
+			ReadOnly: true,
+		},
 	}
 
-	var envs []string
-	deprecatedHelmVersionSet := ""
-	for _, e := range instance.Spec.EnvironmentVars {
-		if e.Name == "HELM_VERSION" {
-			d.log.Warn("The use of the HELM_VERSION environment variable for specifying Helm versions has been deprecated.  Use the `.spec.tools.helm` configuration for specifying the helm version to use.  See https://github.com/PremiereGlobal/stim/blob/master/docs/DEPLOY.md for more details.")
-			deprecatedHelmVersionSet = e.Value
+	// Secret files and generated kubeconfigs are written to tmpfs mounts in the
+	// container once it has started, so they are never on the host's disk and
+	// are owned by the container user.  The deployment waits for them.
+	var files []*containerFile
+	if len(instance.Spec.SecretFiles) > 0 {
+		secretFiles, err := d.readSecretFiles(instance)
+		if err != nil {
+			return newContainerError(instance, "%v", err)
 		}
-		envs = append(envs, fmt.Sprintf("%s=%s", e.Name, e.Value))
+		for _, f := range secretFiles {
+			files = append(files, &containerFile{path: path.Join(containerSecretsDir, f.name), content: f.content})
+		}
+		envs = append(envs, secretFileEnvs(instance, containerSecretsDir)...)
 	}
 
-	if _, ok := instance.Spec.Tools["helm"]; ok {
-		if deprecatedHelmVersionSet == "" {
-			envs = append(envs, fmt.Sprintf("HELM_VERSION=%s", downloader.GetBaseVersion(instance.Spec.Tools["helm"].Version)))
-		} else {
-			d.log.Warn("Both `spec.tools.helm` and the deprecated HELM_VERSION environment variable are set.  HELM_VERSION of '{}' is taking precedence", deprecatedHelmVersionSet)
+	// Generated credentials are passed as a kubeconfig, which the deployment may modify
+	if instance.kubeConfig != nil {
+		content, err := clientcmd.Write(*instance.kubeConfig)
+		if err != nil {
+			return newContainerError(instance, "Unable to write kubeconfig for deploy container. %v", err)
 		}
-	} else if deprecatedHelmVersionSet == "" {
-		d.log.Warn("Auto-detection of Helm v2 versions is now deprecated.  Use the `.spec.tools.helm` configuration for specifying the helm version to use. See https://github.com/PremiereGlobal/stim/blob/master/docs/DEPLOY.md for more details.")
-		// DEPRECATION: Auto-matching helm version is deprecated and the env variable below should be uncommented
-		// once this feature is removed
-		// envs = append(envs, "HELM_MATCH_SERVER=false")
+		files = append(files, &containerFile{path: path.Join(containerKubeDir, "config"), content: content})
+		envs = append(envs, fmt.Sprintf("KUBECONFIG=%s", path.Join(containerKubeDir, "config")))
+		mounts = append(mounts, mount.Mount{Type: mount.TypeTmpfs, Target: containerKubeDir})
 	}
 
-	// Since we're using Docker, we need to mount the Linux binaries
-	hostCacheDir := d.stim.ConfigGetCacheDir("bin/linux")
-	cacheDir := "/bin-cache"
-	workDir := "/scripts"
-	pathDir := "/stim/path"
+	// The ready marker is kept in the secrets tmpfs
+	if len(files) > 0 {
+		mounts = append(mounts, mount.Mount{Type: mount.TypeTmpfs, Target: containerSecretsDir})
+		command = fmt.Sprintf("while [ ! -e %s ]; do sleep 1; done; %s", containerFilesReady, command)
+	}
+	cmd := []string{"/bin/sh", "-c", command}
 
-	// Create the container spec
-	cmd := []string{"/bin/sh", "-c", fmt.Sprintf("export PATH=%s:${PATH}; ./%s", pathDir, d.config.Deployment.Script)}
+	hostConfig, err := d.containerHostConfig(instance, mounts)
+	if err != nil {
+		return newContainerError(instance, "%v", err)
+	}
 	resp, err := dockerClient.ContainerCreate(ctx, &container.Config{
 		Image:        image,
 		Cmd:          cmd,
-		Tty:          true,
+		Entrypoint:   instance.container.Entrypoint,
+		User:         instance.container.User,
+		Tty:          tty,
 		Env:          envs,
 		AttachStdout: true,
 		AttachStderr: true,
 		WorkingDir:   workDir,
-	}, &container.HostConfig{
-		AutoRemove: true,
-		Mounts: []mount.Mount{
-			mount.Mount{
-				Type:     mount.TypeBind,
-				Source:   d.config.Deployment.fullDirectoryPath,
-				Target:   workDir,
-				ReadOnly: false, // This could be set to false when the downloads don't go here
-			},
-			mount.Mount{
-				Type:     mount.TypeBind,
-				Source:   hostCacheDir,
-				Target:   cacheDir,
-				ReadOnly: false,
-			},
-			// mount.Mount{
-			// 	Type:     mount.TypeBind,
-			// 	Source:   e.GetPath()+"/",
-			// 	Target:   pathDir,
-			// 	ReadOnly: true,
-			// },
-		},
-	}, nil, "")
+	}, hostConfig, nil, "")
 	if err != nil {
-		d.log.Fatal("Error creating deploy container. {}", err)
+		return newContainerError(instance, "Error creating deploy container. %v", err)
 	}
 
+	// If the deployment is stopped, the container needs to be stopped too
+	defer d.stopContainer(ctx, dockerClient, instance, resp.ID)
+
 	// Start the container
 	if err := dockerClient.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		d.log.Fatal("Error starting deploy container. {}", err)
+		return newContainerError(instance, "Error starting deploy container. %v", err)
+	}
+	if len(files) > 0 {
+		if err := copyContainerFiles(ctx, dockerClient, resp.ID, files); err != nil {
+			dockerClient.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true})
+			return newContainerError(instance, "%v", err)
+		}
 	}
 
 	// Start capturing the logs
 	out, err := dockerClient.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{Follow: true, ShowStdout: true, ShowStderr: true})
 	if err != nil {
-		d.log.Fatal("Error getting container logs. {}", err)
+		return newContainerError(instance, "Error getting container logs. %v", err)
 	}
 	defer out.Close()
 
-	d.log.Info("--- START Stim deploy - Docker container logs ---")
-	scanner = bufio.NewScanner(out)
-	for scanner.Scan() {
-		fmt.Println(scanner.Text())
+	stdout, stderr, closeOutput, err := d.deployOutput(environment, instance)
+	if err != nil {
+		return newContainerError(instance, "%v", err)
+	}
+
+	d.log.Info("--- START Stim deploy - Docker container logs ({}) ---", instance.Name)
+	if tty {
+		_, err = io.Copy(stdout, out)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, out)
+	}
+	closeOutput()
+	d.log.Info("--- END Stim deploy - Docker container logs ({}) ---", instance.Name)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return newContainerError(instance, "Error reading container logs. %v", err)
 	}
-	d.log.Info("--- END Stim deploy - Docker container logs ---")
 
 	// Wait for the container to finish
 	statusCh, errCh := dockerClient.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
 	select {
 	case err := <-errCh:
-		if err != nil {
-			d.log.Fatal("Deploy container error. {}", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			return newContainerError(instance, "Error waiting for deploy container. %v", err)
 		}
 	case status := <-statusCh:
 		if status.Error != nil {
-			d.log.Fatal("Deployment resulted in error. {}. Halting any further deployments...", status.Error.Message)
+			return newContainerError(instance, "%s", status.Error.Message)
 		}
 		if status.StatusCode != 0 {
-			d.log.Fatal("Deployment to '{}' resulted in non-zero exit code {}. Halting any further deployments...", instance.Name, status.StatusCode)
+			return &scriptError{instance: instance.Name, exitCode: int(status.StatusCode)}
+		}
+	}
+
+	return nil
+}
+
+// containerEnvs returns the environment variables of the deploy container
+func (d *Deploy) containerEnvs(instance *Instance) []string {
+
+	var envs []string
+	deprecatedHelmVersionSet := ""
+	for _, e := range instance.Spec.EnvironmentVars {
+		if e.Name == "HELM_VERSION" {
+			d.log.Warn("The use of the HELM_VERSION environment variable for specifying Helm versions has been deprecated.  Use the `.spec.tools.helm` configuration for specifying the helm version to use.  See https://github.com/PremiereGlobal/stim/blob/master/docs/DEPLOY.md for more details.")
+			deprecatedHelmVersionSet = e.Value
+		}
+		envs = append(envs, fmt.Sprintf("%s=%s", e.Name, e.Value))
+	}
+	envs = append(envs, instance.awsEnvs...)
+	envs = append(envs, instance.secretEnvs...)
+
+	if _, ok := instance.Spec.Tools["helm"]; ok {
+		if deprecatedHelmVersionSet == "" {
+			envs = append(envs, fmt.Sprintf("HELM_VERSION=%s", downloader.GetBaseVersion(instance.Spec.Tools["helm"].Version)))
+		} else {
+			d.log.Warn("Both `spec.tools.helm` and the deprecated HELM_VERSION environment variable are set.  HELM_VERSION of '{}' is taking precedence", deprecatedHelmVersionSet)
+		}
+	} else if deprecatedHelmVersionSet == "" {
+		d.log.Warn("Auto-detection of Helm v2 versions is now deprecated.  Use the `.spec.tools.helm` configuration for specifying the helm version to use. See https://github.com/PremiereGlobal/stim/blob/master/docs/DEPLOY.md for more details.")
+		// DEPRECATION: Auto-matching helm version is deprecated and the env variable below should be uncommented
+		// once this feature is removed
+		// envs = append(envs, "HELM_MATCH_SERVER=false")
+	}
+
+	return envs
+}
+
+// containerHostConfig returns the host config of the deploy container, with
+// the configured mounts and resource limits added to the given stim mounts
+func (d *Deploy) containerHostConfig(instance *Instance, mounts []mount.Mount) (*container.HostConfig, error) {
+
+	c := instance.container
+	for _, m := range c.Mounts {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.hostSource(d.config.Deployment.configDirectory),
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+	for _, t := range c.Tmpfs {
+		tmpfs := mount.Mount{Type: mount.TypeTmpfs, Target: t.Target}
+		if t.Size != "" {
+			size, err := units.RAMInBytes(t.Size)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid tmpfs size '%s'. %v", t.Size, err))
+			}
+			tmpfs.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: size}
+		}
+		mounts = append(mounts, tmpfs)
+	}
+
+	hostConfig := &container.HostConfig{
+		AutoRemove:  true,
+		Mounts:      mounts,
+		NetworkMode: container.NetworkMode(c.Network),
+		ExtraHosts:  c.ExtraHosts,
+	}
+	if c.CPUs > 0 {
+		hostConfig.NanoCPUs = int64(c.CPUs * 1e9)
+	}
+	if c.Memory != "" {
+		memory, err := units.RAMInBytes(c.Memory)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid memory limit '%s'. %v", c.Memory, err))
+		}
+		hostConfig.Memory = memory
+	}
+
+	return hostConfig, nil
+}
+
+// containerFile is a file written to a tmpfs of the deploy container
+type containerFile struct {
+	path    string
+	content []byte
+}
+
+// copyContainerFiles writes the files to the running deploy container as the
+// container user, only readable by that user, then marks them as ready
+func copyContainerFiles(ctx context.Context, dockerClient *client.Client, containerID string, files []*containerFile) error {
+
+	for _, f := range files {
+		if err := containerExec(ctx, dockerClient, containerID, f.content, "umask 077 && cat > "+shellQuote(f.path)); err != nil {
+			return errors.New(fmt.Sprintf("Unable to write '%s' in deploy container. %v", f.path, err))
 		}
 	}
+	if err := containerExec(ctx, dockerClient, containerID, nil, "touch "+containerFilesReady); err != nil {
+		return errors.New(fmt.Sprintf("Unable to write '%s' in deploy container. %v", containerFilesReady, err))
+	}
+
+	return nil
+}
+
+// containerExec runs a shell command in the running container with the given
+// input, returning an error with the command's output if it fails
+func containerExec(ctx context.Context, dockerClient *client.Client, containerID string, input []byte, command string) error {
+
+	exec, err := dockerClient.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          []string{"/bin/sh", "-c", command},
+	})
+	if err != nil {
+		return err
+	}
+	attach, err := dockerClient.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return err
+	}
+	defer attach.Close()
+
+	if _, err := attach.Conn.Write(input); err != nil {
+		return err
+	}
+	if err := attach.CloseWrite(); err != nil {
+		return err
+	}
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, attach.Reader); err != nil {
+		return err
+	}
+
+	inspect, err := dockerClient.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return err
+	}
+	if inspect.ExitCode != 0 {
+		return errors.New(fmt.Sprintf("Exited with code %d. %s", inspect.ExitCode, strings.TrimSpace(output.String())))
+	}
+
+	return nil
+}
+
+// stopContainer stops and removes the deploy container if the deployment was
+// stopped before the container exited
+func (d *Deploy) stopContainer(ctx context.Context, dockerClient *client.Client, instance *Instance, containerID string) {
+
+	if ctx.Err() == nil {
+		return
+	}
+
+	d.log.Info("Stopping deploy container for '{}'", instance.Name)
+	timeout := 10 * time.Second
+	if err := dockerClient.ContainerStop(context.Background(), containerID, &timeout); err != nil {
+		d.log.Debug("Error stopping deploy container for '{}': {}", instance.Name, err)
+	}
+	if err := dockerClient.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true}); err != nil {
+		d.log.Debug("Error removing deploy container for '{}': {}", instance.Name, err)
+	}
+}
+
+// linkContainerTools downloads the Linux binaries of the instance tools and
+// links them in a new directory which is mounted as the container PATH
+// directory.  The links point to containerCacheDir, where the binary cache is
+// mounted in the container.  Returns the host path of the directory.
+func (d *Deploy) linkContainerTools(instance *Instance, containerCacheDir string) (string, error) {
+
+	pathDir, err := ioutil.TempDir("", "stim-path")
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Unable to create PATH directory for deploy container. %v", err))
+	}
+
+	// Detecting the kubectl version needs a kubeconfig, which is kept out of the mounted directory
+	var kc *kubernetes.Config
+	if tool, ok := instance.Spec.Tools["kubectl"]; ok && tool.Version == "" && instance.Spec.Kubernetes.Cluster != "" {
+		kubeDir, err := ioutil.TempDir("", "stim-kube")
+		if err != nil {
+			os.RemoveAll(pathDir)
+			return "", errors.New(fmt.Sprintf("Unable to create kubeconfig directory. %v", err))
+		}
+		defer os.RemoveAll(kubeDir)
+		kc, err = d.stim.KubeConfig(filepath.Join(kubeDir, "kubeconfig"), d.envConfigKubernetes(instance))
+		if err != nil {
+			os.RemoveAll(pathDir)
+			return "", err
+		}
+	}
+
+	versions, err := d.stim.LinkTools(&stim.ToolsConfig{
+		Tools:         instance.Spec.Tools,
+		OS:            "linux",
+		LinkDir:       pathDir,
+		LinkSourceDir: containerCacheDir,
+		Kubernetes:    kc,
+	})
+	if err != nil {
+		os.RemoveAll(pathDir)
+		return "", err
+	}
+	for tool, version := range versions {
+		d.log.Debug("Using {} version {} in deploy container for '{}'", tool, version, instance.Name)
+	}
+	instance.toolVersions = versions
 
+	return pathDir, nil
 }
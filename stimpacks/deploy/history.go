@@ -0,0 +1,416 @@
+package deploy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+)
+
+const (
+	historyFileName = "deploy-history.jsonl"
+
+	// historyKeyTimeFormat is used for Vault history keys so they sort by time
+	historyKeyTimeFormat = "20060102T150405.000000000Z"
+
+	// historyRecordKey is the Vault secret key holding a history record
+	historyRecordKey = "record"
+)
+
+// historyLock ensures parallel deployments do not interleave history records
+var historyLock sync.Mutex
+
+// historyKeyUnsafe matches characters which are not used in Vault history keys
+var historyKeyUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// History describes where deployment history is recorded, in addition to
+// the local history file
+type History struct {
+	VaultPath string `yaml:"vaultPath"`
+}
+
+// historyRecord is a record of a single instance deployment
+type historyRecord struct {
+	Time            time.Time         `json:"time"`
+	User            string            `json:"user"`
+	Environment     string            `json:"environment"`
+	Instance        string            `json:"instance"`
+	Cluster         string            `json:"cluster"`
+	Directory       string            `json:"directory"`
+	GitCommit       string            `json:"gitCommit,omitempty"`
+	Method          string            `json:"method"`
+	Image           string            `json:"image,omitempty"`
+	Tools           map[string]string `json:"tools,omitempty"`
+	ExitCode        int               `json:"exitCode"`
+	Error           string            `json:"error,omitempty"`
+	DurationSeconds float64           `json:"durationSeconds"`
+	ApprovedBy      string            `json:"approvedBy,omitempty"`
+	OverrideReason  string            `json:"overrideReason,omitempty"`
+	RollbackTo      *time.Time        `json:"rollbackTo,omitempty"`
+	Snapshot        *deploySnapshot   `json:"snapshot,omitempty"`
+}
+
+// recordHistory records the deployment of an instance in the local history
+// file and, if configured, in Vault.  Problems recording history are only
+// logged so they do not affect the deployment.
+func (d *Deploy) recordHistory(environment *Environment, instance *Instance, deployMethod int, start time.Time, deployErr error) {
+
+	record := &historyRecord{
+		Time:            start.UTC(),
+		User:            d.deployUser(),
+		Environment:     environment.Name,
+		Instance:        instance.Name,
+		Cluster:         instance.Spec.Kubernetes.Cluster,
+		Directory:       d.config.Deployment.fullDirectoryPath,
+		GitCommit:       gitCommit(d.config.Deployment.fullDirectoryPath),
+		Tools:           historyTools(instance),
+		ExitCode:        exitCode(deployErr),
+		DurationSeconds: time.Since(start).Round(time.Millisecond).Seconds(),
+	}
+	if deployErr != nil {
+		record.Error = deployErr.Error()
+	}
+	if d.protection != nil {
+		record.ApprovedBy = d.protection.approvedBy
+		record.OverrideReason = d.protection.overrideReason
+	}
+	if d.rollback != nil {
+		record.Directory = d.rollback.repoPath(record.Directory)
+		record.RollbackTo = &d.rollback.record.Time
+	}
+
+	switch deployMethod {
+	case DEPLOY_METHOD_DOCKER:
+		record.Method = "docker"
+		record.Image = d.containerImage(instance)
+	case DEPLOY_METHOD_SHELL:
+		record.Method = "shell"
+	default:
+		record.Method = "unknown"
+	}
+
+	// Only successful deployments can be rolled back to
+	if deployErr == nil {
+		record.Snapshot = d.makeSnapshot(instance, deployMethod)
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	if err := appendHistoryFile(d.historyFilePath(), record); err != nil {
+		d.log.Warn("Unable to write deploy history: {}", err)
+	}
+
+	if vaultPath := d.config.Deployment.History.VaultPath; vaultPath != "" {
+		content, err := json.Marshal(record)
+		if err == nil {
+			data := map[string]interface{}{historyRecordKey: string(content)}
+			err = d.stim.Vault().WriteKV(path.Join(vaultPath, historyKey(record)), data)
+		}
+		if err != nil {
+			d.log.Warn("Unable to write deploy history to Vault path '{}': {}", vaultPath, err)
+		}
+	}
+}
+
+// historyTools returns the tool versions used by the deployment of the
+// instance, falling back to the versions in the spec for tools whose version
+// was not resolved
+func historyTools(instance *Instance) map[string]string {
+
+	tools := make(map[string]string)
+	for name, version := range instance.toolVersions {
+		tools[name] = version
+	}
+	for name, tool := range instance.Spec.Tools {
+		if _, ok := tools[name]; !ok {
+			tools[name] = pick(tool.Version, "auto")
+		}
+	}
+
+	return tools
+}
+
+// deployUser returns the Vault username of the user deploying, falling back
+// to the local username
+func (d *Deploy) deployUser() string {
+	if username, err := d.stim.Vault().GetUsername(); err == nil {
+		return username
+	}
+	if username, err := d.stim.User(); err == nil {
+		return username
+	}
+	return "unknown"
+}
+
+// historyFilePath returns the path of the local deploy history file
+func (d *Deploy) historyFilePath() string {
+	return filepath.Join(d.stim.ConfigGetString("path"), historyFileName)
+}
+
+// exitCode returns the exit code of the deployment script for the given
+// deployment error.  Returns -1 if the deployment failed before or outside of
+// the script.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if scriptErr, ok := err.(*scriptError); ok {
+		return scriptErr.exitCode
+	}
+	return -1
+}
+
+// gitCommit returns the current git commit of the given directory, or an
+// empty string if it is not in a git repo
+func gitCommit(dir string) string {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// historyKey returns the Vault key a history record is stored under
+func historyKey(record *historyRecord) string {
+	return historyKeyUnsafe.ReplaceAllString(fmt.Sprintf("%s-%s-%s", record.Time.Format(historyKeyTimeFormat), record.Environment, record.Instance), "_")
+}
+
+// appendHistoryFile appends a record to the history file
+func appendHistoryFile(historyFile string, record *historyRecord) error {
+
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = utils.CreateDirIfNotExist(filepath.Dir(historyFile), utils.UserGroupMode)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(content, '\n'))
+	return err
+}
+
+// readHistoryFile reads all records from the history file
+func readHistoryFile(historyFile string) ([]*historyRecord, error) {
+
+	f, err := os.Open(historyFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*historyRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		record := &historyRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid history record on line %d of %s: %v", line, historyFile, err))
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// readVaultHistory reads all records from the given Vault path
+func (d *Deploy) readVaultHistory(vaultPath string) ([]*historyRecord, error) {
+
+	vault := d.stim.Vault()
+
+	keys, err := vault.ListKV(vaultPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*historyRecord
+	for _, key := range keys {
+		data, err := vault.ReadKV(path.Join(vaultPath, key))
+		if err != nil {
+			return nil, err
+		}
+		content, ok := data[historyRecordKey].(string)
+		if !ok {
+			d.log.Debug("Skipping Vault history secret '{}' without a record", key)
+			continue
+		}
+		record := &historyRecord{}
+		if err := json.Unmarshal([]byte(content), record); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid history record in Vault secret '%s': %v", key, err))
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// readHistory reads all records from the given history source ('local' or
+// 'vault').  The Vault path defaults to the one set in the deployment file.
+// Exits if the history can't be read.
+func (d *Deploy) readHistory(source string, vaultPath string) []*historyRecord {
+
+	var records []*historyRecord
+	var err error
+	switch source {
+	case "local":
+		records, err = readHistoryFile(d.historyFilePath())
+	case "vault":
+		if vaultPath == "" {
+			d.parseConfig()
+			vaultPath = d.config.Deployment.History.VaultPath
+		}
+		if vaultPath == "" {
+			d.log.Fatal("No Vault history path set.  Use --vault-path or set 'deployment.history.vaultPath' in the deployment file")
+		}
+		records, err = d.readVaultHistory(vaultPath)
+	default:
+		d.log.Fatal("Invalid history source '{}'.  Must be one of ['local','vault']", source)
+	}
+	if err != nil {
+		d.log.Fatal("Error reading deploy history: {}", err)
+	}
+
+	return records
+}
+
+// historyFilter selects history records
+type historyFilter struct {
+	environment string
+	instance    string
+	user        string
+	since       time.Time
+	until       time.Time
+}
+
+// matches returns true if the record is selected by the filter
+func (f historyFilter) matches(record *historyRecord) bool {
+	if f.environment != "" && record.Environment != f.environment {
+		return false
+	}
+	if f.instance != "" && record.Instance != f.instance {
+		return false
+	}
+	if f.user != "" && record.User != f.user {
+		return false
+	}
+	if !f.since.IsZero() && record.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && record.Time.After(f.until) {
+		return false
+	}
+	return true
+}
+
+// parseHistoryTime parses a time filter.  Values can be a duration before now
+// (ex. 24h), a date (2006-01-02) or an RFC3339 timestamp.
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("Invalid time '%s'.  Must be a duration (ex. 24h), date (ex. 2006-01-02) or RFC3339 timestamp", value))
+}
+
+// DeployHistory is the entrypoint to the "deploy history" command
+// It prints the deployment history matching the given filters
+func (d *Deploy) DeployHistory() {
+
+	d.log = d.stim.GetLogger()
+
+	output := d.stim.ConfigGetString("deploy.history.output")
+	if !utils.Contains([]string{"table", "json"}, output) {
+		d.log.Fatal("Invalid output format '{}'.  Must be one of ['table','json']", output)
+	}
+
+	now := time.Now()
+	since, err := parseHistoryTime(d.stim.ConfigGetString("deploy.history.since"), now)
+	if err != nil {
+		d.log.Fatal("Invalid --since value: {}", err)
+	}
+	until, err := parseHistoryTime(d.stim.ConfigGetString("deploy.history.until"), now)
+	if err != nil {
+		d.log.Fatal("Invalid --until value: {}", err)
+	}
+	filter := historyFilter{
+		environment: d.stim.ConfigGetString("deploy.environment"),
+		instance:    d.stim.ConfigGetString("deploy.instance"),
+		user:        d.stim.ConfigGetString("deploy.history.user"),
+		since:       since,
+		until:       until,
+	}
+
+	records := d.readHistory(d.stim.ConfigGetString("deploy.history.source"), d.stim.ConfigGetString("deploy.history.vault-path"))
+
+	matched := []*historyRecord{}
+	for _, record := range records {
+		if filter.matches(record) {
+			matched = append(matched, record)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Time.Before(matched[j].Time) })
+
+	if l := d.stim.ConfigGetString("deploy.history.limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			d.log.Fatal("Invalid value for --limit '{}'. Must be a positive integer", l)
+		}
+		if limit > 0 && len(matched) > limit {
+			matched = matched[len(matched)-limit:]
+		}
+	}
+
+	if output == "json" {
+		d.writeJSON(matched)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tUSER\tENVIRONMENT\tINSTANCE\tCLUSTER\tCOMMIT\tEXIT CODE\tDURATION")
+	for _, r := range matched {
+		commit := r.GitCommit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		duration := time.Duration(r.DurationSeconds * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", r.Time.Local().Format("2006-01-02 15:04:05"), r.User, r.Environment, r.Instance, r.Cluster, commit, r.ExitCode, duration)
+	}
+	w.Flush()
+}
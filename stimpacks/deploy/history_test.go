@@ -0,0 +1,46 @@
+package deploy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PremiereGlobal/stim/stim"
+	"gotest.tools/assert"
+)
+
+func TestParseHistoryTime(t *testing.T) {
+	now := time.Date(2020, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	since, err := parseHistoryTime("24h", now)
+	assert.NilError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), since, "Values not Equal")
+
+	since, err = parseHistoryTime("2020-05-01", now)
+	assert.NilError(t, err)
+	assert.Equal(t, time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC), since, "Values not Equal")
+
+	_, err = parseHistoryTime("yesterday", now)
+	assert.ErrorContains(t, err, "Invalid time 'yesterday'")
+
+	filter := historyFilter{environment: "prod", since: now.Add(-time.Hour)}
+	assert.Assert(t, filter.matches(&historyRecord{Environment: "prod", Time: now}))
+	assert.Assert(t, !filter.matches(&historyRecord{Environment: "dev", Time: now}))
+	assert.Assert(t, !filter.matches(&historyRecord{Environment: "prod", Time: now.Add(-2 * time.Hour)}))
+}
+
+func TestHistoryTools(t *testing.T) {
+	instance := &Instance{
+		Spec: &Spec{Tools: map[string]stim.EnvTool{
+			"helm":    {Version: "3.1"},
+			"kubectl": {},
+			"vault":   {Version: "1.4"},
+		}},
+		toolVersions: map[string]string{"helm": "3.1.2", "kubectl": "1.17.4"},
+	}
+
+	// Resolved versions are recorded over the versions in the spec
+	assert.DeepEqual(t, map[string]string{"helm": "3.1.2", "kubectl": "1.17.4", "vault": "1.4"}, historyTools(instance))
+
+	instance.toolVersions = nil
+	assert.DeepEqual(t, map[string]string{"helm": "3.1", "kubectl": "auto", "vault": "1.4"}, historyTools(instance))
+}
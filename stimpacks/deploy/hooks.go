@@ -0,0 +1,165 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+)
+
+// Hook failure policies
+const (
+	hookPolicyAbort = "abort"
+	hookPolicyWarn  = "warn"
+)
+
+// Hooks describes commands which are run around a deployment
+type Hooks struct {
+	PreDeploy     []string `yaml:"preDeploy" json:"preDeploy,omitempty"`
+	PostDeploy    []string `yaml:"postDeploy" json:"postDeploy,omitempty"`
+	OnFailure     []string `yaml:"onFailure" json:"onFailure,omitempty"`
+	FailurePolicy string   `yaml:"failurePolicy" json:"failurePolicy,omitempty"`
+}
+
+// isEmpty returns true if there are no hook commands
+func (h Hooks) isEmpty() bool {
+	return len(h.PreDeploy) == 0 && len(h.PostDeploy) == 0 && len(h.OnFailure) == 0
+}
+
+// policy returns the failure policy of the hooks, defaulting to abort
+func (h Hooks) policy() string {
+	if h.FailurePolicy == "" {
+		return hookPolicyAbort
+	}
+	return h.FailurePolicy
+}
+
+// mergeHooks is used to merge hooks at the various levels they can be set at
+// Hooks from all levels are run, global first.  The failure policy of the
+// most specific level which sets one is used.
+func mergeHooks(instance Hooks, environment Hooks, global Hooks) Hooks {
+
+	var result Hooks
+	for _, h := range []Hooks{global, environment, instance} {
+		result.PreDeploy = append(result.PreDeploy, h.PreDeploy...)
+		result.PostDeploy = append(result.PostDeploy, h.PostDeploy...)
+		result.OnFailure = append(result.OnFailure, h.OnFailure...)
+		overrideString(&result.FailurePolicy, h.FailurePolicy)
+	}
+
+	return result
+}
+
+// validateHooks ensures the hooks config is valid
+func (d *Deploy) validateHooks(hooks Hooks, hooksPath configPath) {
+	if hooks.FailurePolicy != "" && !utils.Contains([]string{hookPolicyAbort, hookPolicyWarn}, hooks.FailurePolicy) {
+		d.addConfigError(hooksPath.with("failurePolicy"), "Invalid hook failure policy '%s'. Must be one of ['%s','%s']", hooks.FailurePolicy, hookPolicyAbort, hookPolicyWarn)
+	}
+}
+
+// deployCommand returns the shell command which runs the deployment script
+// along with any hooks.  The hooks run in the same shell as the script so
+// they have the same environment.  The exit code of the first failure is kept.
+func deployCommand(hooks Hooks, script string) string {
+
+	scriptCommand := "./" + script
+	if hooks.isEmpty() {
+		return scriptCommand
+	}
+
+	var lines []string
+
+	// Runs the onFailure hooks then exits with the given exit code
+	lines = append(lines, "stim_deploy_failed() {")
+	for _, hook := range hooks.OnFailure {
+		lines = append(lines, "  "+hookLine("onFailure", hook, hookPolicyWarn))
+	}
+	lines = append(lines, `  exit "$1"`, "}")
+
+	for _, hook := range hooks.PreDeploy {
+		lines = append(lines, hookLine("preDeploy", hook, hooks.policy()))
+	}
+	lines = append(lines, scriptCommand+` || stim_deploy_failed "$?"`)
+	for _, hook := range hooks.PostDeploy {
+		lines = append(lines, hookLine("postDeploy", hook, hooks.policy()))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// hookLine returns the shell command to run a single hook with the given failure policy
+func hookLine(stage string, hook string, policy string) string {
+
+	announce := fmt.Sprintf("echo %s", shellQuote(fmt.Sprintf("--- Running %s hook: %s", stage, hook)))
+	run := fmt.Sprintf("/bin/sh -c %s", shellQuote(hook))
+
+	if policy == hookPolicyWarn {
+		warning := shellQuote(fmt.Sprintf("WARNING: %s hook failed with exit code ", stage))
+		return fmt.Sprintf(`%s; %s || echo %s"$?"`, announce, run, warning)
+	}
+
+	return fmt.Sprintf(`%s; %s || stim_deploy_failed "$?"`, announce, run)
+}
+
+// shellQuote quotes a string for use as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// rolloutHooksCommand returns the shell command which runs the environment
+// hooks of a stage.  With the abort policy, the first failing hook stops the
+// command with its exit code.
+func rolloutHooksCommand(stage string, hooks []string, policy string) string {
+
+	lines := []string{`stim_deploy_failed() { exit "$1"; }`}
+	for _, hook := range hooks {
+		lines = append(lines, hookLine(stage, hook, policy))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// resolveRolloutHooks sets the instances deployed by the rollout in the
+// environment of the environment-level hooks, and reads their valueFrom values
+// and credentials.  This is done once for all stages of the rollout.
+func (d *Deploy) resolveRolloutHooks(ctx context.Context, environment *Environment, instances []*Instance) error {
+
+	instance := environment.hooksInstance
+	for _, e := range instance.Spec.EnvironmentVars {
+		if e.Name == "DEPLOY_INSTANCES" {
+			e.Value = strings.Join(instanceNames(instances), ",")
+		}
+	}
+
+	if err := d.resolveInstance(ctx, instance); err != nil {
+		return errors.New(fmt.Sprintf("Unable to set up the hooks of environment '%s'. %v", environment.Name, err))
+	}
+
+	return nil
+}
+
+// runRolloutHooks runs the given environment-level hooks once for a rollout
+// to multiple instances.  They are run the same way as instance deployments,
+// in a deploy container or the local shell, with the environment and global
+// specs (see resolveRolloutHooks).
+func (d *Deploy) runRolloutHooks(ctx context.Context, environment *Environment, stage string, hooks []string, policy string) error {
+
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	deployMethod, err := d.DetermineDeployMethod()
+	if err != nil {
+		return err
+	}
+
+	d.log.Info("Running environment {} hooks for '{}'", stage, environment.Name)
+	err = d.startDeployment(ctx, environment, environment.hooksInstance, deployMethod, rolloutHooksCommand(stage, hooks, policy))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Environment %s hooks for '%s' failed. %v", stage, environment.Name, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package deploy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PremiereGlobal/stim/stim"
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	"gotest.tools/assert"
+)
+
+// runDeployCommand runs the deploy command for the given hooks with a script
+// which exits with the given code, returning the output and exit code
+func runDeployCommand(t *testing.T, hooks Hooks, scriptExitCode string) (string, int) {
+	dir, err := ioutil.TempDir("", "stim-hooks")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := "#!/bin/sh\necho script\nexit " + scriptExitCode + "\n"
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "deploy.sh"), []byte(script), 0755))
+
+	cmd := exec.Command("/bin/sh", "-c", "cd "+dir+" && "+deployCommand(hooks, "deploy.sh"))
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), exitErr.ExitCode()
+	}
+	assert.NilError(t, err)
+	return string(out), 0
+}
+
+// outputLines returns the output without the hook announcements
+func outputLines(out string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if !strings.HasPrefix(line, "--- Running") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, ",")
+}
+
+func TestDeployCommand(t *testing.T) {
+	assert.Equal(t, "./deploy.sh", deployCommand(Hooks{}, "deploy.sh"), "Values not Equal")
+
+	hooks := Hooks{
+		PreDeploy:  []string{"echo 'pre'"},
+		PostDeploy: []string{"echo post; exit 4", "echo post2"},
+		OnFailure:  []string{"echo failed; exit 1", "echo failed2"},
+	}
+
+	out, code := runDeployCommand(t, hooks, "3")
+	assert.Equal(t, "pre,script,failed,WARNING: onFailure hook failed with exit code 1,failed2", outputLines(out), "Values not Equal")
+	assert.Equal(t, 3, code, "Script exit code should be kept")
+
+	out, code = runDeployCommand(t, hooks, "0")
+	assert.Equal(t, "pre,script,post,failed,WARNING: onFailure hook failed with exit code 1,failed2", outputLines(out), "Values not Equal")
+	assert.Equal(t, 4, code, "Hook exit code should be kept")
+
+	hooks.FailurePolicy = hookPolicyWarn
+	out, code = runDeployCommand(t, hooks, "0")
+	assert.Equal(t, "pre,script,post,WARNING: postDeploy hook failed with exit code 4,post2", outputLines(out), "Values not Equal")
+	assert.Equal(t, 0, code, "Values not Equal")
+}
+
+func TestRolloutHooksCommand(t *testing.T) {
+	hooks := []string{"echo one", "exit 3", "echo two"}
+
+	out, err := exec.Command("/bin/sh", "-c", rolloutHooksCommand("preDeploy", hooks, hookPolicyAbort)).Output()
+	assert.Equal(t, "one", outputLines(string(out)), "Values not Equal")
+	exitErr, ok := err.(*exec.ExitError)
+	assert.Assert(t, ok, "Hook exit code should be kept")
+	assert.Equal(t, 3, exitErr.ExitCode(), "Values not Equal")
+
+	out, err = exec.Command("/bin/sh", "-c", rolloutHooksCommand("preDeploy", hooks, hookPolicyWarn)).Output()
+	assert.NilError(t, err)
+	assert.Equal(t, "one,WARNING: preDeploy hook failed with exit code 3,two", outputLines(string(out)), "Values not Equal")
+}
+
+// containerEnvMap returns the environment variables of the deploy container of the instance
+func containerEnvMap(d *Deploy, instance *Instance) map[string]string {
+	envs := map[string]string{}
+	for _, e := range d.containerEnvs(instance) {
+		parts := strings.SplitN(e, "=", 2)
+		envs[parts[0]] = parts[1]
+	}
+	return envs
+}
+
+func TestRolloutHooksInstance(t *testing.T) {
+	d := &Deploy{stim: stim.New()}
+	d.log = d.stim.GetLogger()
+	d.config.Deployment.Container = Container{Repo: "stim-deploy", Tag: "0.3.4"}
+	d.config.Global.Spec = &Spec{
+		Kubernetes:      Kubernetes{ServiceAccount: "deploy"},
+		EnvironmentVars: []*EnvironmentVar{{Name: "LOG_LEVEL", Value: "info"}},
+		Tools:           map[string]stim.EnvTool{"helm": {Version: "3.1"}},
+	}
+
+	// Hooks are run in a deploy container with the environment and global specs
+	environment := &Environment{
+		Name: "prod",
+		Spec: &Spec{
+			Kubernetes:      Kubernetes{Cluster: "prod-west"},
+			EnvironmentVars: []*EnvironmentVar{{Name: "APP_URL", Value: "https://${DEPLOY_ENVIRONMENT}.example.com"}},
+			Secrets:         []*v2e.SecretItem{{SecretPath: "secret/app", SecretMaps: map[string]string{"DB_PASSWORD": "password"}}},
+		},
+		Container: &Container{Tag: "1.0"},
+		Hooks:     Hooks{PreDeploy: []string{"./migrate.sh"}},
+	}
+	environment.hooksInstance = &Instance{Name: environment.Name, Spec: &Spec{}}
+	d.processInstance(environment, environment.hooksInstance, 0, -1, "https://vault", "s.token")
+	assert.Equal(t, 0, len(d.config.errors), "Values not Equal")
+
+	envs := containerEnvMap(d, environment.hooksInstance)
+	for name, value := range map[string]string{
+		"LOG_LEVEL":          "info",
+		"APP_URL":            "https://prod.example.com",
+		"HELM_VERSION":       "3.1",
+		"DEPLOY_ENVIRONMENT": "prod",
+		"DEPLOY_CLUSTER":     "prod-west",
+		"VAULT_TOKEN":        "s.token",
+		"STIM_DEPLOY":        "true",
+	} {
+		assert.Equal(t, value, envs[name], "Values not Equal for %s", name)
+	}
+	_, ok := envs["DEPLOY_INSTANCE"]
+	assert.Assert(t, !ok, "DEPLOY_INSTANCE should not be set for environment hooks")
+	assert.Assert(t, strings.Contains(envs["SECRET_CONFIG"], "secret/app"), envs["SECRET_CONFIG"])
+	assert.Assert(t, strings.Contains(envs["SECRET_CONFIG"], "CLUSTER_SERVER"), envs["SECRET_CONFIG"])
+	assert.Equal(t, "1.0", environment.hooksInstance.container.Tag, "Values not Equal")
+	assert.Equal(t, "prod-west", d.envConfigKubernetes(environment.hooksInstance).Cluster, "Values not Equal")
+
+	// Without a cluster, hooks are run without Kubernetes credentials
+	staging := &Environment{
+		Name:      "staging",
+		Spec:      &Spec{},
+		Hooks:     Hooks{PostDeploy: []string{"./notify.sh"}},
+		Instances: []*Instance{{Name: "us-west-2"}, {Name: "us-east-1"}},
+	}
+	staging.hooksInstance = &Instance{Name: staging.Name, Spec: &Spec{}}
+	d.processInstance(staging, staging.hooksInstance, 1, -1, "https://vault", "s.token")
+	assert.NilError(t, d.resolveRolloutHooks(context.Background(), staging, staging.Instances))
+
+	envs = containerEnvMap(d, staging.hooksInstance)
+	assert.Equal(t, "us-west-2,us-east-1", envs["DEPLOY_INSTANCES"], "Values not Equal")
+	assert.Equal(t, "", envs["SECRET_CONFIG"], "Values not Equal")
+	assert.Assert(t, d.envConfigKubernetes(staging.hooksInstance) == nil, "Kubernetes should not be set up")
+}
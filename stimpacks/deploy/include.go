@@ -0,0 +1,395 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+const (
+	// vaultIncludePrefix designates an included config stored in Vault
+	// (ex. 'vault:secret/deploy/shared#config')
+	vaultIncludePrefix = "vault:"
+
+	// defaultVaultIncludeKey is the Vault secret key read if one is not specified
+	defaultVaultIncludeKey = "config"
+)
+
+// decodeConfigSource decodes a deployment config and merges in any configs it
+// includes.  The source is the file path or Vault path the content was read
+// from and stack contains the sources currently being decoded, to detect
+// include cycles.  Returns false if the config, or any config it includes,
+// could not be decoded.
+func (d *Deploy) decodeConfigSource(source string, content []byte, strict bool, stack []string) (*Config, bool) {
+
+	// Parse the document tree, this is used to look up the location of any errors
+	root := &yaml3.Node{}
+	err := yaml3.Unmarshal(content, root)
+	if err != nil {
+		d.addYamlErrors(source, nil, err)
+		return nil, false
+	}
+	if len(stack) == 0 {
+		d.config.root = root
+	}
+
+	config := &Config{}
+	if strict {
+		err = yaml.UnmarshalStrict(content, config)
+	} else {
+		err = yaml.Unmarshal(content, config)
+	}
+	if err != nil {
+		d.addYamlErrors(source, root, err)
+
+		// Type errors still decode the rest of the document so we can continue looking for more
+		if _, ok := err.(*yaml.TypeError); !ok {
+			return nil, false
+		}
+	}
+
+	config.setSources(source)
+
+	// Merge the included configs in order, with later includes taking
+	// precedence over earlier ones and this config over all of them
+	stack = append(stack, normalizeConfigSource(source))
+	base := &Config{}
+	ok := true
+	for k, include := range config.Include {
+
+		includePath := configPath{"include", k}
+		includeSource := d.resolveInclude(source, include)
+
+		if utils.Contains(stack, normalizeConfigSource(includeSource)) {
+			d.addFileError(source, root, includePath, "Include cycle detected: %s", strings.Join(append(stack, includeSource), " -> "))
+			ok = false
+			continue
+		}
+
+		d.log.Debug("Including deployment config '{}' in '{}'", includeSource, source)
+		includeContent, err := d.readConfigSource(includeSource)
+		if err != nil {
+			d.addFileError(source, root, includePath, "Included config '%s' could not be read: %v", include, err)
+			ok = false
+			continue
+		}
+
+		included, includedOk := d.decodeConfigSource(includeSource, includeContent, strict, stack)
+		if !includedOk {
+			ok = false
+			continue
+		}
+		base = mergeConfigs(base, included)
+	}
+
+	return mergeConfigs(base, config), ok
+}
+
+// resolveInclude returns the source of an include.  Relative file paths are
+// relative to the including file, or the deployment file if the include is
+// in Vault.
+func (d *Deploy) resolveInclude(from string, include string) string {
+	if strings.HasPrefix(include, vaultIncludePrefix) || filepath.IsAbs(include) {
+		return include
+	}
+
+	if strings.HasPrefix(from, vaultIncludePrefix) {
+		from = d.config.configFilePath
+	}
+
+	return filepath.Join(filepath.Dir(from), include)
+}
+
+// normalizeConfigSource returns the source in a form that can be compared
+func normalizeConfigSource(source string) string {
+	if strings.HasPrefix(source, vaultIncludePrefix) {
+		return source
+	}
+	return filepath.Clean(source)
+}
+
+// readConfigSource reads the content of a file or Vault config source
+func (d *Deploy) readConfigSource(source string) ([]byte, error) {
+
+	if !strings.HasPrefix(source, vaultIncludePrefix) {
+		return ioutil.ReadFile(source)
+	}
+
+	secretPath := strings.TrimPrefix(source, vaultIncludePrefix)
+	key := defaultVaultIncludeKey
+	if i := strings.LastIndex(secretPath, "#"); i >= 0 {
+		key = secretPath[i+1:]
+		secretPath = secretPath[:i]
+	}
+
+	data, err := d.stim.Vault().ReadKV(secretPath)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := data[key].(string)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Key '%s' not found in Vault secret '%s'", key, secretPath))
+	}
+
+	return []byte(value), nil
+}
+
+// setSources records the given source as the origin of every spec item in the config
+func (c *Config) setSources(source string) {
+	specs := []*Spec{c.Global.Spec}
+	for _, environment := range c.Environments {
+		specs = append(specs, environment.Spec)
+		for _, instance := range environment.Instances {
+			specs = append(specs, instance.Spec)
+		}
+	}
+
+	for _, spec := range specs {
+		if spec != nil {
+			spec.origins = newSpecOrigins()
+			spec.origins.setSource(spec, source)
+		}
+	}
+}
+
+// mergeConfigs merges two configs, with values in override taking precedence
+// over those in base.  Environments with the same name are merged in the same
+// way as an environment which extends another.
+func mergeConfigs(base *Config, override *Config) *Config {
+
+	result := &Config{
+		Deployment: base.Deployment,
+		Global:     Global{Spec: mergeSpec(override.Global.Spec, base.Global.Spec)},
+	}
+
+	overrideString(&result.Deployment.Directory, override.Deployment.Directory)
+	overrideString(&result.Deployment.Script, override.Deployment.Script)
+	result.Deployment.Container = mergeContainer(&override.Deployment.Container, base.Deployment.Container)
+	overrideString(&result.Deployment.RequiredVersion, override.Deployment.RequiredVersion)
+	overrideString(&result.Deployment.MinimumVersion, override.Deployment.MinimumVersion)
+	overrideString(&result.Deployment.History.VaultPath, override.Deployment.History.VaultPath)
+	overrideString(&result.Deployment.Lock.VaultPath, override.Deployment.Lock.VaultPath)
+	overrideString(&result.Deployment.Lock.TTL, override.Deployment.Lock.TTL)
+	if override.Deployment.Parallelism != 0 {
+		result.Deployment.Parallelism = override.Deployment.Parallelism
+	}
+
+	for _, environment := range override.Environments {
+		if parent := findEnvironment(base.Environments, environment.Name); parent != nil {
+			result.Environments = append(result.Environments, mergeEnvironment(environment, parent))
+		} else {
+			result.Environments = append(result.Environments, environment)
+		}
+	}
+	for _, environment := range base.Environments {
+		if findEnvironment(override.Environments, environment.Name) == nil {
+			result.Environments = append(result.Environments, environment)
+		}
+	}
+
+	return result
+}
+
+// resolveExtends merges each environment's parent environment into it
+func (d *Deploy) resolveExtends() {
+	resolved := make(map[int]bool)
+	for i := range d.config.Environments {
+		d.extendEnvironment(i, nil, resolved)
+	}
+}
+
+// extendEnvironment merges the parent environment of the environment at the
+// given index into it, first extending the parent if required
+func (d *Deploy) extendEnvironment(index int, stack []string, resolved map[int]bool) {
+
+	environment := d.config.Environments[index]
+	if resolved[index] {
+		return
+	}
+	resolved[index] = true
+
+	if environment.Extends == "" {
+		return
+	}
+
+	extendsPath := configPath{"environments", index, "extends"}
+	if environment.Extends == environment.Name || utils.Contains(stack, environment.Extends) {
+		d.addConfigError(extendsPath, "Environment extends cycle detected: %s", strings.Join(append(stack, environment.Name, environment.Extends), " -> "))
+		return
+	}
+
+	parentIndex := -1
+	for i, e := range d.config.Environments {
+		if e.Name == environment.Extends {
+			parentIndex = i
+			break
+		}
+	}
+	if parentIndex < 0 {
+		d.addConfigError(extendsPath, "Environment '%s' extends unknown environment '%s'", environment.Name, environment.Extends)
+		return
+	}
+
+	d.extendEnvironment(parentIndex, append(stack, environment.Name), resolved)
+
+	d.config.Environments[index] = mergeEnvironment(environment, d.config.Environments[parentIndex])
+}
+
+// mergeEnvironment merges two environments, with values in environment taking
+// precedence over those in parent.  Instances with the same name are merged
+// and instances only in the parent are added.
+func mergeEnvironment(environment *Environment, parent *Environment) *Environment {
+
+	result := &Environment{
+		Name:            environment.Name,
+		Extends:         environment.Extends,
+		Spec:            mergeSpec(environment.Spec, parent.Spec),
+		RemoveAllPrompt: environment.RemoveAllPrompt || parent.RemoveAllPrompt,
+		Hooks:           mergeHooks(environment.Hooks, parent.Hooks, Hooks{}),
+		Rollout:         environment.Rollout,
+		Notifications:   environment.Notifications,
+		Protection:      environment.Protection,
+		Container:       environment.Container,
+	}
+	if result.Rollout.isEmpty() {
+		result.Rollout = parent.Rollout
+	}
+	if result.Notifications.isEmpty() {
+		result.Notifications = parent.Notifications
+	}
+	if result.Protection == nil {
+		result.Protection = parent.Protection
+	}
+	if parent.Container != nil {
+		container := mergeContainer(environment.Container, *parent.Container)
+		result.Container = &container
+	}
+	if result.Extends == "" {
+		result.Extends = parent.Extends
+	}
+
+	for _, instance := range environment.Instances {
+		parentInstance := findInstance(parent.Instances, instance.Name)
+		if parentInstance == nil {
+			result.Instances = append(result.Instances, instance)
+			continue
+		}
+		merged := &Instance{Name: instance.Name, Labels: mergeLabels(instance.Labels, parentInstance.Labels), Spec: mergeSpec(instance.Spec, parentInstance.Spec), DependsOn: instance.DependsOn}
+		if len(merged.DependsOn) == 0 {
+			merged.DependsOn = parentInstance.DependsOn
+		}
+		result.Instances = append(result.Instances, merged)
+	}
+
+	// Instances are copied as their specs are modified when the config is processed
+	for _, instance := range parent.Instances {
+		if findInstance(environment.Instances, instance.Name) == nil {
+			result.Instances = append(result.Instances, &Instance{Name: instance.Name, Labels: mergeLabels(nil, instance.Labels), Spec: mergeSpec(nil, instance.Spec), DependsOn: instance.DependsOn})
+		}
+	}
+
+	return result
+}
+
+// mergeSpec merges two specs into a new spec, with values in spec taking
+// precedence over those in parent
+func mergeSpec(spec *Spec, parent *Spec) *Spec {
+
+	if spec == nil && parent == nil {
+		return nil
+	}
+	if spec == nil {
+		spec = &Spec{}
+	}
+	if parent == nil {
+		parent = &Spec{}
+	}
+
+	result := &Spec{
+		Kubernetes:            parent.Kubernetes,
+		AddConfirmationPrompt: parent.AddConfirmationPrompt,
+		EnvironmentVars:       mergeEnvVars(append([]*EnvironmentVar{}, spec.EnvironmentVars...), parent.EnvironmentVars, nil),
+		Secrets:               mergeSecrets(spec.Secrets, append([]*v2e.SecretItem{}, parent.Secrets...), nil),
+		SecretFiles:           mergeSecretFiles(spec.SecretFiles, parent.SecretFiles, nil),
+		Tools:                 mergeTools(spec.Tools, parent.Tools, nil),
+		Hooks:                 mergeHooks(spec.Hooks, parent.Hooks, Hooks{}),
+		origins:               newSpecOrigins(),
+	}
+	if spec.AddConfirmationPrompt != nil {
+		result.AddConfirmationPrompt = spec.AddConfirmationPrompt
+	}
+	overrideString(&result.Kubernetes.Cluster, spec.Kubernetes.Cluster)
+	overrideString(&result.Kubernetes.ServiceAccount, spec.Kubernetes.ServiceAccount)
+	if spec.Kubernetes.Credentials != nil {
+		result.Kubernetes.Credentials = spec.Kubernetes.Credentials
+	}
+	overrideString(&result.Timeout, parent.Timeout)
+	overrideString(&result.Timeout, spec.Timeout)
+	result.AWS = parent.AWS
+	if spec.AWS != nil {
+		result.AWS = spec.AWS
+	}
+	result.Verify = parent.Verify
+	if spec.Verify != nil {
+		result.Verify = spec.Verify
+	}
+
+	result.origins.merge(parent.origins)
+	result.origins.merge(spec.origins)
+
+	return result
+}
+
+// mergeLabels merges two sets of instance labels into a new set, with labels
+// in labels taking precedence over those in parent
+func mergeLabels(labels map[string]string, parent map[string]string) map[string]string {
+
+	if labels == nil && parent == nil {
+		return nil
+	}
+
+	result := make(map[string]string)
+	for key, value := range parent {
+		result[key] = value
+	}
+	for key, value := range labels {
+		result[key] = value
+	}
+
+	return result
+}
+
+// overrideString sets target to value if value is not empty
+func overrideString(target *string, value string) {
+	if value != "" {
+		*target = value
+	}
+}
+
+// findEnvironment returns the environment with the given name or nil if not found
+func findEnvironment(environments []*Environment, name string) *Environment {
+	for _, e := range environments {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// findInstance returns the instance with the given name or nil if not found
+func findInstance(instances []*Instance, name string) *Instance {
+	for _, i := range instances {
+		if i.Name == name {
+			return i
+		}
+	}
+	return nil
+}
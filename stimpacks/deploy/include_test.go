@@ -0,0 +1,61 @@
+package deploy
+
+import (
+	"testing"
+
+	"github.com/PremiereGlobal/stim/stim"
+	"gotest.tools/assert"
+)
+
+func TestMergeEnvironment(t *testing.T) {
+	confirm, noConfirm := true, false
+	parent := &Environment{
+		Name: "dev",
+		Spec: &Spec{
+			Kubernetes:            Kubernetes{Cluster: "dev", ServiceAccount: "deploy"},
+			EnvironmentVars:       []*EnvironmentVar{{Name: "LOG_LEVEL", Value: "debug"}, {Name: "REPLICAS", Value: "1"}},
+			Tools:                 map[string]stim.EnvTool{"helm": {Version: "2.16.1"}},
+			AddConfirmationPrompt: &confirm,
+		},
+		Instances: []*Instance{{Name: "us-west-2"}, {Name: "us-east-1", Spec: &Spec{Kubernetes: Kubernetes{Cluster: "dev-east"}}}},
+	}
+	parent.Spec.origins = newSpecOrigins()
+	parent.Spec.origins.setSource(parent.Spec, "shared.yaml")
+
+	child := &Environment{
+		Name:    "stage",
+		Extends: "dev",
+		Spec: &Spec{
+			Kubernetes:            Kubernetes{Cluster: "stage"},
+			EnvironmentVars:       []*EnvironmentVar{{Name: "REPLICAS", Value: "3"}},
+			AddConfirmationPrompt: &noConfirm,
+		},
+		Instances: []*Instance{{Name: "us-east-1", Spec: &Spec{Kubernetes: Kubernetes{ServiceAccount: "stage-deploy"}}}},
+	}
+	child.Spec.origins = newSpecOrigins()
+	child.Spec.origins.setSource(child.Spec, "stim.deploy.yaml")
+
+	merged := mergeEnvironment(child, parent)
+
+	assert.Equal(t, "stage", merged.Spec.Kubernetes.Cluster, "Values not Equal")
+	assert.Equal(t, "deploy", merged.Spec.Kubernetes.ServiceAccount, "Values not Equal")
+	assert.Equal(t, "2.16.1", merged.Spec.Tools["helm"].Version, "Values not Equal")
+	assert.Equal(t, 2, len(merged.Spec.EnvironmentVars), "Values not Equal")
+	assert.Equal(t, "3", merged.Spec.EnvironmentVars[0].Value, "Child values should take precedence")
+	assert.Equal(t, "stim.deploy.yaml", merged.Spec.origins.envVarOrigin("REPLICAS").source, "Values not Equal")
+	assert.Equal(t, "shared.yaml", merged.Spec.origins.envVarOrigin("LOG_LEVEL").source, "Values not Equal")
+	assert.Assert(t, !merged.Spec.confirmationPrompt(), "Child should turn off the confirmation prompt")
+
+	// Instance origins combine the level with the file each item was set in
+	origins := newSpecOrigins()
+	origins.add(merged.Spec, originEnvironment)
+	assert.Equal(t, itemOrigin{level: originEnvironment, source: "shared.yaml"}, origins.envVarOrigin("LOG_LEVEL"))
+	assert.Equal(t, itemOrigin{level: originEnvironment, source: "stim.deploy.yaml"}, origins.cluster)
+	assert.Equal(t, itemOrigin{level: originStim, source: originStim}, origins.envVarOrigin("VAULT_TOKEN"))
+
+	assert.Equal(t, 2, len(merged.Instances), "Values not Equal")
+	assert.Equal(t, "dev-east", merged.Instances[0].Spec.Kubernetes.Cluster, "Values not Equal")
+	assert.Equal(t, "stage-deploy", merged.Instances[0].Spec.Kubernetes.ServiceAccount, "Values not Equal")
+	assert.Equal(t, "us-west-2", merged.Instances[1].Name, "Values not Equal")
+	assert.Assert(t, merged.Instances[1] != parent.Instances[0], "Parent instances should be copied")
+}
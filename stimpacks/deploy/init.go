@@ -0,0 +1,414 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// initConfig is the deployment generated by 'stim deploy init'
+type initConfig struct {
+
+	// ServiceAccount is set when every instance uses the same service account,
+	// which is then only set in the global spec
+	ServiceAccount string
+
+	Script       string
+	Tools        []*initTool
+	Environments []*initEnvironment
+}
+
+// initTool is a tool installed for the generated deployment.  An empty
+// version is detected when deploying.
+type initTool struct {
+	Name    string
+	Version string
+}
+
+// initEnvironment is an environment of the generated deployment
+type initEnvironment struct {
+	Name      string
+	Namespace string
+	Instances []*initInstance
+}
+
+// initInstance is an instance of the generated deployment
+type initInstance struct {
+	Name           string
+	Cluster        string
+	ServiceAccount string
+}
+
+// DeployInit is the entrypoint to the "deploy init" command
+// It writes a starter deployment file and deployment script, either from
+// answers to prompts (listing the clusters and service accounts in Vault) or
+// from the command line arguments
+func (d *Deploy) DeployInit() {
+
+	d.log = d.stim.GetLogger()
+
+	configFile := pick(d.stim.ConfigGetString("deploy.file"), defaultConfigFile)
+	scriptFile := filepath.Join(filepath.Dir(configFile), defaultDeployScript)
+	if !d.stim.ConfigGetBool("deploy.init.force") {
+		for _, file := range []string{configFile, scriptFile} {
+			if _, err := os.Stat(file); err == nil {
+				d.log.Fatal("'{}' already exists.  Use --force to overwrite it.", file)
+			}
+		}
+	}
+
+	// The default namespace is named after the deployment directory
+	defaultNamespace := "default"
+	if dir, err := filepath.Abs(filepath.Dir(configFile)); err == nil {
+		defaultNamespace = filepath.Base(dir)
+	}
+
+	var config *initConfig
+	var err error
+	instances := d.stim.ConfigGetStringSlice("deploy.init.instances")
+	if len(instances) > 0 {
+		config, err = parseInitConfig(instances, d.stim.ConfigGetStringSlice("deploy.init.namespaces"), d.stim.ConfigGetStringSlice("deploy.init.tools"), d.stim.ConfigGetString("deploy.init.service-account"), defaultNamespace)
+	} else if d.stim.ConfigGetBool("noprompt") || d.stim.IsAutomated() {
+		d.log.Fatal("--instances is required when not prompting")
+	} else {
+		config, err = d.promptInitConfig(defaultNamespace)
+	}
+	if err != nil {
+		d.log.Fatal("{}", err)
+	}
+	config.finalize()
+
+	content, err := config.render(initConfigTemplate)
+	if err != nil {
+		d.log.Fatal("Error generating the deployment file. {}", err)
+	}
+	if err := ioutil.WriteFile(configFile, content, 0644); err != nil {
+		d.log.Fatal("Error writing '{}'. {}", configFile, err)
+	}
+	d.log.Info("Wrote deployment file '{}'", configFile)
+
+	content, err = config.render(initScriptTemplate)
+	if err != nil {
+		d.log.Fatal("Error generating the deployment script. {}", err)
+	}
+	if err := ioutil.WriteFile(scriptFile, content, 0755); err != nil {
+		d.log.Fatal("Error writing '{}'. {}", scriptFile, err)
+	}
+	d.log.Info("Wrote deployment script '{}'", scriptFile)
+}
+
+// parseInitConfig creates the deployment from the 'deploy init' command line
+// arguments.  Instances are given as '<environment>/<instance>=<cluster>',
+// optionally followed by '/<service account>', namespaces as
+// '<environment>=<namespace>' and tools as '<tool>[=<version>]'.
+func parseInitConfig(instances []string, namespaces []string, tools []string, serviceAccount string, defaultNamespace string) (*initConfig, error) {
+
+	config := &initConfig{}
+	environments := make(map[string]*initEnvironment)
+
+	for _, value := range instances {
+		parts := strings.SplitN(value, "=", 2)
+		names := strings.Split(parts[0], "/")
+		if len(parts) != 2 || len(names) != 2 || names[0] == "" || names[1] == "" || parts[1] == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid instance '%s'. Must be '<environment>/<instance>=<cluster>[/<service account>]'", value))
+		}
+		cluster := strings.SplitN(parts[1], "/", 2)
+		instance := &initInstance{Name: names[1], Cluster: cluster[0], ServiceAccount: serviceAccount}
+		if len(cluster) == 2 {
+			instance.ServiceAccount = cluster[1]
+		}
+		if instance.ServiceAccount == "" {
+			return nil, errors.New(fmt.Sprintf("No service account for instance '%s'.  Set --service-account or add it to the cluster (ex. '%s/deploy')", value, value))
+		}
+
+		environment, ok := environments[names[0]]
+		if !ok {
+			environment = &initEnvironment{Name: names[0], Namespace: defaultNamespace}
+			environments[names[0]] = environment
+			config.Environments = append(config.Environments, environment)
+		}
+		environment.Instances = append(environment.Instances, instance)
+	}
+
+	for _, value := range namespaces {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid namespace '%s'. Must be '<environment>=<namespace>'", value))
+		}
+		environment, ok := environments[parts[0]]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Namespace '%s' is for environment '%s', which has no instances", value, parts[0]))
+		}
+		environment.Namespace = parts[1]
+	}
+
+	var err error
+	config.Tools, err = parseInitTools(tools)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, config.validate()
+}
+
+// parseInitTools parses tools given as '<tool>[=<version>]'
+func parseInitTools(tools []string) ([]*initTool, error) {
+	result := []*initTool{}
+	for _, value := range tools {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		parts := strings.SplitN(value, "=", 2)
+		tool := &initTool{Name: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			tool.Version = strings.TrimSpace(parts[1])
+		}
+		if tool.Name == "helm" && tool.Version == "" {
+			return nil, errors.New("A version is required for helm (ex. 'helm=3.2.1')")
+		}
+		result = append(result, tool)
+	}
+	return result, nil
+}
+
+// promptInitConfig creates the deployment from answers to prompts.  The
+// clusters and service accounts to choose from are listed from the Kubernetes
+// credentials in Vault.
+func (d *Deploy) promptInitConfig(defaultNamespace string) (*initConfig, error) {
+
+	clusters, err := d.stim.KubeClusters(d.stim.ConfigGetString("kube.config.cluster-filter"))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to list the clusters in Vault. %v", err))
+	}
+	if len(clusters) == 0 {
+		return nil, errors.New("No clusters found in Vault")
+	}
+	filterByToken := d.stim.ConfigGetBool("deploy.init.filter-by-token") || d.stim.ConfigGetBool("kube.config.filter-by-token")
+	serviceAccounts := make(map[string][]string)
+
+	config := &initConfig{}
+	names, err := d.stim.PromptString("Environments (comma separated)", "dev,prod")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range splitList(names) {
+		environment := &initEnvironment{Name: name}
+		config.Environments = append(config.Environments, environment)
+
+		if environment.Namespace, err = d.stim.PromptString(fmt.Sprintf("Namespace for '%s'", name), defaultNamespace); err != nil {
+			return nil, err
+		}
+		instanceNames, err := d.stim.PromptString(fmt.Sprintf("Instances in '%s' (comma separated)", name), "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, instanceName := range splitList(instanceNames) {
+			instance := &initInstance{Name: instanceName}
+			for instance.ServiceAccount == "" {
+				if instance.Cluster, err = d.stim.PromptSearchList(fmt.Sprintf("Cluster for '%s/%s'", name, instanceName), clusters); err != nil {
+					return nil, err
+				}
+				accounts, ok := serviceAccounts[instance.Cluster]
+				if !ok {
+					if accounts, err = d.stim.KubeServiceAccounts(instance.Cluster, d.stim.ConfigGetString("kube.config.service-account-filter"), filterByToken); err != nil {
+						return nil, errors.New(fmt.Sprintf("Unable to list the service accounts of cluster '%s' in Vault. %v", instance.Cluster, err))
+					}
+					serviceAccounts[instance.Cluster] = accounts
+				}
+				if len(accounts) == 0 {
+					d.log.Warn("No service accounts available in cluster '{}'", instance.Cluster)
+					continue
+				}
+				if instance.ServiceAccount, err = d.stim.PromptList(fmt.Sprintf("Service account for '%s/%s'", name, instanceName), accounts, ""); err != nil {
+					return nil, err
+				}
+			}
+			environment.Instances = append(environment.Instances, instance)
+		}
+	}
+
+	tools, err := d.stim.PromptString("Tools (comma separated '<tool>[=<version>]', kubectl is matched to the cluster without a version)", "kubectl")
+	if err != nil {
+		return nil, err
+	}
+	if config.Tools, err = parseInitTools(splitList(tools)); err != nil {
+		return nil, err
+	}
+
+	return config, config.validate()
+}
+
+// validate ensures the names in the deployment are valid and unique
+func (c *initConfig) validate() error {
+
+	if len(c.Environments) == 0 {
+		return errors.New("At least one environment is required")
+	}
+
+	environments := []string{}
+	for _, environment := range c.Environments {
+		if utils.Contains(environments, environment.Name) {
+			return errors.New(fmt.Sprintf("Environment '%s' is given more than once", environment.Name))
+		}
+		environments = append(environments, environment.Name)
+
+		if len(environment.Instances) == 0 {
+			return errors.New(fmt.Sprintf("At least one instance is required in environment '%s'", environment.Name))
+		}
+		instances := []string{}
+		for _, instance := range environment.Instances {
+			if strings.ToLower(instance.Name) == allOptionCli || instance.Name == multipleOptionPrompt {
+				return errors.New(fmt.Sprintf("Instances can not be named '%s'. It is a reserved name.", instance.Name))
+			}
+			if utils.Contains(instances, instance.Name) {
+				return errors.New(fmt.Sprintf("Instance '%s' is given more than once in environment '%s'", instance.Name, environment.Name))
+			}
+			instances = append(instances, instance.Name)
+		}
+	}
+
+	return nil
+}
+
+// finalize sets the deployment script and moves the service account to the
+// global spec if every instance uses the same one
+func (c *initConfig) finalize() {
+
+	c.Script = defaultDeployScript
+
+	accounts := []string{}
+	for _, environment := range c.Environments {
+		for _, instance := range environment.Instances {
+			if !utils.Contains(accounts, instance.ServiceAccount) {
+				accounts = append(accounts, instance.ServiceAccount)
+			}
+		}
+	}
+	if len(accounts) != 1 {
+		return
+	}
+
+	c.ServiceAccount = accounts[0]
+	for _, environment := range c.Environments {
+		for _, instance := range environment.Instances {
+			instance.ServiceAccount = ""
+		}
+	}
+}
+
+// HasTool returns true if the deployment installs the tool
+func (c *initConfig) HasTool(name string) bool {
+	for _, tool := range c.Tools {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// render executes the template with the deployment
+func (c *initConfig) render(text string) ([]byte, error) {
+
+	t, err := template.New("init").Funcs(template.FuncMap{"quote": yamlScalar}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, c); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// yamlScalar returns the value as a YAML scalar, quoting it if needed
+func yamlScalar(value string) (string, error) {
+	out, err := yaml.Marshal(value)
+	return strings.TrimSuffix(string(out), "\n"), err
+}
+
+// splitList splits a comma separated list, ignoring empty items
+func splitList(value string) []string {
+	result := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// initConfigTemplate is the template of the generated deployment file
+const initConfigTemplate = `# Deployment file for 'stim deploy', generated by 'stim deploy init'.
+# See https://github.com/PremiereGlobal/stim/blob/master/docs/DEPLOY.md for
+# all of the options.
+
+deployment:
+  # Script run for each instance, from the deployment directory
+  script: {{ quote .Script }}
+  directory: ./
+
+global:
+  spec:
+{{- if .ServiceAccount }}
+    kubernetes:
+      # Service account of the Kubernetes credentials in Vault
+      serviceAccount: {{ quote .ServiceAccount }}
+{{- end }}
+{{- if .Tools }}
+    # Tools installed for the deployment.  kubectl without a version is
+    # matched to the version of the cluster.
+    tools:
+{{- range .Tools }}
+      {{ quote .Name }}:{{ if .Version }}
+        version: {{ quote .Version }}{{ else }} {}{{ end }}
+{{- end }}
+{{- end }}
+    # Stop deployments which take longer than this
+    timeout: 30m
+
+environments:
+{{- range .Environments }}
+- name: {{ quote .Name }}
+  spec:
+    env:
+    # Namespace the deployment script deploys to
+    - name: NAMESPACE
+      value: {{ quote .Namespace }}
+  instances:
+{{- range .Instances }}
+  - name: {{ quote .Name }}
+    spec:
+      kubernetes:
+        cluster: {{ quote .Cluster }}
+{{- if .ServiceAccount }}
+        serviceAccount: {{ quote .ServiceAccount }}
+{{- end }}
+{{- end }}
+{{- end }}
+`
+
+// initScriptTemplate is the template of the generated deployment script
+const initScriptTemplate = `#!/usr/bin/env bash
+# Deployment script run by 'stim deploy' for each instance.  The kubeconfig,
+# tools, environment variables and secrets of the instance are already set.
+set -euo pipefail
+
+echo "Deploying to '${DEPLOY_INSTANCE}' in environment '${DEPLOY_ENVIRONMENT}' (cluster ${DEPLOY_CLUSTER}, namespace ${NAMESPACE})"
+{{ if .HasTool "helm" }}
+# helm upgrade --install my-app ./chart --namespace "${NAMESPACE}" --wait
+{{- end }}
+{{- if .HasTool "kubectl" }}
+kubectl get pods --namespace "${NAMESPACE}"
+{{- end }}
+`
@@ -0,0 +1,77 @@
+package deploy
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+	"gotest.tools/assert"
+)
+
+func TestParseInitConfig(t *testing.T) {
+	config, err := parseInitConfig(
+		[]string{"dev/us-west-2=dev-cluster", "prod/us-west-2=prod-west", "prod/us-east-1=prod-east/admin"},
+		[]string{"prod=my-app-prod"},
+		[]string{"kubectl", "helm=3.2.1"},
+		"deploy",
+		"my-app",
+	)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []*initTool{{Name: "kubectl"}, {Name: "helm", Version: "3.2.1"}}, config.Tools)
+	assert.Equal(t, 2, len(config.Environments))
+	assert.Equal(t, "my-app", config.Environments[0].Namespace)
+	assert.Equal(t, "my-app-prod", config.Environments[1].Namespace)
+	assert.DeepEqual(t, &initInstance{Name: "us-east-1", Cluster: "prod-east", ServiceAccount: "admin"}, config.Environments[1].Instances[1])
+
+	tests := []struct {
+		instances  []string
+		namespaces []string
+		tools      []string
+		err        string
+	}{
+		{[]string{"us-west-2=dev-cluster"}, nil, nil, "Invalid instance"},
+		{[]string{"dev/us-west-2"}, nil, nil, "Invalid instance"},
+		{[]string{"dev/all=dev-cluster"}, nil, nil, "reserved name"},
+		{[]string{"dev/a=c1", "dev/a=c2"}, nil, nil, "more than once"},
+		{[]string{"dev/a=c1"}, []string{"prod=x"}, nil, "has no instances"},
+		{[]string{"dev/a=c1"}, nil, []string{"helm"}, "version is required for helm"},
+	}
+	for _, test := range tests {
+		_, err := parseInitConfig(test.instances, test.namespaces, test.tools, "deploy", "my-app")
+		assert.ErrorContains(t, err, test.err)
+	}
+
+	_, err = parseInitConfig([]string{"dev/a=c1"}, nil, nil, "", "my-app")
+	assert.ErrorContains(t, err, "No service account")
+}
+
+func TestRenderInitConfig(t *testing.T) {
+	config, err := parseInitConfig([]string{"dev/us-west-2=dev-cluster", "prod/us-west-2=prod-west/admin"}, nil, []string{"kubectl", "helm=3.10"}, "deploy", "my-app")
+	assert.NilError(t, err)
+	config.finalize()
+
+	content, err := config.render(initConfigTemplate)
+	assert.NilError(t, err)
+	generated := &Config{}
+	assert.NilError(t, yaml.UnmarshalStrict(content, generated), string(content))
+
+	assert.Equal(t, defaultDeployScript, generated.Deployment.Script)
+	assert.Equal(t, "", generated.Global.Spec.Kubernetes.ServiceAccount)
+	assert.Equal(t, "3.10", generated.Global.Spec.Tools["helm"].Version)
+	assert.Equal(t, "", generated.Global.Spec.Tools["kubectl"].Version)
+	prod := generated.Environments[1]
+	assert.Equal(t, "NAMESPACE", prod.Spec.EnvironmentVars[0].Name)
+	assert.Equal(t, "my-app", prod.Spec.EnvironmentVars[0].Value)
+	assert.Equal(t, "prod-west", prod.Instances[0].Spec.Kubernetes.Cluster)
+	assert.Equal(t, "admin", prod.Instances[0].Spec.Kubernetes.ServiceAccount)
+
+	// A service account used by every instance is only set globally
+	config, err = parseInitConfig([]string{"dev/us-west-2=dev-cluster"}, nil, nil, "deploy", "my-app")
+	assert.NilError(t, err)
+	config.finalize()
+	content, err = config.render(initConfigTemplate)
+	assert.NilError(t, err)
+	generated = &Config{}
+	assert.NilError(t, yaml.UnmarshalStrict(content, generated), string(content))
+	assert.Equal(t, "deploy", generated.Global.Spec.Kubernetes.ServiceAccount)
+	assert.Equal(t, "", generated.Environments[0].Instances[0].Spec.Kubernetes.ServiceAccount)
+}
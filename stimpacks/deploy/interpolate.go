@@ -0,0 +1,348 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+)
+
+// variableReference matches '${NAME}' references in config values.  A
+// reference prefixed with an extra '$' (ex. '$${NAME}') is left as-is
+// (without the extra '$') so that literal references can be passed through.
+var variableReference = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// variableName matches valid variable names
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// variableResolver expands variable references using the variables declared
+// for an instance, falling back to the OS environment
+type variableResolver struct {
+	declared  map[string]string
+	resolved  map[string]string
+	secrets   map[string]bool
+	lookupEnv func(string) (string, bool)
+
+	// values are the values read with valueFrom, which are used as they are.
+	// deferred are the valueFrom variables which have not been read yet.
+	values   map[string]string
+	deferred map[string]bool
+}
+
+// newVariableResolver creates a resolver for the given declared variables
+// Declared values may themselves contain references to other variables
+func newVariableResolver(declared map[string]string) *variableResolver {
+	return &variableResolver{
+		declared:  declared,
+		resolved:  make(map[string]string),
+		secrets:   make(map[string]bool),
+		lookupEnv: os.LookupEnv,
+		values:    make(map[string]string),
+		deferred:  make(map[string]bool),
+	}
+}
+
+// setValue sets the value of a variable read with valueFrom
+func (r *variableResolver) setValue(name string, value string) {
+	r.values[name] = value
+	delete(r.deferred, name)
+
+	// Values expanded before may have used the deferred variable
+	r.resolved = make(map[string]string)
+}
+
+// deferredReference returns true if the value references a valueFrom
+// variable which has not been read yet, directly or through other variables
+func (r *variableResolver) deferredReference(value string) bool {
+	for _, name := range r.references(value) {
+		if r.deferred[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// references returns the names of the declared variables referenced by the
+// value, including those referenced through other variables, in sorted order
+func (r *variableResolver) references(value string) []string {
+
+	seen := make(map[string]bool)
+	var walk func(string)
+	walk = func(value string) {
+		for _, match := range variableReference.FindAllStringSubmatch(value, -1) {
+			name := match[1]
+			if strings.HasPrefix(match[0], "$$") || seen[name] {
+				continue
+			}
+			if declared, ok := r.declared[name]; ok {
+				seen[name] = true
+				walk(declared)
+			} else if _, ok := r.values[name]; ok || r.deferred[name] {
+				seen[name] = true
+			}
+		}
+	}
+	walk(value)
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// secretReference returns the name of a secret variable referenced by the
+// value, directly or through other variables, or an empty string if there
+// isn't one
+func (r *variableResolver) secretReference(value string) string {
+	for _, name := range r.references(value) {
+		if r.secrets[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// expandPublic replaces all variable references in a value which is not kept
+// secret, so it must not reference secret variables
+func (r *variableResolver) expandPublic(value string) (string, error) {
+	if name := r.secretReference(value); name != "" {
+		return value, errors.New(fmt.Sprintf("Variable '${%s}' is read from Vault and can only be referenced in environment variables", name))
+	}
+	return r.expand(value)
+}
+
+// expand replaces all variable references in the given value
+func (r *variableResolver) expand(value string) (string, error) {
+	return r.expandWithStack(value, nil)
+}
+
+// expandWithStack replaces all variable references in the given value.  The
+// stack contains the names of the variables currently being resolved and is
+// used to detect reference cycles.
+func (r *variableResolver) expandWithStack(value string, stack []string) (string, error) {
+
+	var err error
+	result := variableReference.ReplaceAllStringFunc(value, func(match string) string {
+		if err != nil {
+			return match
+		}
+
+		// Escaped reference
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+
+		name := match[2 : len(match)-1]
+		if !variableName.MatchString(name) {
+			err = errors.New(fmt.Sprintf("Invalid variable reference '%s'", match))
+			return match
+		}
+
+		var resolved string
+		resolved, err = r.resolve(name, stack)
+		return resolved
+	})
+
+	return result, err
+}
+
+// resolve returns the fully expanded value of the given variable
+func (r *variableResolver) resolve(name string, stack []string) (string, error) {
+
+	if value, ok := r.resolved[name]; ok {
+		return value, nil
+	}
+
+	// Deferred variables are expanded to an empty value until they are read
+	if value, ok := r.values[name]; ok {
+		return value, nil
+	}
+	if r.deferred[name] {
+		return "", nil
+	}
+
+	for i, s := range stack {
+		if s == name {
+			cycle := append(append([]string{}, stack[i:]...), name)
+			return "", errors.New(fmt.Sprintf("Variable reference cycle detected: %s", strings.Join(cycle, " -> ")))
+		}
+	}
+
+	if raw, ok := r.declared[name]; ok {
+		value, err := r.expandWithStack(raw, append(stack, name))
+		if err != nil {
+			return "", err
+		}
+		r.resolved[name] = value
+		return value, nil
+	}
+
+	// OS environment variables are used as-is and are not expanded further
+	if value, ok := r.lookupEnv(name); ok {
+		return value, nil
+	}
+
+	return "", errors.New(fmt.Sprintf("Undefined variable '${%s}' referenced", name))
+}
+
+// interpolateInstance expands variable references in the merged spec of the
+// given instance.  This must be done after the global/environment/instance
+// specs are merged so that references resolve to the instance's values.
+func (d *Deploy) interpolateInstance(environment *Environment, instance *Instance, environmentIndex int, instanceIndex int) {
+
+	declared := map[string]string{
+		"DEPLOY_ENVIRONMENT": environment.Name,
+		"DEPLOY_INSTANCE":    instance.Name,
+		"DEPLOY_CLUSTER":     instance.Spec.Kubernetes.Cluster,
+	}
+	resolver := newVariableResolver(declared)
+	for _, e := range instance.Spec.EnvironmentVars {
+		if e.ValueFrom == nil {
+			declared[e.Name] = e.Value
+		} else if e.resolved {
+			resolver.values[e.Name] = e.Value
+		} else {
+			resolver.deferred[e.Name] = true
+		}
+		if e.ValueFrom.isSecret() {
+			resolver.secrets[e.Name] = true
+		}
+	}
+	instance.resolver = resolver
+	instance.deferred = nil
+
+	// The cluster is needed to build the deployment config so it can't wait
+	// for valueFrom values
+	clusterPath := originPath(instance.origins.cluster.level, environmentIndex, instanceIndex).with("kubernetes", "cluster")
+	cluster, err := resolver.expandPublic(instance.Spec.Kubernetes.Cluster)
+	if err == nil && resolver.deferredReference(instance.Spec.Kubernetes.Cluster) {
+		err = errors.New("Variables read with valueFrom can not be referenced in the Kubernetes cluster")
+	}
+	if err != nil {
+		d.addConfigError(clusterPath, "Error in Kubernetes cluster: %v", err)
+	}
+	instance.Spec.Kubernetes.Cluster = cluster
+
+	// Merged items may be shared with other instances so they are copied
+	// rather than modified in place
+	envVars := make([]*EnvironmentVar, len(instance.Spec.EnvironmentVars))
+	for k, e := range instance.Spec.EnvironmentVars {
+		envVars[k] = &EnvironmentVar{Name: e.Name, Value: e.Value, ValueFrom: e.ValueFrom, resolved: e.resolved, secret: e.secret}
+
+		// Values read with valueFrom are used as they are
+		if e.ValueFrom != nil {
+			continue
+		}
+
+		// Values which include a secret are kept secret too
+		envVars[k].secret = e.secret || resolver.secretReference(e.Value) != ""
+		if _, err := instance.interpolate(&envVars[k].Value, false); err != nil {
+			envPath := originPath(instance.origins.envVar(e.Name), environmentIndex, instanceIndex).with("env")
+			d.addConfigError(envPath, "Error in environment variable '%s': %v", e.Name, err)
+		}
+	}
+	instance.Spec.EnvironmentVars = envVars
+
+	secrets := make([]*v2e.SecretItem, len(instance.Spec.Secrets))
+	for k, s := range instance.Spec.Secrets {
+		secret := *s
+		if _, err := instance.interpolate(&secret.SecretPath, true); err != nil {
+			d.addConfigError(originPath(instance.origins.secret(s), environmentIndex, instanceIndex).with("secrets"), "Error in secret path '%s': %v", s.SecretPath, err)
+		}
+		instance.origins.replaceSecret(s, &secret)
+		secrets[k] = &secret
+	}
+	instance.Spec.Secrets = secrets
+
+	secretFiles := make([]*SecretFile, len(instance.Spec.SecretFiles))
+	for k, s := range instance.Spec.SecretFiles {
+		secretFile := *s
+		if _, err := instance.interpolate(&secretFile.SecretPath, true); err != nil {
+			d.addConfigError(originPath(originStim, environmentIndex, instanceIndex).with("secretFiles"), "Error in secret file path '%s': %v", s.SecretPath, err)
+		}
+		secretFiles[k] = &secretFile
+	}
+	instance.Spec.SecretFiles = secretFiles
+
+	d.interpolateVerify(instance, environmentIndex, instanceIndex)
+
+	// Environments can override the deploy container settings
+	instance.container = mergeContainer(environment.Container, d.config.Deployment.Container)
+	tagPath := configPath{"deployment", "container", "tag"}
+	if environment.Container != nil && environment.Container.Tag != "" {
+		tagPath = configPath{"environments", environmentIndex, "container", "tag"}
+	}
+	if _, err := instance.interpolate(&instance.container.Tag, true); err != nil {
+		d.addConfigError(tagPath, "Error in container tag: %v", err)
+	}
+}
+
+// interpolate expands the variable references in a config value of the
+// instance.  Values which are shown (public) can not reference secrets.  Values
+// referencing valueFrom variables are expanded once the valueFrom values are
+// read when deploying, and true is returned.
+func (instance *Instance) interpolate(value *string, public bool) (bool, error) {
+
+	expand := instance.resolver.expand
+	if public {
+		expand = instance.resolver.expandPublic
+	}
+	expanded, err := expand(*value)
+	if err != nil {
+		return false, err
+	}
+
+	if instance.resolver.deferredReference(*value) {
+		instance.deferred = append(instance.deferred, &deferredValue{target: value, template: *value})
+		return true, nil
+	}
+
+	*value = expanded
+	return false, nil
+}
+
+// resolveDeferred expands the config values of the instance whose valueFrom
+// variables have all been read.  The other values stay deferred.
+func (instance *Instance) resolveDeferred() error {
+	deferred := []*deferredValue{}
+	for _, v := range instance.deferred {
+		if instance.resolver.deferredReference(v.template) {
+			deferred = append(deferred, v)
+			continue
+		}
+		value, err := instance.resolver.expand(v.template)
+		if err != nil {
+			return err
+		}
+		*v.target = value
+	}
+	instance.deferred = deferred
+	return nil
+}
+
+// undefer stops a deferred config value from being expanded, as it has been
+// set another way
+func (instance *Instance) undefer(value *string) {
+	deferred := []*deferredValue{}
+	for _, v := range instance.deferred {
+		if v.target != value {
+			deferred = append(deferred, v)
+		}
+	}
+	instance.deferred = deferred
+}
+
+// containerImage returns the deployment container image for the given
+// instance.  Images pinned by digest are referenced by the digest.
+func (d *Deploy) containerImage(instance *Instance) string {
+	if instance.container.Digest != "" {
+		return fmt.Sprintf("%s@%s", instance.container.Repo, instance.container.Digest)
+	}
+	return fmt.Sprintf("%s:%s", instance.container.Repo, instance.container.Tag)
+}
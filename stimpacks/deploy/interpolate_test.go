@@ -0,0 +1,79 @@
+package deploy
+
+import (
+	"testing"
+
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	"gotest.tools/assert"
+)
+
+func TestVariableResolver(t *testing.T) {
+	r := newVariableResolver(map[string]string{
+		"DEPLOY_ENVIRONMENT": "prod",
+		"DEPLOY_CLUSTER":     "${DEPLOY_ENVIRONMENT}-us-west-2",
+		"RELEASE":            "app-${DEPLOY_CLUSTER}",
+		"LOOP_A":             "${LOOP_B}",
+		"LOOP_B":             "x-${LOOP_A}",
+	})
+	r.lookupEnv = func(name string) (string, bool) {
+		if name == "HOME" {
+			return "/home/${USER}", true
+		}
+		return "", false
+	}
+
+	value, err := r.expand("secret/${RELEASE}/config")
+	assert.NilError(t, err)
+	assert.Equal(t, "secret/app-prod-us-west-2/config", value, "Values not Equal")
+
+	value, err = r.expand("${HOME} $${RELEASE}")
+	assert.NilError(t, err)
+	assert.Equal(t, "/home/${USER} ${RELEASE}", value, "OS values and escaped references should not be expanded")
+
+	_, err = r.expand("${LOOP_A}")
+	assert.Error(t, err, "Variable reference cycle detected: LOOP_A -> LOOP_B -> LOOP_A")
+
+	_, err = r.expand("${MISSING}")
+	assert.Error(t, err, "Undefined variable '${MISSING}' referenced")
+
+	_, err = r.expand("${not valid}")
+	assert.Error(t, err, "Invalid variable reference '${not valid}'")
+}
+
+func TestInterpolateSecretReferences(t *testing.T) {
+	environment := &Environment{Name: "prod"}
+	instance := &Instance{
+		Name: "us-east",
+		Spec: &Spec{
+			Kubernetes: Kubernetes{Cluster: "prod-us-east"},
+			EnvironmentVars: []*EnvironmentVar{
+				{Name: "DB_PASSWORD", Value: "hunter2", ValueFrom: &ValueFrom{Vault: &VaultKeySource{Path: "secret/db", Key: "password"}}, resolved: true},
+				{Name: "DB_URL", Value: "postgres://app:${DB_PASSWORD}@db"},
+				{Name: "DB_ARGS", Value: "--url=${DB_URL}"},
+				{Name: "REPLICAS", Value: "3"},
+			},
+			Secrets: []*v2e.SecretItem{{SecretPath: "secret/app/${DB_URL}"}},
+		},
+		origins: newSpecOrigins(),
+	}
+
+	instance.origins.add(instance.Spec, originInstance)
+
+	d := &Deploy{}
+	d.interpolateInstance(environment, instance, 0, 0)
+
+	secret := map[string]bool{}
+	for _, e := range instance.Spec.EnvironmentVars {
+		secret[e.Name] = e.isSecret()
+	}
+	assert.DeepEqual(t, map[string]bool{"DB_PASSWORD": true, "DB_URL": true, "DB_ARGS": true, "REPLICAS": false}, secret)
+	assert.Equal(t, "--url=postgres://app:hunter2@db", instance.Spec.EnvironmentVars[2].Value, "Values not Equal")
+
+	// Secrets can't be referenced in values which are shown
+	assert.Equal(t, len(d.config.errors), 1)
+	assert.ErrorContains(t, d.config.errors[0], "Variable '${DB_PASSWORD}' is read from Vault and can only be referenced in environment variables")
+
+	// Snapshots and plans leave out values which include secrets
+	snapshot := d.makeSnapshot(instance, DEPLOY_METHOD_SHELL)
+	assert.DeepEqual(t, map[string]string{"REPLICAS": "3"}, snapshot.Env)
+}
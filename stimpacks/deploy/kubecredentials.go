@@ -0,0 +1,318 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/PremiereGlobal/stim/pkg/aws"
+	"github.com/PremiereGlobal/stim/pkg/kubernetes"
+	"github.com/PremiereGlobal/stim/stim"
+)
+
+// Defaults of the Kubernetes credential providers
+const (
+	defaultVaultKubernetesMount = "kubernetes"
+	defaultVaultAWSMount        = "aws"
+	defaultAWSRegion            = "us-east-1"
+	defaultKubeNamespace        = "default"
+)
+
+// containerKubeDir is the tmpfs in the deploy container which the kubeconfig
+// is written to when the credentials are generated by stim
+const containerKubeDir = "/stim/kube"
+
+// KubernetesCredentials selects how the credentials used to deploy to the
+// cluster are obtained.  At most one provider can be set.  If none are, the
+// static token in Vault is used.
+type KubernetesCredentials struct {
+	VaultToken      *VaultTokenCredentials      `yaml:"vaultToken"`
+	Kubeconfig      *KubeconfigCredentials      `yaml:"kubeconfig"`
+	VaultClientCert *VaultClientCertCredentials `yaml:"vaultClientCert"`
+	VaultKubernetes *VaultKubernetesCredentials `yaml:"vaultKubernetes"`
+	EKS             *EKSCredentials             `yaml:"eks"`
+}
+
+// VaultTokenCredentials reads a static service account token from Vault
+type VaultTokenCredentials struct {
+	Path string `yaml:"path"`
+}
+
+// KubeconfigCredentials uses a context of a local kubeconfig file
+type KubeconfigCredentials struct {
+	Path    string `yaml:"path"`
+	Context string `yaml:"context"`
+}
+
+// VaultClientCertCredentials reads client certificate data from Vault
+type VaultClientCertCredentials struct {
+	Path string `yaml:"path"`
+}
+
+// VaultKubernetesCredentials generates a short-lived service account token
+// with the Vault Kubernetes secrets engine
+type VaultKubernetesCredentials struct {
+	Mount       string `yaml:"mount"`
+	Role        string `yaml:"role"`
+	Namespace   string `yaml:"namespace"`
+	TTL         string `yaml:"ttl"`
+	ClusterPath string `yaml:"clusterPath"`
+}
+
+// EKSCredentials generates an EKS token from AWS credentials issued by the
+// Vault AWS secrets engine
+type EKSCredentials struct {
+	Mount       string `yaml:"mount"`
+	Role        string `yaml:"role"`
+	ClusterName string `yaml:"clusterName"`
+	Region      string `yaml:"region"`
+	ClusterPath string `yaml:"clusterPath"`
+}
+
+// providers returns the names of the providers which are set
+func (c *KubernetesCredentials) providers() []string {
+	var providers []string
+	if c.VaultToken != nil {
+		providers = append(providers, "vaultToken")
+	}
+	if c.Kubeconfig != nil {
+		providers = append(providers, "kubeconfig")
+	}
+	if c.VaultClientCert != nil {
+		providers = append(providers, "vaultClientCert")
+	}
+	if c.VaultKubernetes != nil {
+		providers = append(providers, "vaultKubernetes")
+	}
+	if c.EKS != nil {
+		providers = append(providers, "eks")
+	}
+	return providers
+}
+
+// provider returns the name of the credential provider used
+func (k Kubernetes) provider() string {
+	if k.Credentials == nil {
+		return "vaultToken"
+	}
+	if providers := k.Credentials.providers(); len(providers) == 1 {
+		return providers[0]
+	}
+	return "vaultToken"
+}
+
+// usesVaultToken returns true if the static token in Vault is used, which is
+// also set in the deployment environment variables
+func (k Kubernetes) usesVaultToken() bool {
+	return k.provider() == "vaultToken"
+}
+
+// vaultTokenPath returns the configured path of the static token in Vault, or
+// an empty string for the default path
+func (k Kubernetes) vaultTokenPath() string {
+	if k.Credentials != nil && k.Credentials.VaultToken != nil {
+		return k.Credentials.VaultToken.Path
+	}
+	return ""
+}
+
+// needsServiceAccount returns true if the credentials are read from the
+// default Vault path, which includes the service account
+func (k Kubernetes) needsServiceAccount() bool {
+	switch k.provider() {
+	case "vaultToken":
+		return k.vaultTokenPath() == ""
+	case "vaultClientCert":
+		return k.Credentials.VaultClientCert.Path == ""
+	case "eks":
+		return k.Credentials.EKS.ClusterPath == ""
+	}
+	return false
+}
+
+// validateKubernetesCredentials ensures the Kubernetes credentials config is valid
+func (d *Deploy) validateKubernetesCredentials(credentials *KubernetesCredentials, credentialsPath configPath) {
+
+	if credentials == nil {
+		return
+	}
+
+	if providers := credentials.providers(); len(providers) != 1 {
+		d.addConfigError(credentialsPath, "Kubernetes credentials must have exactly one of ['vaultToken','kubeconfig','vaultClientCert','vaultKubernetes','eks']")
+	}
+
+	if c := credentials.VaultKubernetes; c != nil {
+		if c.Role == "" {
+			d.addConfigError(credentialsPath.with("vaultKubernetes", "role"), "Vault Kubernetes role is required")
+		}
+		if c.Namespace == "" {
+			d.addConfigError(credentialsPath.with("vaultKubernetes", "namespace"), "Vault Kubernetes namespace is required")
+		}
+		if c.TTL != "" {
+			if ttl, err := time.ParseDuration(c.TTL); err != nil || ttl <= 0 {
+				d.addConfigError(credentialsPath.with("vaultKubernetes", "ttl"), "Invalid ttl '%s'. Must be a positive duration (ex. 30m)", c.TTL)
+			}
+		}
+	}
+
+	if c := credentials.EKS; c != nil && c.Role == "" {
+		d.addConfigError(credentialsPath.with("eks", "role"), "EKS AWS role is required")
+	}
+}
+
+// envConfigKubernetes returns the Kubernetes environment config of the
+// instance, or nil for environment hooks if the environment has no cluster
+func (d *Deploy) envConfigKubernetes(instance *Instance) *stim.EnvConfigKubernetes {
+	if instance.Spec.Kubernetes.Cluster == "" {
+		return nil
+	}
+	return &stim.EnvConfigKubernetes{
+		Cluster:          instance.Spec.Kubernetes.Cluster,
+		ServiceAccount:   instance.Spec.Kubernetes.ServiceAccount,
+		DefaultNamespace: defaultKubeNamespace,
+		VaultPath:        instance.Spec.Kubernetes.vaultTokenPath(),
+		KubeConfig:       instance.kubeConfig,
+	}
+}
+
+// resolveKubeCredentials obtains the Kubernetes credentials of the instance
+// from its credential provider and builds the kubeconfig used for the
+// deployment.  Nothing is done for the static token in Vault, which is read
+// when the environment is set up, or for environment hooks without a cluster.
+// Vault leases are revoked at the end of the deployment run.
+func (d *Deploy) resolveKubeCredentials(ctx context.Context, instance *Instance) error {
+
+	k := instance.Spec.Kubernetes
+	if k.Cluster == "" {
+		return nil
+	}
+
+	options := &kubernetes.ConfigOptions{
+		ClusterName:             k.Cluster,
+		AuthName:                k.Cluster + "-" + k.ServiceAccount,
+		ContextName:             k.Cluster,
+		ContextSetCurrent:       true,
+		ContextDefaultNamespace: defaultKubeNamespace,
+	}
+
+	switch k.provider() {
+	case "vaultToken":
+		return nil
+
+	case "kubeconfig":
+		c := k.Credentials.Kubeconfig
+		path := c.Path
+		if path != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(d.config.Deployment.fullDirectoryPath, path)
+		}
+		config, err := kubernetes.LoadContext(path, c.Context)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to load kubeconfig context for '%s'. %v", instance.Name, err))
+		}
+		instance.kubeConfig = config
+		return nil
+
+	case "vaultClientCert":
+		path := pick(k.Credentials.VaultClientCert.Path, d.stim.KubeConfigVaultPath(k.Cluster, k.ServiceAccount))
+		secret, err := d.stim.Vault().GetSecretKeys(path)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to read Kubernetes client certificate from Vault. %v", err))
+		}
+		if secret["client-cert"] == "" || secret["client-key"] == "" {
+			return errors.New(fmt.Sprintf("Kubernetes credentials at '%s' must contain 'client-cert' and 'client-key'", path))
+		}
+		options.ClusterServer = secret["cluster-server"]
+		options.ClusterCA = secret["cluster-ca"]
+		options.AuthClientCertificate = secret["client-cert"]
+		options.AuthClientKey = secret["client-key"]
+		options.ContextDefaultNamespace = pick(secret["default-namespace"], defaultKubeNamespace)
+
+	case "vaultKubernetes":
+		c := k.Credentials.VaultKubernetes
+		mount := pick(c.Mount, defaultVaultKubernetesMount)
+		secret, err := d.stim.Vault().KubernetesCredentials(mount, c.Role, c.Namespace, c.TTL)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to generate Kubernetes credentials with Vault. %v", err))
+		}
+		d.trackLease(secret.LeaseID)
+		token, _ := secret.Data["service_account_token"].(string)
+		if token == "" {
+			return errors.New(fmt.Sprintf("No service account token returned by Vault role '%s'", c.Role))
+		}
+		options.AuthToken = token
+
+		// The cluster connection is read from the secrets engine config unless set
+		if c.ClusterPath != "" {
+			if err := d.readClusterConnection(c.ClusterPath, options); err != nil {
+				return err
+			}
+		} else {
+			config, err := d.stim.Vault().GetSecret(mount + "/config")
+			if err != nil || config == nil {
+				return errors.New(fmt.Sprintf("Unable to read the cluster connection from the Vault Kubernetes secrets engine config, set clusterPath instead. %v", err))
+			}
+			options.ClusterServer, _ = config.Data["kubernetes_host"].(string)
+			options.ClusterCA, _ = config.Data["kubernetes_ca_cert"].(string)
+		}
+		options.ContextDefaultNamespace = c.Namespace
+
+	case "eks":
+		c := k.Credentials.EKS
+		if err := d.readClusterConnection(pick(c.ClusterPath, d.stim.KubeConfigVaultPath(k.Cluster, k.ServiceAccount)), options); err != nil {
+			return err
+		}
+		secret, err := d.stim.Vault().AWScredentials(pick(c.Mount, defaultVaultAWSMount), c.Role)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to get AWS credentials from Vault for EKS. %v", err))
+		}
+		d.trackLease(secret.LeaseID)
+		accessKey, _ := secret.Data["access_key"].(string)
+		secretKey, _ := secret.Data["secret_key"].(string)
+		sessionToken, _ := secret.Data["security_token"].(string)
+		a, err := aws.New(&aws.Config{
+			AccessKey:    accessKey,
+			SecretKey:    secretKey,
+			SessionToken: sessionToken,
+			Region:       pick(c.Region, defaultAWSRegion),
+			Log:          d.stim.GetLogger(),
+		})
+		if err != nil {
+			return err
+		}
+
+		// IAM user credentials take a moment to become active
+		if sessionToken == "" {
+			if err := a.WaitForActiveCredsContext(ctx); err != nil {
+				return errors.New(fmt.Sprintf("AWS credentials for EKS did not become active. %v", err))
+			}
+		}
+		token, err := a.EKSToken(pick(c.ClusterName, k.Cluster))
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to generate EKS token. %v", err))
+		}
+		options.AuthToken = token
+	}
+
+	instance.kubeConfig = kubernetes.NewConfigFromOptions(options)
+	return nil
+}
+
+// readClusterConnection sets the cluster server and CA from the
+// 'cluster-server' and 'cluster-ca' keys of a Vault secret
+func (d *Deploy) readClusterConnection(path string, options *kubernetes.ConfigOptions) error {
+
+	secret, err := d.stim.Vault().GetSecretKeys(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to read the Kubernetes cluster connection from Vault. %v", err))
+	}
+	if secret["cluster-server"] == "" {
+		return errors.New(fmt.Sprintf("Kubernetes cluster connection at '%s' must contain 'cluster-server'", path))
+	}
+	options.ClusterServer = secret["cluster-server"]
+	options.ClusterCA = secret["cluster-ca"]
+	options.ContextDefaultNamespace = pick(secret["default-namespace"], options.ContextDefaultNamespace)
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package deploy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestKubernetesProvider(t *testing.T) {
+	assert.Equal(t, "vaultToken", Kubernetes{}.provider(), "Values not Equal")
+	assert.Assert(t, Kubernetes{}.needsServiceAccount())
+	assert.Assert(t, !Kubernetes{Credentials: &KubernetesCredentials{VaultToken: &VaultTokenCredentials{Path: "secret/k8s/prod"}}}.needsServiceAccount())
+
+	k := Kubernetes{Credentials: &KubernetesCredentials{EKS: &EKSCredentials{Role: "deploy"}}}
+	assert.Equal(t, "eks", k.provider(), "Values not Equal")
+	assert.Assert(t, !k.usesVaultToken())
+	assert.Assert(t, k.needsServiceAccount())
+}
+
+func TestResolveKubeconfigCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stim-deploy")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+    certificate-authority: ca.crt
+users:
+- name: dev
+  user:
+    token: dev-token
+- name: prod
+  user:
+    token: prod-token
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+- name: prod
+  context:
+    cluster: prod
+    user: prod
+    namespace: apps
+`
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "kubeconfig"), []byte(kubeconfig), 0600))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "ca.crt"), []byte("CA"), 0600))
+
+	d := &Deploy{}
+	d.config.Deployment.fullDirectoryPath = dir
+	instance := &Instance{Name: "prod", Spec: &Spec{Kubernetes: Kubernetes{
+		Cluster:     "prod",
+		Credentials: &KubernetesCredentials{Kubeconfig: &KubeconfigCredentials{Path: "kubeconfig", Context: "prod"}},
+	}}}
+
+	assert.NilError(t, d.resolveKubeCredentials(context.Background(), instance))
+	config := instance.kubeConfig
+	assert.Equal(t, "prod", config.CurrentContext, "Values not Equal")
+	assert.Equal(t, 1, len(config.Clusters), "Values not Equal")
+	assert.Equal(t, "CA", string(config.Clusters["prod"].CertificateAuthorityData), "Values not Equal")
+	assert.Equal(t, "prod-token", config.AuthInfos["prod"].Token, "Values not Equal")
+	assert.Equal(t, "apps", config.Contexts["prod"].Namespace, "Values not Equal")
+
+	instance.Spec.Kubernetes.Credentials.Kubeconfig.Context = "missing"
+	assert.ErrorContains(t, d.resolveKubeCredentials(context.Background(), instance), "Context 'missing' not found")
+}
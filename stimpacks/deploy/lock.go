@@ -0,0 +1,379 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+	"github.com/PremiereGlobal/stim/pkg/vault"
+)
+
+// defaultLockTTL is how long a deploy lock is held without being refreshed
+// before it is considered stale and can be taken over
+const defaultLockTTL = "1h"
+
+// Lock describes where deploy locks are kept in Vault.  Locking is disabled
+// if no Vault path is set.
+type Lock struct {
+	VaultPath string `yaml:"vaultPath"`
+	TTL       string `yaml:"ttl"`
+}
+
+// lockRecord is the content of a deploy lock
+type lockRecord struct {
+	Holder      string    `json:"holder"`
+	Host        string    `json:"host"`
+	Environment string    `json:"environment"`
+	Instance    string    `json:"instance"`
+	Started     time.Time `json:"started"`
+	Expires     time.Time `json:"expires"`
+}
+
+// deployLock is a deploy lock held by this deployment run
+type deployLock struct {
+	path    string
+	record  *lockRecord
+	lock    sync.Mutex
+	version int
+	done    chan struct{}
+}
+
+// lockTracker keeps the deploy locks held by the deployment run so they can
+// be released once it has finished or is interrupted
+type lockTracker struct {
+	lock  sync.Mutex
+	locks []*deployLock
+}
+
+// lockPath returns the Vault path of the lock for an environment instance
+func lockPath(vaultPath string, environment string, instance string) string {
+	return path.Join(vaultPath, environment, instance)
+}
+
+// isExpired returns true if the lock has not been refreshed within its TTL
+func (r *lockRecord) isExpired(now time.Time) bool {
+	return now.After(r.Expires)
+}
+
+// describe returns a description of who holds the lock
+func (r *lockRecord) describe() string {
+	return fmt.Sprintf("%s on %s since %s", r.Holder, r.Host, r.Started.Local().Format("2006-01-02 15:04:05"))
+}
+
+// data returns the lock as Vault secret data
+func (r *lockRecord) data() map[string]interface{} {
+	return map[string]interface{}{
+		"holder":      r.Holder,
+		"host":        r.Host,
+		"environment": r.Environment,
+		"instance":    r.Instance,
+		"started":     r.Started.Format(time.RFC3339),
+		"expires":     r.Expires.Format(time.RFC3339),
+	}
+}
+
+// releasedLockData returns the secret data written to release a lock.  Key-value
+// secrets can't be deleted with check-and-set, so a released marker is written
+// instead to avoid removing a lock that someone else has since taken over.
+func releasedLockData(now time.Time) map[string]interface{} {
+	return map[string]interface{}{"released": now.Format(time.RFC3339)}
+}
+
+// isReleasedLock returns true if the Vault secret data is a released lock
+func isReleasedLock(data map[string]interface{}) bool {
+	_, ok := data["released"]
+	return ok
+}
+
+// parseLockRecord reads a lock from Vault secret data
+func parseLockRecord(data map[string]interface{}) (*lockRecord, error) {
+	value := func(key string) string {
+		s, _ := data[key].(string)
+		return s
+	}
+	record := &lockRecord{
+		Holder:      value("holder"),
+		Host:        value("host"),
+		Environment: value("environment"),
+		Instance:    value("instance"),
+	}
+	var err error
+	if record.Started, err = time.Parse(time.RFC3339, value("started")); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid lock start time '%s'", value("started")))
+	}
+	if record.Expires, err = time.Parse(time.RFC3339, value("expires")); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid lock expiry time '%s'", value("expires")))
+	}
+	return record, nil
+}
+
+// lockTTL returns the configured lock TTL
+func (d *Deploy) lockTTL() time.Duration {
+	ttl, _ := time.ParseDuration(pick(d.config.Deployment.Lock.TTL, defaultLockTTL))
+	return ttl
+}
+
+// lockHost returns the name of this host for deploy locks
+func lockHost() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// acquireLocks locks each of the given instances, so that no one else can
+// deploy to them until the locks are released.  If any lock can not be
+// acquired, the locks already acquired are released.
+func (d *Deploy) acquireLocks(environment *Environment, instances []*Instance) error {
+
+	vaultPath := d.config.Deployment.Lock.VaultPath
+	if vaultPath == "" {
+		return nil
+	}
+
+	for _, instance := range instances {
+		l, err := d.acquireLock(vaultPath, environment, instance)
+		if err != nil {
+			d.releaseLocks()
+			return err
+		}
+		d.locks.lock.Lock()
+		d.locks.locks = append(d.locks.locks, l)
+		d.locks.lock.Unlock()
+		go d.refreshLock(l)
+	}
+
+	return nil
+}
+
+// acquireLock creates the lock for an instance using check-and-set, so that
+// only one deployment can create it.  Expired locks are taken over.
+func (d *Deploy) acquireLock(vaultPath string, environment *Environment, instance *Instance) (*deployLock, error) {
+
+	lockPath := lockPath(vaultPath, environment.Name, instance.Name)
+	data, version, err := d.stim.Vault().ReadKVVersion(lockPath)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to read deploy lock '%s'. %v", lockPath, err))
+	}
+
+	now := time.Now()
+	if data != nil && !isReleasedLock(data) {
+		current, err := parseLockRecord(data)
+		if err != nil {
+			d.log.Warn("Replacing invalid deploy lock '{}': {}", lockPath, err)
+		} else if !current.isExpired(now) {
+			return nil, errors.New(fmt.Sprintf("Instance '%s' in environment '%s' is locked by %s.  Use 'stim deploy lock release --force' if the lock is no longer in use", instance.Name, environment.Name, current.describe()))
+		} else {
+			d.log.Warn("Taking over expired deploy lock for instance '{}' held by {}", instance.Name, current.describe())
+		}
+	}
+
+	record := &lockRecord{
+		Holder:      d.deployUser(),
+		Host:        lockHost(),
+		Environment: environment.Name,
+		Instance:    instance.Name,
+		Started:     now,
+		Expires:     now.Add(d.lockTTL()),
+	}
+	if err := d.stim.Vault().WriteKVCAS(lockPath, record.data(), version); err != nil {
+		if err == vault.ErrCheckAndSet {
+			return nil, errors.New(fmt.Sprintf("Instance '%s' in environment '%s' was locked by another deployment", instance.Name, environment.Name))
+		}
+		return nil, errors.New(fmt.Sprintf("Unable to write deploy lock '%s'. %v", lockPath, err))
+	}
+
+	d.log.Debug("Acquired deploy lock '{}'", lockPath)
+	return &deployLock{path: lockPath, record: record, version: version + 1, done: make(chan struct{})}, nil
+}
+
+// refreshLock extends the expiry of a held lock periodically, so that
+// deployments running longer than the TTL keep their lock
+func (d *Deploy) refreshLock(l *deployLock) {
+
+	ttl := d.lockTTL()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.lock.Lock()
+			l.record.Expires = time.Now().Add(ttl)
+			err := d.stim.Vault().WriteKVCAS(l.path, l.record.data(), l.version)
+			if err == nil {
+				l.version++
+			}
+			l.lock.Unlock()
+			if err == vault.ErrCheckAndSet {
+				d.log.Warn("Deploy lock '{}' was changed by someone else and is no longer held", l.path)
+				return
+			} else if err != nil {
+				d.log.Warn("Unable to refresh deploy lock '{}': {}", l.path, err)
+			}
+		}
+	}
+}
+
+// releaseLocks releases all deploy locks held by the deployment run
+// Failures are only logged as the locks will expire on their own
+func (d *Deploy) releaseLocks() {
+	d.locks.lock.Lock()
+	defer d.locks.lock.Unlock()
+
+	for _, l := range d.locks.locks {
+		close(l.done)
+		l.lock.Lock()
+		err := d.stim.Vault().WriteKVCAS(l.path, releasedLockData(time.Now()), l.version)
+		l.lock.Unlock()
+		if err == vault.ErrCheckAndSet {
+			d.log.Warn("Deploy lock '{}' was changed by someone else, not releasing it", l.path)
+		} else if err != nil {
+			d.log.Warn("Unable to release deploy lock '{}': {}", l.path, err)
+		} else {
+			d.log.Debug("Released deploy lock '{}'", l.path)
+		}
+	}
+	d.locks.locks = nil
+}
+
+// lockVaultPath returns the Vault path of the deploy locks from the command
+// line or the deployment file
+func (d *Deploy) lockVaultPath() string {
+	vaultPath := d.stim.ConfigGetString("deploy.lock.vault-path")
+	if vaultPath == "" {
+		d.parseConfig()
+		vaultPath = d.config.Deployment.Lock.VaultPath
+	}
+	if vaultPath == "" {
+		d.log.Fatal("No Vault lock path set.  Use --vault-path or set 'deployment.lock.vaultPath' in the deployment file")
+	}
+	return strings.TrimSuffix(vaultPath, "/")
+}
+
+// readLocks reads all deploy locks under the given Vault path
+func (d *Deploy) readLocks(vaultPath string) ([]*lockRecord, error) {
+
+	environments, err := d.stim.Vault().ListKV(vaultPath)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*lockRecord{}
+	for _, environment := range environments {
+		environment = strings.TrimSuffix(environment, "/")
+		instances, err := d.stim.Vault().ListKV(path.Join(vaultPath, environment))
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			data, _, err := d.stim.Vault().ReadKVVersion(lockPath(vaultPath, environment, instance))
+			if err != nil {
+				return nil, err
+			}
+			if data == nil || isReleasedLock(data) {
+				continue
+			}
+			record, err := parseLockRecord(data)
+			if err != nil {
+				d.log.Warn("Skipping invalid deploy lock '{}': {}", lockPath(vaultPath, environment, instance), err)
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+// DeployLockList is the entrypoint to the "deploy lock list" command
+// It prints the deploy locks currently held
+func (d *Deploy) DeployLockList() {
+
+	d.log = d.stim.GetLogger()
+
+	output := d.stim.ConfigGetString("deploy.lock.output")
+	if !utils.Contains([]string{"table", "json"}, output) {
+		d.log.Fatal("Invalid output format '{}'.  Must be one of ['table','json']", output)
+	}
+
+	records, err := d.readLocks(d.lockVaultPath())
+	if err != nil {
+		d.log.Fatal("Error reading deploy locks: {}", err)
+	}
+
+	environment := d.stim.ConfigGetString("deploy.environment")
+	matched := []*lockRecord{}
+	for _, r := range records {
+		if environment == "" || r.Environment == environment {
+			matched = append(matched, r)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Started.Before(matched[j].Started) })
+
+	if output == "json" {
+		d.writeJSON(matched)
+		return
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENVIRONMENT\tINSTANCE\tHOLDER\tHOST\tSTARTED\tEXPIRES\tSTATUS")
+	for _, r := range matched {
+		status := "active"
+		if r.isExpired(now) {
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Environment, r.Instance, r.Holder, r.Host, r.Started.Local().Format("2006-01-02 15:04:05"), r.Expires.Local().Format("2006-01-02 15:04:05"), status)
+	}
+	w.Flush()
+}
+
+// DeployLockRelease is the entrypoint to the "deploy lock release" command
+// It removes the lock of an instance.  Locks held by another user or host,
+// which have not expired, are only removed with --force.
+func (d *Deploy) DeployLockRelease() {
+
+	d.log = d.stim.GetLogger()
+
+	environment := d.stim.ConfigGetString("deploy.environment")
+	instance := d.stim.ConfigGetString("deploy.instance")
+	if environment == "" || instance == "" {
+		d.log.Fatal("Both --environment and --instance are required to release a deploy lock")
+	}
+
+	lockPath := lockPath(d.lockVaultPath(), environment, instance)
+	data, version, err := d.stim.Vault().ReadKVVersion(lockPath)
+	if err != nil {
+		d.log.Fatal("Error reading deploy lock '{}': {}", lockPath, err)
+	}
+	if data == nil || isReleasedLock(data) {
+		d.log.Info("Instance '{}' in environment '{}' is not locked", instance, environment)
+		return
+	}
+
+	record, err := parseLockRecord(data)
+	if err == nil && !record.isExpired(time.Now()) && (record.Holder != d.deployUser() || record.Host != lockHost()) {
+		if !d.stim.ConfigGetBool("deploy.lock.force") {
+			d.log.Fatal("Instance '{}' in environment '{}' is locked by {}.  Use --force to release it", instance, environment, record.describe())
+		}
+		d.log.Warn("Forcibly releasing deploy lock held by {}", record.describe())
+	}
+
+	if err := d.stim.Vault().WriteKVCAS(lockPath, releasedLockData(time.Now()), version); err == vault.ErrCheckAndSet {
+		d.log.Fatal("Deploy lock '{}' was changed while releasing it.  Check the lock and try again", lockPath)
+	} else if err != nil {
+		d.log.Fatal("Error releasing deploy lock '{}': {}", lockPath, err)
+	}
+	d.log.Info("Released deploy lock for instance '{}' in environment '{}'", instance, environment)
+}
@@ -0,0 +1,37 @@
+package deploy
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestParseLockRecord(t *testing.T) {
+	started := time.Date(2020, 5, 10, 12, 0, 0, 0, time.UTC)
+	record := &lockRecord{
+		Holder:      "jdoe",
+		Host:        "laptop",
+		Environment: "prod",
+		Instance:    "us-east",
+		Started:     started,
+		Expires:     started.Add(time.Hour),
+	}
+
+	parsed, err := parseLockRecord(record.data())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, record, parsed)
+	assert.Assert(t, !parsed.isExpired(started.Add(30*time.Minute)))
+	assert.Assert(t, parsed.isExpired(started.Add(2*time.Hour)))
+
+	_, err = parseLockRecord(map[string]interface{}{"holder": "jdoe"})
+	assert.ErrorContains(t, err, "Invalid lock start time")
+}
+
+func TestReleasedLock(t *testing.T) {
+	released := releasedLockData(time.Now())
+	assert.Assert(t, isReleasedLock(released))
+
+	record := &lockRecord{Holder: "jdoe", Started: time.Now(), Expires: time.Now().Add(time.Hour)}
+	assert.Assert(t, !isReleasedLock(record.data()))
+}
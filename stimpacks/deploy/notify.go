@@ -0,0 +1,278 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/PremiereGlobal/stim/pkg/pagerduty"
+	"github.com/PremiereGlobal/stim/pkg/slack"
+	"github.com/PremiereGlobal/stim/pkg/utils"
+)
+
+// Deployment events which notifications can be sent for
+const (
+	notifyStart   = "start"
+	notifySuccess = "success"
+	notifyFailure = "failure"
+)
+
+// Pagerduty notification types
+const (
+	pagerdutyTrigger = "trigger"
+	pagerdutyChange  = "change"
+)
+
+// Default notification messages
+const (
+	defaultStartMessage   = "{{.User}} started deploying to instance '{{.Instance}}' in environment '{{.Environment}}'"
+	defaultSuccessMessage = "{{.User}} successfully deployed to instance '{{.Instance}}' in environment '{{.Environment}}' in {{.Duration}}"
+	defaultFailureMessage = "{{.User}} failed to deploy to instance '{{.Instance}}' in environment '{{.Environment}}' after {{.Duration}}: {{.Error}}"
+)
+
+// Notifications describes where to send notifications about deployments
+type Notifications struct {
+	Slack     []*SlackNotification     `yaml:"slack"`
+	Pagerduty []*PagerdutyNotification `yaml:"pagerduty"`
+}
+
+// SlackNotification describes messages posted to a Slack channel
+type SlackNotification struct {
+	Channel  string               `yaml:"channel"`
+	Events   []string             `yaml:"events"`
+	Username string               `yaml:"username"`
+	IconURL  string               `yaml:"iconUrl"`
+	Messages NotificationMessages `yaml:"messages"`
+}
+
+// PagerdutyNotification describes events sent to a Pagerduty service
+type PagerdutyNotification struct {
+	Service  string               `yaml:"service"`
+	Type     string               `yaml:"type"`
+	Events   []string             `yaml:"events"`
+	Severity string               `yaml:"severity"`
+	Messages NotificationMessages `yaml:"messages"`
+}
+
+// NotificationMessages are the templates of the text sent for each event
+type NotificationMessages struct {
+	Start   string `yaml:"start"`
+	Success string `yaml:"success"`
+	Failure string `yaml:"failure"`
+}
+
+// notificationData is the data available to notification message templates
+type notificationData struct {
+	Environment string
+	Instance    string
+	Cluster     string
+	User        string
+	Event       string
+	Duration    time.Duration
+	ExitCode    int
+	Error       string
+	ApprovedBy  string
+	Override    string
+}
+
+// notifier sends deployment notifications for an environment
+type notifier struct {
+	notifications Notifications
+	slack         *slack.Slack
+	pagerduty     *pagerduty.Pagerduty
+}
+
+// isEmpty returns true if no notifications are configured
+func (n Notifications) isEmpty() bool {
+	return len(n.Slack) == 0 && len(n.Pagerduty) == 0
+}
+
+// notificationEvents returns the configured events, or the given defaults if none are set
+func notificationEvents(events []string, defaults ...string) []string {
+	if len(events) == 0 {
+		return defaults
+	}
+	return events
+}
+
+// message returns the message template for the given event, falling back to
+// the default message
+func (m NotificationMessages) message(event string) string {
+	switch event {
+	case notifyStart:
+		return pick(m.Start, defaultStartMessage)
+	case notifySuccess:
+		return pick(m.Success, defaultSuccessMessage)
+	}
+	return pick(m.Failure, defaultFailureMessage)
+}
+
+// pick returns value if it is set, otherwise the fallback
+func pick(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// renderMessage renders a notification message template with the given data
+func renderMessage(text string, data *notificationData) (string, error) {
+	t, err := template.New("message").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// validateNotifications ensures the notifications config is valid
+func (d *Deploy) validateNotifications(notifications Notifications, notificationsPath configPath) {
+
+	validEvents := []string{notifyStart, notifySuccess, notifyFailure}
+
+	validateMessages := func(messages NotificationMessages, messagesPath configPath) {
+		for event, text := range map[string]string{notifyStart: messages.Start, notifySuccess: messages.Success, notifyFailure: messages.Failure} {
+			if _, err := renderMessage(text, &notificationData{}); err != nil {
+				d.addConfigError(messagesPath.with(event), "Invalid notification message template: %v", err)
+			}
+		}
+	}
+
+	validateEvents := func(events []string, eventsPath configPath) {
+		for k, event := range events {
+			if !utils.Contains(validEvents, event) {
+				d.addConfigError(eventsPath.with(k), "Invalid notification event '%s'. Must be one of ['start','success','failure']", event)
+			}
+		}
+	}
+
+	for i, n := range notifications.Slack {
+		slackPath := notificationsPath.with("slack", i)
+		if n.Channel == "" {
+			d.addConfigError(slackPath, "Slack notification channel is required")
+		}
+		validateEvents(n.Events, slackPath.with("events"))
+		validateMessages(n.Messages, slackPath.with("messages"))
+	}
+
+	for i, n := range notifications.Pagerduty {
+		pagerdutyPath := notificationsPath.with("pagerduty", i)
+		if n.Service == "" {
+			d.addConfigError(pagerdutyPath, "Pagerduty notification service is required")
+		}
+		if n.Type != "" && !utils.Contains([]string{pagerdutyTrigger, pagerdutyChange}, n.Type) {
+			d.addConfigError(pagerdutyPath.with("type"), "Invalid Pagerduty notification type '%s'. Must be one of ['trigger','change']", n.Type)
+		}
+		if n.Severity != "" && !utils.Contains([]string{"critical", "error", "warning", "info"}, n.Severity) {
+			d.addConfigError(pagerdutyPath.with("severity"), "Invalid Pagerduty notification severity '%s'. Must be one of ['critical','error','warning','info']", n.Severity)
+		}
+		validateEvents(n.Events, pagerdutyPath.with("events"))
+		validateMessages(n.Messages, pagerdutyPath.with("messages"))
+	}
+}
+
+// newNotifier creates the clients needed to send the given notifications
+// This is done up front so that missing credentials are found before deploying
+func (d *Deploy) newNotifier(notifications Notifications) *notifier {
+
+	if notifications.isEmpty() {
+		return nil
+	}
+
+	n := &notifier{notifications: notifications}
+	if len(notifications.Slack) > 0 {
+		n.slack = d.stim.Slack()
+	}
+	if len(notifications.Pagerduty) > 0 {
+		n.pagerduty = d.stim.Pagerduty()
+	}
+
+	return n
+}
+
+// notify sends notifications for an instance deployment event.  Failures to
+// send notifications are only logged so they do not affect the deployment.
+func (d *Deploy) notify(environment *Environment, instance *Instance, event string, start time.Time, deployErr error) {
+
+	if d.notifier == nil {
+		return
+	}
+
+	data := &notificationData{
+		Environment: environment.Name,
+		Instance:    instance.Name,
+		Cluster:     instance.Spec.Kubernetes.Cluster,
+		User:        d.deployUser(),
+		Event:       event,
+		Duration:    time.Since(start).Round(time.Second),
+		ExitCode:    exitCode(deployErr),
+	}
+	if deployErr != nil {
+		data.Error = deployErr.Error()
+	}
+	if d.protection != nil {
+		data.ApprovedBy = d.protection.approvedBy
+		data.Override = d.protection.overrideReason
+	}
+
+	for _, n := range d.notifier.notifications.Slack {
+		if !utils.Contains(notificationEvents(n.Events, notifyStart, notifySuccess, notifyFailure), event) {
+			continue
+		}
+		text, err := renderMessage(n.Messages.message(event), data)
+		if err == nil {
+			err = d.notifier.slack.PostMessage(&slack.Message{
+				Channel:  n.Channel,
+				Username: n.Username,
+				Text:     text,
+				IconUrl:  n.IconURL,
+			})
+		}
+		if err != nil {
+			d.log.Warn("Unable to send Slack notification to channel '{}': {}", n.Channel, err)
+		}
+	}
+
+	for _, n := range d.notifier.notifications.Pagerduty {
+		if !utils.Contains(notificationEvents(n.Events, notifyFailure), event) {
+			continue
+		}
+		text, err := renderMessage(n.Messages.message(event), data)
+		if err == nil {
+			if n.Type == pagerdutyChange {
+				err = d.notifier.pagerduty.SendChangeEvent(&pagerduty.ChangeEvent{
+					Service: n.Service,
+					Summary: text,
+					CustomDetails: map[string]string{
+						"environment": data.Environment,
+						"instance":    data.Instance,
+						"cluster":     data.Cluster,
+						"user":        data.User,
+						"event":       data.Event,
+						"exitCode":    strconv.Itoa(data.ExitCode),
+					},
+				})
+			} else {
+				err = d.notifier.pagerduty.SendEvent(&pagerduty.Event{
+					Action:    pagerdutyTrigger,
+					Service:   n.Service,
+					Severity:  pick(n.Severity, "error"),
+					Summary:   text,
+					Component: data.Instance,
+					Group:     data.Environment,
+					Class:     "deploy",
+					Details:   data.Error,
+					DedupKey:  fmt.Sprintf("stim-deploy/%s/%s", data.Environment, data.Instance),
+				})
+			}
+		}
+		if err != nil {
+			d.log.Warn("Unable to send Pagerduty notification to service '{}': {}", n.Service, err)
+		}
+	}
+}
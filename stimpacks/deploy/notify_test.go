@@ -0,0 +1,23 @@
+package deploy
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRenderMessage(t *testing.T) {
+	data := &notificationData{Environment: "prod", Instance: "us-west-2", User: "jdoe", Duration: 65 * time.Second, Error: "boom"}
+
+	text, err := renderMessage(NotificationMessages{}.message(notifyFailure), data)
+	assert.NilError(t, err)
+	assert.Equal(t, "jdoe failed to deploy to instance 'us-west-2' in environment 'prod' after 1m5s: boom", text, "Values not Equal")
+
+	text, err = renderMessage(NotificationMessages{Start: "{{.Environment}}/{{.Instance}}"}.message(notifyStart), data)
+	assert.NilError(t, err)
+	assert.Equal(t, "prod/us-west-2", text, "Values not Equal")
+
+	_, err = renderMessage("{{.Unknown}}", data)
+	assert.ErrorContains(t, err, "Unknown")
+}
@@ -0,0 +1,192 @@
+package deploy
+
+import (
+	"fmt"
+
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+)
+
+// Levels of the config hierarchy a merged spec item can originate from
+const (
+	originGlobal      = "global"
+	originEnvironment = "environment"
+	originInstance    = "instance"
+	originStim        = "stim"
+)
+
+// itemOrigin is where a merged spec item came from: the level of the config
+// hierarchy and the config file it was set in
+type itemOrigin struct {
+	level  string
+	source string
+}
+
+// specOrigins records where each item of a merged spec came from.  Specs read
+// from a config file only know the file (source) of their items, while the
+// merged spec of an instance also knows their level.
+type specOrigins struct {
+	envVars        map[string]itemOrigin
+	secrets        map[*v2e.SecretItem]itemOrigin
+	secretFiles    map[string]itemOrigin
+	tools          map[string]itemOrigin
+	cluster        itemOrigin
+	serviceAccount itemOrigin
+}
+
+// newSpecOrigins returns an empty specOrigins
+func newSpecOrigins() *specOrigins {
+	return &specOrigins{
+		envVars:     make(map[string]itemOrigin),
+		secrets:     make(map[*v2e.SecretItem]itemOrigin),
+		secretFiles: make(map[string]itemOrigin),
+		tools:       make(map[string]itemOrigin),
+	}
+}
+
+// setSource records the given config file as the source of every item of the
+// spec
+func (o *specOrigins) setSource(spec *Spec, source string) {
+	o.record(spec, func(itemOrigin) itemOrigin { return itemOrigin{source: source} })
+}
+
+// add records the given spec's items as coming from the given level, keeping
+// the config file the spec recorded for each item.  Specs should be added in
+// order of precedence (lowest first) so that overridden items are attributed
+// to the level that wins the merge.
+func (o *specOrigins) add(spec *Spec, level string) {
+	o.record(spec, func(origin itemOrigin) itemOrigin { return itemOrigin{level: level, source: origin.source} })
+}
+
+// record sets the origin of each item of the spec, given its origin in the
+// spec's own origins
+func (o *specOrigins) record(spec *Spec, origin func(itemOrigin) itemOrigin) {
+	own := spec.origins
+	if own == nil {
+		own = newSpecOrigins()
+	}
+	for _, e := range spec.EnvironmentVars {
+		o.envVars[e.Name] = origin(own.envVars[e.Name])
+	}
+	for _, s := range spec.Secrets {
+		o.secrets[s] = origin(own.secrets[s])
+	}
+	for _, name := range spec.secretFileNames() {
+		o.secretFiles[name] = origin(own.secretFiles[name])
+	}
+	for name := range spec.Tools {
+		o.tools[name] = origin(own.tools[name])
+	}
+	if spec.Kubernetes.Cluster != "" {
+		o.cluster = origin(own.cluster)
+	}
+	if spec.Kubernetes.ServiceAccount != "" {
+		o.serviceAccount = origin(own.serviceAccount)
+	}
+}
+
+// merge copies the origins of another spec into this one, overriding any
+// existing items
+func (o *specOrigins) merge(other *specOrigins) {
+	if other == nil {
+		return
+	}
+	for k, v := range other.envVars {
+		o.envVars[k] = v
+	}
+	for k, v := range other.secrets {
+		o.secrets[k] = v
+	}
+	for k, v := range other.secretFiles {
+		o.secretFiles[k] = v
+	}
+	for k, v := range other.tools {
+		o.tools[k] = v
+	}
+	if other.cluster != (itemOrigin{}) {
+		o.cluster = other.cluster
+	}
+	if other.serviceAccount != (itemOrigin{}) {
+		o.serviceAccount = other.serviceAccount
+	}
+}
+
+// envVar returns the level of the given environment variable
+func (o *specOrigins) envVar(name string) string {
+	return o.envVarOrigin(name).level
+}
+
+// envVarOrigin returns the origin of the given environment variable.  Items
+// which were not set in the config were generated by stim.
+func (o *specOrigins) envVarOrigin(name string) itemOrigin {
+	if origin, ok := o.envVars[name]; ok {
+		return origin
+	}
+	return itemOrigin{level: originStim, source: originStim}
+}
+
+// secret returns the level of the given secret item
+func (o *specOrigins) secret(secret *v2e.SecretItem) string {
+	return o.secretOrigin(secret).level
+}
+
+// secretOrigin returns the origin of the given secret item
+func (o *specOrigins) secretOrigin(secret *v2e.SecretItem) itemOrigin {
+	if origin, ok := o.secrets[secret]; ok {
+		return origin
+	}
+	return itemOrigin{level: originStim, source: originStim}
+}
+
+// secretFile returns the level of the given secret file
+func (o *specOrigins) secretFile(name string) string {
+	if origin, ok := o.secretFiles[name]; ok {
+		return origin.level
+	}
+	return originStim
+}
+
+// replaceSecret records that the given secret item has been replaced by a
+// copy, keeping the origin of the original
+func (o *specOrigins) replaceSecret(original *v2e.SecretItem, replacement *v2e.SecretItem) {
+	if origin, ok := o.secrets[original]; ok {
+		delete(o.secrets, original)
+		o.secrets[replacement] = origin
+	}
+}
+
+// tool returns the origin of the given tool
+func (o *specOrigins) tool(name string) itemOrigin {
+	return o.tools[name]
+}
+
+// originPath returns the config path of the spec at the given level for the
+// instance at the given environment/instance indexes.  Items generated by stim
+// are attributed to the instance itself.
+func originPath(level string, environmentIndex int, instanceIndex int) configPath {
+	switch level {
+	case originGlobal:
+		return configPath{"global", "spec"}
+	case originEnvironment:
+		return configPath{"environments", environmentIndex, "spec"}
+	case originInstance:
+		return configPath{"environments", environmentIndex, "instances", instanceIndex, "spec"}
+	}
+
+	return configPath{"environments", environmentIndex, "instances", instanceIndex}
+}
+
+// logSources writes the config file each item of the instance spec came from to the debug log
+func (d *Deploy) logSources(instance *Instance) {
+	prefix := fmt.Sprintf("[%s] ", instance.Name)
+	d.log.Debug("{}kubernetes.cluster '{}' from {}", prefix, instance.Spec.Kubernetes.Cluster, instance.origins.cluster.source)
+	d.log.Debug("{}kubernetes.serviceAccount '{}' from {}", prefix, instance.Spec.Kubernetes.ServiceAccount, instance.origins.serviceAccount.source)
+	for name := range instance.Spec.Tools {
+		d.log.Debug("{}tool '{}' from {}", prefix, name, instance.origins.tool(name).source)
+	}
+	for _, e := range instance.Spec.EnvironmentVars {
+		d.log.Debug("{}env '{}' from {}", prefix, e.Name, instance.origins.envVarOrigin(e.Name).source)
+	}
+	for _, s := range instance.Spec.Secrets {
+		d.log.Debug("{}secret '{}' from {}", prefix, s.SecretPath, instance.origins.secretOrigin(s).source)
+	}
+}
@@ -0,0 +1,113 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// outputLock serializes writes from concurrent deployments so that lines from
+// different instances never interleave mid-line
+var outputLock sync.Mutex
+
+// timestampFormat is the format of line timestamps, fixed width so that lines align
+const timestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// prefixWriter is an io.Writer that prefixes every line written to it
+// Partial lines are buffered until a newline is written or Flush is called
+// If timestamps is set, each line is also prefixed with the time it was written
+type prefixWriter struct {
+	out        io.Writer
+	prefix     string
+	timestamps bool
+	buf        []byte
+}
+
+// newPrefixWriter returns a prefixWriter that writes to out
+func newPrefixWriter(out io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{out: out, prefix: prefix}
+}
+
+// Write implements io.Writer, writing all complete lines to the underlying writer
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes out any buffered partial line
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := append(w.buf, '\n')
+	w.buf = nil
+	return w.writeLine(line)
+}
+
+// writeLine writes a single prefixed line to the underlying writer
+func (w *prefixWriter) writeLine(line []byte) error {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	prefix := w.prefix
+	if w.timestamps {
+		prefix = time.Now().UTC().Format(timestampFormat) + " " + prefix
+	}
+
+	_, err := w.out.Write(append([]byte(prefix), line...))
+	return err
+}
+
+// deployOutput returns the writers the deployment stdout and stderr are
+// copied to.  Each line is prefixed with the instance name and, if set,
+// the time.  If logs are being saved, output is also written to a log file in
+// the stim cache.  The returned function flushes and closes the writers.
+func (d *Deploy) deployOutput(environment *Environment, instance *Instance) (io.Writer, io.Writer, func(), error) {
+
+	prefix := fmt.Sprintf("[%s] ", instance.Name)
+	stdout := newPrefixWriter(os.Stdout, prefix)
+	stderr := newPrefixWriter(os.Stderr, prefix)
+	stdout.timestamps = d.stim.ConfigGetBool("deploy.timestamps")
+	stderr.timestamps = stdout.timestamps
+
+	if !d.stim.ConfigGetBool("deploy.save-logs") {
+		return stdout, stderr, func() {
+			stdout.Flush()
+			stderr.Flush()
+		}, nil
+	}
+
+	logPath := filepath.Join(d.stim.ConfigGetCacheDir("deploy-logs"), fmt.Sprintf("%s-%s-%s.log", environment.Name, instance.Name, time.Now().Format("20060102T150405")))
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, nil, nil, errors.New(fmt.Sprintf("Error creating deploy log file. %v", err))
+	}
+	d.log.Info("Saving deploy logs for '{}' to {}", instance.Name, logPath)
+
+	// Log file lines are always timestamped, with stderr lines marked
+	fileStdout := &prefixWriter{out: logFile, timestamps: true}
+	fileStderr := &prefixWriter{out: logFile, prefix: "[stderr] ", timestamps: true}
+
+	return io.MultiWriter(stdout, fileStdout), io.MultiWriter(stderr, fileStderr), func() {
+		for _, w := range []*prefixWriter{stdout, stderr, fileStdout, fileStderr} {
+			w.Flush()
+		}
+		logFile.Close()
+	}, nil
+}
@@ -0,0 +1,24 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := newPrefixWriter(&out, "[us-west-2] ")
+
+	fmt.Fprint(w, "first line\nsecond ")
+	assert.Equal(t, "[us-west-2] first line\n", out.String(), "Partial line should be buffered")
+
+	fmt.Fprint(w, "line\nthird")
+	w.Flush()
+	assert.Equal(t, "[us-west-2] first line\n[us-west-2] second line\n[us-west-2] third\n", out.String(), "Values not Equal")
+
+	w.Flush()
+	assert.Equal(t, "[us-west-2] first line\n[us-west-2] second line\n[us-west-2] third\n", out.String(), "Empty flush should not write")
+}
@@ -0,0 +1,84 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// deployResult holds the outcome of a single instance deployment
+type deployResult struct {
+	instance *Instance
+	err      error
+	skipped  bool
+	reason   string
+	phase    string
+	duration time.Duration
+}
+
+// status returns a short, human-readable status for the result
+func (r *deployResult) status() string {
+	if r.skipped {
+		return "SKIPPED"
+	}
+	if r.err != nil {
+		return "FAILED"
+	}
+	return "OK"
+}
+
+// getParallelism determines how many instances may be deployed at once
+// The cli parameter takes precedence over the deployment config
+func (d *Deploy) getParallelism() int {
+	parallelism := d.config.Deployment.Parallelism
+
+	if p := d.stim.ConfigGetString("deploy.parallel"); p != "" {
+		cliParallelism, err := strconv.Atoi(p)
+		if err != nil || cliParallelism < 0 {
+			d.log.Fatal("Invalid value for --parallel '{}'. Must be a positive integer", p)
+		}
+		if cliParallelism > 0 {
+			parallelism = cliParallelism
+		}
+	}
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	return parallelism
+}
+
+// printSummary prints a table of deployment results
+// Returns the number of deployments that did not succeed
+func (d *Deploy) printSummary(environment *Environment, results []*deployResult) int {
+
+	failures := 0
+
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	fmt.Printf("\nDeployment summary for environment '%s':\n\n", environment.Name)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tPHASE\tSTATUS\tDURATION\tERROR")
+	for _, r := range results {
+		errMessage := r.reason
+		if r.err != nil {
+			errMessage = r.err.Error()
+		}
+		if r.status() != "OK" {
+			failures++
+		}
+		phase := r.phase
+		if phase == "" {
+			phase = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.instance.Name, phase, r.status(), r.duration.Round(time.Second), errMessage)
+	}
+	w.Flush()
+	fmt.Println()
+
+	return failures
+}
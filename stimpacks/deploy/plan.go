@@ -0,0 +1,303 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+	"gopkg.in/yaml.v2"
+)
+
+const redactedValue = "<redacted>"
+
+// redactedEnvVars are stim-generated environment variables whose values
+// should never be displayed
+var redactedEnvVars = []string{"VAULT_TOKEN", "SECRET_CONFIG"}
+
+// instancePlan is the effective, fully merged spec of an instance deployment
+type instancePlan struct {
+	Environment string            `json:"environment" yaml:"environment"`
+	Instance    string            `json:"instance" yaml:"instance"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Method      string            `json:"method" yaml:"method"`
+	Image       string            `json:"image,omitempty" yaml:"image,omitempty"`
+	Directory   string            `json:"directory" yaml:"directory"`
+	Script      string            `json:"script" yaml:"script"`
+	Kubernetes  planKubernetes    `json:"kubernetes" yaml:"kubernetes"`
+	Tools       []planTool        `json:"tools" yaml:"tools"`
+	Env         []planEnvVar      `json:"env" yaml:"env"`
+	Secrets     []planSecret      `json:"secrets" yaml:"secrets"`
+	SecretFiles []planSecret      `json:"secretFiles,omitempty" yaml:"secretFiles,omitempty"`
+	Hooks       Hooks             `json:"hooks" yaml:"hooks"`
+	Timeout     string            `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	AWS         *AWS              `json:"aws,omitempty" yaml:"aws,omitempty"`
+	Verify      *Verify           `json:"verify,omitempty" yaml:"verify,omitempty"`
+}
+
+// planKubernetes is the resolved Kubernetes configuration of an instance
+type planKubernetes struct {
+	Cluster              string `json:"cluster" yaml:"cluster"`
+	ClusterSource        string `json:"clusterSource" yaml:"clusterSource"`
+	ServiceAccount       string `json:"serviceAccount" yaml:"serviceAccount"`
+	ServiceAccountSource string `json:"serviceAccountSource" yaml:"serviceAccountSource"`
+	Credentials          string `json:"credentials" yaml:"credentials"`
+}
+
+// planTool is a resolved tool requirement
+type planTool struct {
+	Name    string `json:"name" yaml:"name"`
+	Version string `json:"version" yaml:"version"`
+	Origin  string `json:"origin" yaml:"origin"`
+	Source  string `json:"source" yaml:"source"`
+}
+
+// planEnvVar is a resolved environment variable
+type planEnvVar struct {
+	Name   string `json:"name" yaml:"name"`
+	Value  string `json:"value" yaml:"value"`
+	Origin string `json:"origin" yaml:"origin"`
+	Source string `json:"source" yaml:"source"`
+}
+
+// planSecret is a resolved secret item
+type planSecret struct {
+	SecretPath string            `json:"secretPath" yaml:"secretPath"`
+	Version    float64           `json:"version,omitempty" yaml:"version,omitempty"`
+	TTL        int               `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	Set        map[string]string `json:"set" yaml:"set"`
+	Origin     string            `json:"origin" yaml:"origin"`
+	Source     string            `json:"source" yaml:"source"`
+}
+
+// Plan is the entrypoint to the "deploy plan" command
+// It prints the effective spec of each selected instance without deploying
+func (d *Deploy) Plan() {
+
+	d.log = d.stim.GetLogger()
+
+	d.parseConfig()
+
+	output := d.stim.ConfigGetString("deploy.plan.output")
+	if !utils.Contains([]string{"table", "yaml", "json"}, output) {
+		d.log.Fatal("Invalid output format '{}'.  Must be one of ['table','yaml','json']", output)
+	}
+
+	selectedEnvironment := d.selectEnvironment()
+	instances, _ := d.selectInstances(selectedEnvironment)
+
+	plans := make([]*instancePlan, len(instances))
+	for i, inst := range instances {
+		plans[i] = d.makePlan(selectedEnvironment, inst)
+	}
+
+	var err error
+	switch output {
+	case "yaml":
+		err = yaml.NewEncoder(os.Stdout).Encode(plans)
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(plans)
+	default:
+		for _, plan := range plans {
+			writePlanTable(os.Stdout, plan)
+		}
+	}
+	if err != nil {
+		d.log.Fatal("Error writing deploy plan: {}", err)
+	}
+}
+
+// makePlan builds the effective plan for an instance
+func (d *Deploy) makePlan(environment *Environment, instance *Instance) *instancePlan {
+
+	plan := &instancePlan{
+		Environment: environment.Name,
+		Instance:    instance.Name,
+		Labels:      instance.Labels,
+		Directory:   d.config.Deployment.fullDirectoryPath,
+		Script:      d.config.Deployment.Script,
+		Kubernetes: planKubernetes{
+			Cluster:              instance.Spec.Kubernetes.Cluster,
+			ClusterSource:        instance.origins.cluster.source,
+			ServiceAccount:       instance.Spec.Kubernetes.ServiceAccount,
+			ServiceAccountSource: instance.origins.serviceAccount.source,
+			Credentials:          instance.Spec.Kubernetes.provider(),
+		},
+		Tools:   []planTool{},
+		Env:     []planEnvVar{},
+		Secrets: []planSecret{},
+		Hooks:   instance.Spec.Hooks,
+		Timeout: instance.Spec.Timeout,
+		AWS:     instance.Spec.AWS,
+		Verify:  instance.Spec.Verify,
+	}
+
+	deployMethod, err := d.DetermineDeployMethod()
+	switch {
+	case err != nil:
+		plan.Method = fmt.Sprintf("unavailable (%v)", err)
+	case deployMethod == DEPLOY_METHOD_DOCKER:
+		plan.Method = "docker"
+		plan.Image = d.containerImage(instance)
+	case deployMethod == DEPLOY_METHOD_SHELL:
+		plan.Method = "shell"
+	}
+
+	toolNames := make([]string, 0, len(instance.Spec.Tools))
+	for name := range instance.Spec.Tools {
+		toolNames = append(toolNames, name)
+	}
+	sort.Strings(toolNames)
+	for _, name := range toolNames {
+		version := instance.Spec.Tools[name].Version
+		if version == "" {
+			version = "auto"
+		}
+		plan.Tools = append(plan.Tools, planTool{Name: name, Version: version, Origin: instance.origins.tool(name).level, Source: instance.origins.tool(name).source})
+	}
+
+	for _, e := range instance.Spec.EnvironmentVars {
+		value := e.Value
+		if e.ValueFrom != nil && !e.resolved {
+			value = e.ValueFrom.describe()
+		}
+		if utils.Contains(redactedEnvVars, e.Name) || e.isSecret() {
+			value = redactedValue
+		}
+		plan.Env = append(plan.Env, planEnvVar{Name: e.Name, Value: value, Origin: instance.origins.envVar(e.Name), Source: instance.origins.envVarOrigin(e.Name).source})
+	}
+
+	for _, s := range instance.Spec.Secrets {
+		plan.Secrets = append(plan.Secrets, planSecret{
+			SecretPath: s.SecretPath,
+			Version:    s.Version,
+			TTL:        s.TTL,
+			Set:        s.SecretMaps,
+			Origin:     instance.origins.secret(s),
+			Source:     instance.origins.secretOrigin(s).source,
+		})
+	}
+
+	for _, s := range instance.Spec.SecretFiles {
+		plan.SecretFiles = append(plan.SecretFiles, planSecret{
+			SecretPath: s.SecretPath,
+			Set:        s.Files,
+		})
+	}
+
+	return plan
+}
+
+// writePlanTable writes a human-readable version of the plan
+func writePlanTable(out io.Writer, plan *instancePlan) {
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Environment:\t%s\n", plan.Environment)
+	fmt.Fprintf(w, "Instance:\t%s\n", plan.Instance)
+	if len(plan.Labels) > 0 {
+		labels := make([]string, 0, len(plan.Labels))
+		for key, value := range plan.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(w, "Labels:\t%s\n", strings.Join(labels, ", "))
+	}
+	fmt.Fprintf(w, "Method:\t%s\n", plan.Method)
+	if plan.Image != "" {
+		fmt.Fprintf(w, "Image:\t%s\n", plan.Image)
+	}
+	fmt.Fprintf(w, "Script:\t%s\n", plan.Script)
+	fmt.Fprintf(w, "Directory:\t%s\n", plan.Directory)
+	fmt.Fprintf(w, "Cluster:\t%s\t(%s)\n", plan.Kubernetes.Cluster, plan.Kubernetes.ClusterSource)
+	fmt.Fprintf(w, "Service Account:\t%s\t(%s)\n", plan.Kubernetes.ServiceAccount, plan.Kubernetes.ServiceAccountSource)
+	fmt.Fprintf(w, "Credentials:\t%s\n", plan.Kubernetes.Credentials)
+	if plan.Timeout != "" {
+		fmt.Fprintf(w, "Timeout:\t%s\n", plan.Timeout)
+	}
+	if plan.AWS != nil {
+		fmt.Fprintf(w, "AWS:\t%s/%s\n", plan.AWS.Account, plan.AWS.Role)
+	}
+	w.Flush()
+
+	fmt.Fprintln(out, "\nTools:")
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tVERSION\tORIGIN\tSOURCE")
+	for _, t := range plan.Tools {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", t.Name, t.Version, t.Origin, t.Source)
+	}
+	w.Flush()
+
+	fmt.Fprintln(out, "\nEnvironment Variables:")
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tVALUE\tORIGIN\tSOURCE")
+	for _, e := range plan.Env {
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", e.Name, e.Value, e.Origin, e.Source)
+	}
+	w.Flush()
+
+	fmt.Fprintln(out, "\nSecrets:")
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  PATH\tVERSION\tENV VAR <- KEY\tORIGIN\tSOURCE")
+	for _, s := range plan.Secrets {
+		version := ""
+		if s.Version != 0 {
+			version = fmt.Sprintf("%v", s.Version)
+		}
+		mappings := make([]string, 0, len(s.Set))
+		for envName, key := range s.Set {
+			mappings = append(mappings, envName+" <- "+key)
+		}
+		sort.Strings(mappings)
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n", s.SecretPath, version, strings.Join(mappings, ", "), s.Origin, s.Source)
+	}
+	w.Flush()
+
+	if len(plan.SecretFiles) > 0 {
+		fmt.Fprintln(out, "\nSecret Files:")
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  PATH\tENV VAR <- KEY")
+		for _, s := range plan.SecretFiles {
+			mappings := make([]string, 0, len(s.Set))
+			for envName, key := range s.Set {
+				mappings = append(mappings, envName+" <- "+key)
+			}
+			sort.Strings(mappings)
+			fmt.Fprintf(w, "  %s\t%s\n", s.SecretPath, strings.Join(mappings, ", "))
+		}
+		w.Flush()
+	}
+
+	if !plan.Hooks.isEmpty() {
+		fmt.Fprintf(out, "\nHooks (failure policy: %s):\n", plan.Hooks.policy())
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  STAGE\tCOMMAND")
+		for _, stage := range []struct {
+			name  string
+			hooks []string
+		}{{"preDeploy", plan.Hooks.PreDeploy}, {"postDeploy", plan.Hooks.PostDeploy}, {"onFailure", plan.Hooks.OnFailure}} {
+			for _, hook := range stage.hooks {
+				fmt.Fprintf(w, "  %s\t%s\n", stage.name, hook)
+			}
+		}
+		w.Flush()
+	}
+
+	if plan.Verify != nil {
+		fmt.Fprintf(out, "\nVerify (timeout: %s):\n", pick(plan.Verify.Timeout, defaultVerifyTimeout.String()))
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  KIND\tNAMESPACE\tNAME/SELECTOR")
+		for _, r := range plan.Verify.Resources {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", r.Kind, pick(r.Namespace, "<default>"), pick(r.Name, r.Selector))
+		}
+		w.Flush()
+	}
+
+	fmt.Fprintln(out, "")
+}
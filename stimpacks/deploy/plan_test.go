@@ -0,0 +1,77 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/PremiereGlobal/stim/stim"
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	"gotest.tools/assert"
+)
+
+func TestMakePlan(t *testing.T) {
+	global := &Spec{
+		Kubernetes:      Kubernetes{ServiceAccount: "deploy"},
+		EnvironmentVars: []*EnvironmentVar{{Name: "LOG_LEVEL", Value: "info"}},
+		Tools:           map[string]stim.EnvTool{"helm": {Version: "3.1"}},
+	}
+	global.origins = newSpecOrigins()
+	global.origins.setSource(global, "shared.yaml")
+
+	secret := &v2e.SecretItem{SecretPath: "secret/app", SecretMaps: map[string]string{"PASSWORD": "password"}}
+	spec := &Spec{
+		Kubernetes: Kubernetes{Cluster: "prod-west"},
+		EnvironmentVars: []*EnvironmentVar{
+			{Name: "API_KEY", Value: "api-secret", ValueFrom: &ValueFrom{Vault: &VaultKeySource{Path: "secret/api", Key: "key"}}},
+			{Name: "GIT_SHA", ValueFrom: &ValueFrom{Git: gitAttrCommit}},
+		},
+		Secrets: []*v2e.SecretItem{secret},
+	}
+	spec.origins = newSpecOrigins()
+	spec.origins.setSource(spec, "stim.deploy.yaml")
+
+	instance := &Instance{Name: "us-west-2", Spec: &Spec{
+		Kubernetes: Kubernetes{Cluster: "prod-west", ServiceAccount: "deploy"},
+		Tools:      global.Tools,
+		EnvironmentVars: append(append(append([]*EnvironmentVar{}, global.EnvironmentVars...), spec.EnvironmentVars...),
+			&EnvironmentVar{Name: "VAULT_TOKEN", Value: "s.token"},
+			&EnvironmentVar{Name: "SECRET_CONFIG", Value: "[{\"secretPath\":\"secret/app\"}]"},
+			&EnvironmentVar{Name: "DEPLOY_INSTANCE", Value: "us-west-2"},
+		),
+		Secrets: spec.Secrets,
+	}}
+	instance.origins = newSpecOrigins()
+	instance.origins.add(global, originGlobal)
+	instance.origins.add(spec, originInstance)
+
+	d := &Deploy{stim: stim.New(), config: Config{Deployment: Deployment{Script: "deploy.sh"}}}
+	d.log = d.stim.GetLogger()
+	plan := d.makePlan(&Environment{Name: "prod"}, instance)
+
+	assert.DeepEqual(t, planKubernetes{Cluster: "prod-west", ClusterSource: "stim.deploy.yaml", ServiceAccount: "deploy", ServiceAccountSource: "shared.yaml", Credentials: "vaultToken"}, plan.Kubernetes)
+	assert.DeepEqual(t, []planTool{{Name: "helm", Version: "3.1", Origin: originGlobal, Source: "shared.yaml"}}, plan.Tools)
+	assert.DeepEqual(t, []planEnvVar{
+		{Name: "LOG_LEVEL", Value: "info", Origin: originGlobal, Source: "shared.yaml"},
+		{Name: "API_KEY", Value: redactedValue, Origin: originInstance, Source: "stim.deploy.yaml"},
+		{Name: "GIT_SHA", Value: "<git commit>", Origin: originInstance, Source: "stim.deploy.yaml"},
+		{Name: "VAULT_TOKEN", Value: redactedValue, Origin: originStim, Source: originStim},
+		{Name: "SECRET_CONFIG", Value: redactedValue, Origin: originStim, Source: originStim},
+		{Name: "DEPLOY_INSTANCE", Value: "us-west-2", Origin: originStim, Source: originStim},
+	}, plan.Env)
+	assert.Equal(t, originInstance, plan.Secrets[0].Origin)
+	assert.Equal(t, "stim.deploy.yaml", plan.Secrets[0].Source)
+
+	// No output format includes the secret values
+	var table bytes.Buffer
+	writePlanTable(&table, plan)
+	out, err := json.Marshal(plan)
+	assert.NilError(t, err)
+	for _, output := range []string{table.String(), string(out)} {
+		for _, value := range []string{"api-secret", "s.token", "secret/app\\\""} {
+			assert.Assert(t, !strings.Contains(output, value), "%s found in %s", value, output)
+		}
+	}
+	assert.Assert(t, strings.Contains(table.String(), "API_KEY          <redacted>    instance  stim.deploy.yaml"), table.String())
+}
@@ -0,0 +1,173 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+	"github.com/PremiereGlobal/stim/pkg/vault"
+)
+
+// Protection restricts who can deploy to an environment and requires the
+// deployment to be confirmed by typing the environment name
+type Protection struct {
+	Allow    ProtectionAllow `yaml:"allow"`
+	Approval *Approval       `yaml:"approval"`
+}
+
+// ProtectionAllow lists the Vault identities allowed to do something.  An
+// identity matching any entry is allowed, and everyone is allowed if the list
+// is empty.
+type ProtectionAllow struct {
+	Users    []string `yaml:"users"`
+	Entities []string `yaml:"entities"`
+	Policies []string `yaml:"policies"`
+}
+
+// Approval describes a second person who must approve deployments by
+// authenticating with Vault
+type Approval struct {
+	Required bool            `yaml:"required"`
+	Allow    ProtectionAllow `yaml:"allow"`
+}
+
+// protectionResult records how the protection of an environment was
+// satisfied, for the deployment history
+type protectionResult struct {
+	approvedBy     string
+	overrideReason string
+}
+
+// isEmpty returns true if no identities are listed
+func (a ProtectionAllow) isEmpty() bool {
+	return len(a.Users) == 0 && len(a.Entities) == 0 && len(a.Policies) == 0
+}
+
+// matches returns true if the given identity is allowed
+func (a ProtectionAllow) matches(identity *vault.TokenIdentity) bool {
+	if a.isEmpty() {
+		return true
+	}
+	if identity.Username != "" && utils.Contains(a.Users, identity.Username) {
+		return true
+	}
+	if identity.EntityID != "" && utils.Contains(a.Entities, identity.EntityID) {
+		return true
+	}
+	for _, policy := range identity.Policies {
+		if utils.Contains(a.Policies, policy) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateProtection ensures the protection config is valid
+func (d *Deploy) validateProtection(protection *Protection, protectionPath configPath) {
+
+	if protection == nil {
+		return
+	}
+
+	validateAllow := func(allow ProtectionAllow, allowPath configPath) {
+		for field, values := range map[string][]string{"users": allow.Users, "entities": allow.Entities, "policies": allow.Policies} {
+			for i, value := range values {
+				if strings.TrimSpace(value) == "" {
+					d.addConfigError(allowPath.with(field, i), "Protection allow entries can not be empty")
+				}
+			}
+		}
+	}
+
+	validateAllow(protection.Allow, protectionPath.with("allow"))
+	if protection.Approval != nil {
+		validateAllow(protection.Approval.Allow, protectionPath.with("approval", "allow"))
+	}
+}
+
+// checkProtection ensures the user is allowed to deploy to a protected
+// environment and has confirmed (and if required, had approved) the
+// deployment.  The checks can not be skipped by other flags, only overridden
+// with --override-protection and a reason, which is recorded in the history.
+func (d *Deploy) checkProtection(environment *Environment) (*protectionResult, error) {
+
+	rawOverride := d.stim.ConfigGetString("deploy.override-protection")
+	override := strings.TrimSpace(rawOverride)
+	if rawOverride != "" && override == "" {
+		return nil, errors.New("A reason is required with --override-protection")
+	}
+
+	protection := environment.Protection
+	if protection == nil {
+		if override != "" {
+			d.log.Warn("Environment '{}' is not protected, ignoring --override-protection", environment.Name)
+		}
+		return nil, nil
+	}
+
+	if override != "" {
+		d.log.Warn("{} is overriding the protection of environment '{}'. Reason: {}", d.deployUser(), environment.Name, override)
+		return &protectionResult{overrideReason: override}, nil
+	}
+
+	identity, err := d.stim.Vault().GetTokenIdentity()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to look up the Vault identity needed to deploy to protected environment '%s': %v", environment.Name, err))
+	}
+	if !protection.Allow.matches(identity) {
+		return nil, errors.New(fmt.Sprintf("User '%s' is not allowed to deploy to protected environment '%s'", identity.Username, environment.Name))
+	}
+
+	if d.stim.ConfigGetBool("noprompt") || d.stim.IsAutomated() {
+		return nil, errors.New(fmt.Sprintf("Environment '%s' is protected and deployments must be confirmed interactively.  Use --override-protection with a reason to deploy without confirmation", environment.Name))
+	}
+
+	confirmation, err := d.stim.PromptString(fmt.Sprintf("Environment '%s' is protected.  Type the environment name to confirm:", environment.Name), "")
+	if err != nil {
+		return nil, err
+	}
+	if confirmation != environment.Name {
+		return nil, errors.New(fmt.Sprintf("Confirmation '%s' does not match environment '%s'", confirmation, environment.Name))
+	}
+
+	result := &protectionResult{}
+	if protection.Approval != nil && protection.Approval.Required {
+		result.approvedBy, err = d.approveDeployment(environment, identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// approveDeployment prompts a second person to approve the deployment by
+// authenticating with Vault.  Returns the approver's username.
+func (d *Deploy) approveDeployment(environment *Environment, deployer *vault.TokenIdentity) (string, error) {
+
+	d.log.Info("Deployments to environment '{}' must be approved by a second person", environment.Name)
+	username, err := d.stim.PromptString("Approver Vault username:", "")
+	if err != nil {
+		return "", err
+	}
+	password, err := d.stim.PromptPassword("Approver Vault password")
+	if err != nil {
+		return "", err
+	}
+
+	approver, err := d.stim.Vault().VerifyUser(strings.TrimSpace(username), password)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Unable to authenticate approver '%s': %v", username, err))
+	}
+
+	if approver.Username == deployer.Username || (approver.EntityID != "" && approver.EntityID == deployer.EntityID) {
+		return "", errors.New(fmt.Sprintf("Deployments to environment '%s' must be approved by someone other than the person deploying", environment.Name))
+	}
+	if !environment.Protection.Approval.Allow.matches(approver) {
+		return "", errors.New(fmt.Sprintf("User '%s' is not allowed to approve deployments to environment '%s'", approver.Username, environment.Name))
+	}
+
+	d.log.Info("Deployment to environment '{}' approved by {}", environment.Name, approver.Username)
+	return approver.Username, nil
+}
@@ -0,0 +1,19 @@
+package deploy
+
+import (
+	"testing"
+
+	"github.com/PremiereGlobal/stim/pkg/vault"
+	"gotest.tools/assert"
+)
+
+func TestProtectionAllowMatches(t *testing.T) {
+	identity := &vault.TokenIdentity{Username: "jdoe", EntityID: "1234", Policies: []string{"default", "deployers"}}
+
+	assert.Assert(t, ProtectionAllow{}.matches(identity))
+	assert.Assert(t, ProtectionAllow{Users: []string{"jdoe"}}.matches(identity))
+	assert.Assert(t, ProtectionAllow{Entities: []string{"1234"}}.matches(identity))
+	assert.Assert(t, ProtectionAllow{Policies: []string{"deployers"}}.matches(identity))
+	assert.Assert(t, !ProtectionAllow{Users: []string{"asmith"}, Policies: []string{"admins"}}.matches(identity))
+	assert.Assert(t, !ProtectionAllow{Entities: []string{""}}.matches(&vault.TokenIdentity{}))
+}
@@ -0,0 +1,265 @@
+package deploy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// Image pull policies of the deploy container
+const (
+	pullAlways       = "Always"
+	pullIfNotPresent = "IfNotPresent"
+	pullNever        = "Never"
+)
+
+// Default keys of the registry credentials in the Vault secret
+const (
+	defaultRegistryUsernameKey     = "username"
+	defaultRegistryPasswordKey     = "password"
+	defaultRegistryDockerConfigKey = ".dockerconfigjson"
+)
+
+// digestPattern matches image digests
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// RegistryAuth describes the Vault secret holding the credentials used to
+// pull the deploy image.  The secret can hold either a username and password
+// or a Docker config JSON.
+type RegistryAuth struct {
+	VaultPath       string `yaml:"vaultPath"`
+	UsernameKey     string `yaml:"usernameKey"`
+	PasswordKey     string `yaml:"passwordKey"`
+	DockerConfigKey string `yaml:"dockerConfigKey"`
+}
+
+// dockerConfig is the part of a Docker config JSON holding registry credentials
+type dockerConfig struct {
+	Auths map[string]types.AuthConfig `json:"auths"`
+}
+
+// validateRegistry ensures the image pull settings of the container config are valid
+func (d *Deploy) validateRegistry(container *Container, containerPath configPath) {
+
+	if container.ImagePullPolicy != "" && container.ImagePullPolicy != pullAlways && container.ImagePullPolicy != pullIfNotPresent && container.ImagePullPolicy != pullNever {
+		d.addConfigError(containerPath.with("imagePullPolicy"), "Invalid image pull policy '%s'. Must be one of ['Always','IfNotPresent','Never']", container.ImagePullPolicy)
+	}
+
+	if container.Digest != "" && !digestPattern.MatchString(container.Digest) {
+		d.addConfigError(containerPath.with("digest"), "Invalid image digest '%s'. Must be in the form 'sha256:<64 hex characters>'", container.Digest)
+	}
+
+	if container.RegistryAuth != nil && container.RegistryAuth.VaultPath == "" {
+		d.addConfigError(containerPath.with("registryAuth", "vaultPath"), "Registry auth Vault path is required")
+	}
+}
+
+// pullImage makes sure the deploy image is available according to the image
+// pull policy, and that it matches the pinned digest if one is set
+func (d *Deploy) pullImage(ctx context.Context, dockerClient *client.Client, instance *Instance) error {
+
+	image := d.containerImage(instance)
+	policy := pick(instance.container.ImagePullPolicy, pullAlways)
+
+	pull := policy == pullAlways
+	if !pull {
+		_, _, err := dockerClient.ImageInspectWithRaw(ctx, image)
+		if client.IsErrNotFound(err) {
+			if policy == pullNever {
+				return errors.New(fmt.Sprintf("Deploy image '%s' is not present and the image pull policy is '%s'", image, pullNever))
+			}
+			pull = true
+		} else if err != nil {
+			return errors.New(fmt.Sprintf("Failed to inspect deploy image. %v", err))
+		} else {
+			d.log.Debug("Using existing deploy image '{}'", image)
+		}
+	}
+
+	if pull {
+		registryAuth, err := d.registryAuth(instance)
+		if err != nil {
+			return err
+		}
+		reader, err := dockerClient.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: registryAuth})
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to pull deploy image. %v", err))
+		}
+		defer reader.Close()
+
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			d.log.Debug(scanner.Text())
+		}
+	}
+
+	if instance.container.Digest != "" {
+		instance.imageDigest = instance.container.Digest
+		return verifyImageDigest(ctx, dockerClient, image, instance.container.Repo, instance.container.Digest)
+	}
+
+	// Record the digest of the image so the deployment can be repeated with
+	// the same image, even if the tag has moved
+	inspect, _, err := dockerClient.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		d.log.Debug("Unable to determine the digest of deploy image '{}': {}", image, err)
+		return nil
+	}
+	instance.imageDigest = repoDigest(inspect.RepoDigests, instance.container.Repo)
+
+	return nil
+}
+
+// verifyImageDigest ensures the local image has the expected repository digest
+func verifyImageDigest(ctx context.Context, dockerClient *client.Client, image string, repo string, digest string) error {
+
+	inspect, _, err := dockerClient.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to inspect deploy image. %v", err))
+	}
+
+	if !hasRepoDigest(inspect.RepoDigests, repo, digest) {
+		return errors.New(fmt.Sprintf("Deploy image '%s' does not match the pinned digest %s (found %s)", image, digest, strings.Join(inspect.RepoDigests, ", ")))
+	}
+
+	return nil
+}
+
+// hasRepoDigest returns true if one of the given repository digests is the
+// digest for the repository
+func hasRepoDigest(repoDigests []string, repo string, digest string) bool {
+
+	named, err := reference.ParseNormalizedNamed(repo)
+	if err != nil {
+		return false
+	}
+
+	for _, repoDigest := range repoDigests {
+		ref, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := ref.(reference.Canonical); ok && canonical.Name() == named.Name() && canonical.Digest().String() == digest {
+			return true
+		}
+	}
+
+	return false
+}
+
+// repoDigest returns the digest of the repository from the given repository
+// digests, or an empty string if there is none (ex. for locally built images)
+func repoDigest(repoDigests []string, repo string) string {
+
+	named, err := reference.ParseNormalizedNamed(repo)
+	if err != nil {
+		return ""
+	}
+
+	for _, repoDigest := range repoDigests {
+		ref, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := ref.(reference.Canonical); ok && canonical.Name() == named.Name() {
+			return canonical.Digest().String()
+		}
+	}
+
+	return ""
+}
+
+// registryAuth returns the encoded registry credentials used to pull the
+// deploy image, or an empty string if none are configured
+func (d *Deploy) registryAuth(instance *Instance) (string, error) {
+
+	auth := instance.container.RegistryAuth
+	if auth == nil {
+		return "", nil
+	}
+
+	secret, err := d.stim.Vault().ReadKV(auth.VaultPath)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Unable to read registry credentials from Vault. %v", err))
+	}
+
+	named, err := reference.ParseNormalizedNamed(instance.container.Repo)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Invalid deploy image repository '%s'. %v", instance.container.Repo, err))
+	}
+	domain := reference.Domain(named)
+
+	var authConfig *types.AuthConfig
+	if configJSON, ok := secret[pick(auth.DockerConfigKey, defaultRegistryDockerConfigKey)].(string); ok {
+		authConfig, err = dockerConfigAuth([]byte(configJSON), domain)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Invalid Docker config in registry credentials at '%s'. %v", auth.VaultPath, err))
+		}
+	} else {
+		username, _ := secret[pick(auth.UsernameKey, defaultRegistryUsernameKey)].(string)
+		password, _ := secret[pick(auth.PasswordKey, defaultRegistryPasswordKey)].(string)
+		if username == "" || password == "" {
+			return "", errors.New(fmt.Sprintf("Registry credentials at '%s' must contain either a Docker config or a username and password", auth.VaultPath))
+		}
+		authConfig = &types.AuthConfig{Username: username, Password: password, ServerAddress: domain}
+	}
+
+	encoded, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+// dockerConfigAuth returns the credentials for the given registry domain from
+// a Docker config JSON
+func dockerConfigAuth(configJSON []byte, domain string) (*types.AuthConfig, error) {
+
+	var config dockerConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, err
+	}
+
+	for server, auth := range config.Auths {
+		if registryHost(server) != domain {
+			continue
+		}
+		if auth.Auth != "" && auth.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Invalid auth for registry '%s'", server))
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.New(fmt.Sprintf("Invalid auth for registry '%s'", server))
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+			auth.Auth = ""
+		}
+		auth.ServerAddress = domain
+		return &auth, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("No credentials found for registry '%s'", domain))
+}
+
+// registryHost returns the registry domain of a Docker config server entry,
+// which may be a URL
+func registryHost(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,31 @@
+package deploy
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDockerConfigAuth(t *testing.T) {
+	config := []byte(`{"auths": {"https://index.docker.io/v1/": {"auth": "amRvZTpzZWNyZXQ="}, "registry.example.com": {"username": "deploy", "password": "token"}}}`)
+
+	auth, err := dockerConfigAuth(config, "docker.io")
+	assert.NilError(t, err)
+	assert.Equal(t, "jdoe", auth.Username, "Values not Equal")
+	assert.Equal(t, "secret", auth.Password, "Values not Equal")
+
+	auth, err = dockerConfigAuth(config, "registry.example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, "deploy", auth.Username, "Values not Equal")
+
+	_, err = dockerConfigAuth(config, "quay.io")
+	assert.ErrorContains(t, err, "No credentials found for registry 'quay.io'")
+}
+
+func TestHasRepoDigest(t *testing.T) {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	assert.Assert(t, hasRepoDigest([]string{"premiereglobal/kube-vault-deploy@" + digest}, "docker.io/premiereglobal/kube-vault-deploy", digest))
+	assert.Assert(t, !hasRepoDigest([]string{"example/other@" + digest}, "premiereglobal/kube-vault-deploy", digest))
+	assert.Assert(t, !hasRepoDigest([]string{}, "premiereglobal/kube-vault-deploy", digest))
+}
@@ -0,0 +1,198 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rollbackState describes a rollback to a previous deployment
+type rollbackState struct {
+
+	// record is the history record of the deployment being rolled back to
+	record *historyRecord
+
+	// repoRoot is the git repo of the deployment file and worktree is the
+	// temporary worktree of the recorded commit
+	repoRoot string
+	worktree string
+
+	// deployFile is the deployment file in the worktree
+	deployFile string
+}
+
+// repoPath returns the path in the git repo for a path in the worktree
+func (r *rollbackState) repoPath(worktreePath string) string {
+	rel, err := filepath.Rel(r.worktree, worktreePath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return worktreePath
+	}
+	return filepath.Join(r.repoRoot, rel)
+}
+
+// DeployRollback is the entrypoint to the "deploy rollback" command
+// It re-runs the deployment of an instance with the inputs recorded in the
+// snapshot of a previous successful deployment
+func (d *Deploy) DeployRollback() {
+
+	d.log = d.stim.GetLogger()
+
+	environmentName := d.stim.ConfigGetString("deploy.environment")
+	instanceName := d.stim.ConfigGetString("deploy.instance")
+	if environmentName == "" || instanceName == "" || strings.ToLower(instanceName) == allOptionCli {
+		d.log.Fatal("Both --environment and a single --instance are required to roll back a deployment")
+	}
+
+	to, err := parseHistoryTime(d.stim.ConfigGetString("deploy.rollback.to"), time.Now())
+	if err != nil {
+		d.log.Fatal("Invalid --to value: {}", err)
+	}
+
+	records := d.readHistory(d.stim.ConfigGetString("deploy.rollback.source"), d.stim.ConfigGetString("deploy.rollback.vault-path"))
+	record, err := findRollbackRecord(records, environmentName, instanceName, to)
+	if err != nil {
+		d.log.Fatal("{}", err)
+	}
+	if record.GitCommit == "" || record.Snapshot.DeployFile == "" {
+		d.log.Fatal("The deployment at {} was not made from a git repo and can not be rolled back to", record.Time.Local().Format(time.RFC3339))
+	}
+
+	configFile, err := filepath.Abs(pick(d.stim.ConfigGetString("deploy.file"), defaultConfigFile))
+	if err != nil {
+		d.log.Fatal("Error fetching deploy filepath '{}'", err)
+	}
+	repoRoot, err := gitRoot(filepath.Dir(configFile))
+	if err != nil {
+		d.log.Fatal("The deployment file '{}' must be in a git repo to roll back", configFile)
+	}
+
+	d.log.Info("Rolling back '{}' in environment '{}' to the deployment by {} at {} (commit {})", instanceName, environmentName, record.User, record.Time.Local().Format(time.RFC3339), record.GitCommit)
+	if record.Snapshot.Dirty {
+		d.log.Warn("The deployment had uncommitted changes, which are not included in the rollback")
+	}
+	proceed, _ := d.stim.PromptBool("Proceed with rollback?", d.stim.ConfigGetBool("noprompt") || d.stim.IsAutomated(), false)
+	if !proceed {
+		d.exitWithError(exitCodeDeclined, errDeclined)
+	}
+
+	code, err := d.rollbackInstance(record, repoRoot, environmentName, instanceName)
+	if err != nil {
+		d.exitWithError(code, err)
+	}
+}
+
+// rollbackInstance checks out the commit of the deployment being rolled back
+// to in a worktree and deploys the instance using the deployment file in the
+// worktree and the inputs recorded in the snapshot.  The worktree is removed
+// when it returns, or if stim exits on a second interrupt signal.
+func (d *Deploy) rollbackInstance(record *historyRecord, repoRoot string, environmentName string, instanceName string) (int, error) {
+
+	worktree, err := addWorktree(repoRoot, record.GitCommit)
+	if err != nil {
+		return 0, err
+	}
+	defer removeWorktree(repoRoot, worktree)
+	d.rollback = &rollbackState{
+		record:     record,
+		repoRoot:   repoRoot,
+		worktree:   worktree,
+		deployFile: filepath.Join(worktree, record.Snapshot.DeployFile),
+	}
+
+	d.loadConfig(false)
+	if len(d.config.errors) > 0 {
+		messages := make([]string, len(d.config.errors))
+		for i, err := range d.config.errors {
+			messages[i] = "  " + err.Error()
+		}
+		return 0, errors.New(fmt.Sprintf("Found %d errors in the deployment config at commit %s:\n%s", len(d.config.errors), d.rollback.record.GitCommit, strings.Join(messages, "\n")))
+	}
+
+	e, ok := d.config.environmentMap[environmentName]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Environment '%s' is not in the deployment config at commit %s", environmentName, d.rollback.record.GitCommit))
+	}
+	environment := d.config.Environments[e]
+	i, ok := environment.instanceMap[instanceName]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Instance '%s' is not in environment '%s' in the deployment config at commit %s", instanceName, environmentName, d.rollback.record.GitCommit))
+	}
+	instance := environment.Instances[i]
+
+	d.applySnapshot(instance, d.rollback.record.Snapshot)
+
+	return d.deployInstances(environment, []*Instance{instance}, false)
+}
+
+// findRollbackRecord returns the history record of the successful deployment
+// of the instance to roll back to.  If a time is given, this is the last
+// deployment at or before that time.  Otherwise it is the last deployment
+// before the current one, or before the deployment the current one rolled back
+// to if it was a rollback.
+func findRollbackRecord(records []*historyRecord, environment string, instance string, to time.Time) (*historyRecord, error) {
+
+	filter := historyFilter{environment: environment, instance: instance}
+	matched := []*historyRecord{}
+	for _, record := range records {
+		if filter.matches(record) {
+			matched = append(matched, record)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Time.Before(matched[j].Time) })
+
+	before := to
+	if to.IsZero() {
+		if len(matched) == 0 {
+			return nil, errors.New(fmt.Sprintf("No deployments of instance '%s' in environment '%s' found in the deploy history", instance, environment))
+		}
+		current := matched[len(matched)-1]
+		before = current.Time.Add(-time.Nanosecond)
+		if current.RollbackTo != nil {
+			before = current.RollbackTo.Add(-time.Nanosecond)
+		}
+	}
+
+	for i := len(matched) - 1; i >= 0; i-- {
+		record := matched[i]
+		if record.Time.After(before) || record.ExitCode != 0 || record.Error != "" || record.Snapshot == nil {
+			continue
+		}
+		return record, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("No successful deployment of instance '%s' in environment '%s' to roll back to found in the deploy history", instance, environment))
+}
+
+// addWorktree checks out the commit of the git repo in a new temporary
+// worktree.  Returns the path of the worktree.
+func addWorktree(repoRoot string, commit string) (string, error) {
+
+	dir, err := ioutil.TempDir("", "stim-rollback")
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Unable to create directory for the rollback worktree. %v", err))
+	}
+
+	worktree := filepath.Join(dir, "worktree")
+	cmd := exec.Command("git", "worktree", "add", "--detach", worktree, commit)
+	cmd.Dir = repoRoot
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return "", errors.New(fmt.Sprintf("Unable to check out commit %s. %s", commit, strings.TrimSpace(string(out))))
+	}
+
+	return worktree, nil
+}
+
+// removeWorktree removes a worktree created by addWorktree
+func removeWorktree(repoRoot string, worktree string) {
+	os.RemoveAll(filepath.Dir(worktree))
+	cmd := exec.Command("git", "worktree", "prune")
+	cmd.Dir = repoRoot
+	cmd.Run()
+}
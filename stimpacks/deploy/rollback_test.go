@@ -0,0 +1,96 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestFindRollbackRecord(t *testing.T) {
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time { return start.Add(time.Duration(hours) * time.Hour) }
+	snapshot := &deploySnapshot{DeployFile: "stim.deploy.yaml"}
+
+	records := []*historyRecord{
+		{Time: at(0), Environment: "prod", Instance: "us-east", GitCommit: "a", Snapshot: snapshot},
+		{Time: at(1), Environment: "prod", Instance: "us-west", GitCommit: "b", Snapshot: snapshot},
+		{Time: at(2), Environment: "prod", Instance: "us-east", GitCommit: "c", Snapshot: snapshot},
+		{Time: at(3), Environment: "prod", Instance: "us-east", GitCommit: "d", ExitCode: 2, Error: "failed"},
+	}
+
+	// The current deployment failed, so the last successful one is used
+	record, err := findRollbackRecord(records, "prod", "us-east", time.Time{})
+	assert.NilError(t, err)
+	assert.Equal(t, "c", record.GitCommit, "Values not Equal")
+
+	// The current deployment succeeded, so the one before it is used
+	records = append(records, &historyRecord{Time: at(4), Environment: "prod", Instance: "us-east", GitCommit: "e", Snapshot: snapshot})
+	record, err = findRollbackRecord(records, "prod", "us-east", time.Time{})
+	assert.NilError(t, err)
+	assert.Equal(t, "c", record.GitCommit, "Values not Equal")
+
+	// Rolling back again goes further back than the last rollback
+	rolledBackTo := at(2)
+	records = append(records, &historyRecord{Time: at(5), Environment: "prod", Instance: "us-east", GitCommit: "c", Snapshot: snapshot, RollbackTo: &rolledBackTo})
+	record, err = findRollbackRecord(records, "prod", "us-east", time.Time{})
+	assert.NilError(t, err)
+	assert.Equal(t, "a", record.GitCommit, "Values not Equal")
+
+	record, err = findRollbackRecord(records, "prod", "us-east", at(4))
+	assert.NilError(t, err)
+	assert.Equal(t, "e", record.GitCommit, "Values not Equal")
+
+	_, err = findRollbackRecord(records, "prod", "us-west", time.Time{})
+	assert.ErrorContains(t, err, "No successful deployment of instance 'us-west'")
+	_, err = findRollbackRecord(records, "dev", "us-east", time.Time{})
+	assert.ErrorContains(t, err, "No deployments of instance 'us-east'")
+}
+
+func TestWorktree(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "stim-deploy")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		assert.NilError(t, err, string(out))
+		return string(out)
+	}
+	git("init", "-q")
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "deploy.sh"), []byte("v1"), 0644))
+	git("add", "-A")
+	git("commit", "-q", "-m", "v1")
+	commit := gitCommit(dir)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "deploy.sh"), []byte("v2"), 0644))
+	assert.Assert(t, gitDirty(dir))
+
+	worktree, err := addWorktree(dir, commit)
+	assert.NilError(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(worktree, "deploy.sh"))
+	assert.NilError(t, err)
+	assert.Equal(t, "v1", string(content), "Values not Equal")
+	assert.Equal(t, commit, gitCommit(worktree), "Values not Equal")
+
+	r := &rollbackState{repoRoot: dir, worktree: worktree}
+	assert.Equal(t, filepath.Join(dir, "deploy"), r.repoPath(filepath.Join(worktree, "deploy")), "Values not Equal")
+
+	removeWorktree(dir, worktree)
+	_, err = os.Stat(worktree)
+	assert.Assert(t, os.IsNotExist(err))
+	assert.Assert(t, !strings.Contains(git("worktree", "list"), worktree))
+
+	_, err = addWorktree(dir, "0000000000000000000000000000000000000000")
+	assert.ErrorContains(t, err, "Unable to check out commit")
+}
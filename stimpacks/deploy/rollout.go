@@ -0,0 +1,447 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+)
+
+// Rollout describes how a deployment to all instances in an environment is rolled out
+type Rollout struct {
+	Canary            Canary   `yaml:"canary"`
+	BatchSize         int      `yaml:"batchSize"`
+	ContinueOnFailure bool     `yaml:"continueOnFailure"`
+	Order             []string `yaml:"order"`
+}
+
+// Canary describes the instances which are deployed before all others
+type Canary struct {
+	Instances []string `yaml:"instances"`
+	Pause     string   `yaml:"pause"`
+	Confirm   bool     `yaml:"confirm"`
+}
+
+// isEmpty returns true if no rollout settings are configured
+func (r Rollout) isEmpty() bool {
+	return len(r.Canary.Instances) == 0 && r.BatchSize == 0 && !r.ContinueOnFailure && len(r.Order) == 0
+}
+
+// rolloutPhase is a group of instances which are deployed together
+type rolloutPhase struct {
+	name      string
+	canary    bool
+	instances []*Instance
+}
+
+// validateRollout ensures the rollout config and instance dependencies of an
+// environment are valid.  Must be called after the instance map is built.
+func (d *Deploy) validateRollout(environment *Environment, environmentPath configPath) {
+
+	rolloutPath := environmentPath.with("rollout")
+	rollout := environment.Rollout
+
+	for k, name := range rollout.Canary.Instances {
+		if _, ok := environment.instanceMap[name]; !ok {
+			d.addConfigError(rolloutPath.with("canary", "instances", k), "Canary instance '%s' not found in environment '%s'", name, environment.Name)
+		}
+	}
+	if rollout.Canary.Pause != "" {
+		if _, err := time.ParseDuration(rollout.Canary.Pause); err != nil {
+			d.addConfigError(rolloutPath.with("canary", "pause"), "Invalid canary pause '%s'. Must be a duration (ex. 5m)", rollout.Canary.Pause)
+		}
+	}
+	if rollout.BatchSize < 0 {
+		d.addConfigError(rolloutPath.with("batchSize"), "Invalid rollout batchSize '%d'. Must be a positive integer", rollout.BatchSize)
+	}
+	for k, name := range rollout.Order {
+		if _, ok := environment.instanceMap[name]; !ok {
+			d.addConfigError(rolloutPath.with("order", k), "Rollout order instance '%s' not found in environment '%s'", name, environment.Name)
+		}
+	}
+
+	for j, instance := range environment.Instances {
+		for k, name := range instance.DependsOn {
+			dependsOnPath := environmentPath.with("instances", j, "dependsOn", k)
+			dependency, ok := environment.instanceMap[name]
+			if !ok {
+				d.addConfigError(dependsOnPath, "Instance '%s' depends on unknown instance '%s'", instance.Name, name)
+				continue
+			}
+			if utils.Contains(rollout.Canary.Instances, instance.Name) && !utils.Contains(rollout.Canary.Instances, name) {
+				d.addConfigError(dependsOnPath, "Canary instance '%s' cannot depend on non-canary instance '%s'", instance.Name, environment.Instances[dependency].Name)
+			}
+		}
+	}
+
+	if cycle := dependencyCycle(environment.Instances); cycle != nil {
+		d.addConfigError(environmentPath.with("instances"), "Instance dependency cycle detected: %s", strings.Join(cycle, " -> "))
+	}
+}
+
+// dependencyCycle returns the instance names of a dependency cycle, or nil if there are none
+func dependencyCycle(instances []*Instance) []string {
+
+	byName := make(map[string]*Instance)
+	for _, instance := range instances {
+		byName[instance.Name] = instance
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(name string, stack []string) []string
+	visit = func(name string, stack []string) []string {
+		switch state[name] {
+		case visiting:
+			for i, s := range stack {
+				if s == name {
+					return append(append([]string{}, stack[i:]...), name)
+				}
+			}
+		case visited:
+			return nil
+		}
+		instance, ok := byName[name]
+		if !ok {
+			return nil
+		}
+		state[name] = visiting
+		for _, dependency := range instance.DependsOn {
+			if cycle := visit(dependency, append(stack, name)); cycle != nil {
+				return cycle
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	for _, instance := range instances {
+		if cycle := visit(instance.Name, nil); cycle != nil {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+// planRollout splits the instances to deploy into phases according to the
+// environment's rollout config.  Instances are ordered by the rollout order,
+// then the order in the config, such that dependencies are deployed first.
+func planRollout(rollout Rollout, instances []*Instance) []*rolloutPhase {
+
+	ordered := orderInstances(rollout.Order, instances)
+
+	var phases []*rolloutPhase
+	var remaining []*Instance
+
+	canary := &rolloutPhase{name: "canary", canary: true}
+	for _, instance := range ordered {
+		if utils.Contains(rollout.Canary.Instances, instance.Name) {
+			canary.instances = append(canary.instances, instance)
+		} else {
+			remaining = append(remaining, instance)
+		}
+	}
+	if len(canary.instances) > 0 {
+		phases = append(phases, canary)
+	}
+
+	batchSize := rollout.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(remaining)
+	}
+	for i := 0; i < len(remaining); i += batchSize {
+		end := i + batchSize
+		if end > len(remaining) {
+			end = len(remaining)
+		}
+		phases = append(phases, &rolloutPhase{instances: remaining[i:end]})
+	}
+
+	// Only name the batches if there is more than one phase
+	if len(phases) > 1 {
+		batch := 0
+		for _, phase := range phases {
+			if !phase.canary {
+				batch++
+				phase.name = fmt.Sprintf("batch %d", batch)
+			}
+		}
+	}
+
+	return phases
+}
+
+// orderInstances sorts instances so that each comes after its dependencies.
+// Otherwise instances listed in order come first, then the rest in their
+// existing order.  Dependencies on instances not in the list are ignored.
+func orderInstances(order []string, instances []*Instance) []*Instance {
+
+	var preferred []*Instance
+	for _, name := range order {
+		if instance := findInstance(instances, name); instance != nil && findInstance(preferred, name) == nil {
+			preferred = append(preferred, instance)
+		}
+	}
+	for _, instance := range instances {
+		if findInstance(preferred, instance.Name) == nil {
+			preferred = append(preferred, instance)
+		}
+	}
+
+	var result []*Instance
+	placed := make(map[string]bool)
+	for len(result) < len(preferred) {
+		progress := false
+		for _, instance := range preferred {
+			if placed[instance.Name] {
+				continue
+			}
+			ready := true
+			for _, dependency := range instance.DependsOn {
+				if findInstance(instances, dependency) != nil && !placed[dependency] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				result = append(result, instance)
+				placed[instance.Name] = true
+				progress = true
+				break
+			}
+		}
+
+		// Dependency cycles are caught when validating the config, but make
+		// sure we never loop forever
+		if !progress {
+			for _, instance := range preferred {
+				if !placed[instance.Name] {
+					result = append(result, instance)
+					placed[instance.Name] = true
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// describeRollout returns a human-readable description of the rollout phases
+func describeRollout(rollout Rollout, phases []*rolloutPhase) string {
+
+	var lines []string
+	for _, phase := range phases {
+		names := make([]string, len(phase.instances))
+		for i, instance := range phase.instances {
+			names[i] = instance.Name
+		}
+		name := phase.name
+		if name == "" {
+			name = "all"
+		}
+		line := fmt.Sprintf("  %s: %s", name, strings.Join(names, ", "))
+		if phase.canary {
+			if rollout.Canary.Pause != "" {
+				line += fmt.Sprintf(" (then pause %s)", rollout.Canary.Pause)
+			}
+			if rollout.Canary.Confirm {
+				line += " (then confirm)"
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	onFailure := "stop"
+	if rollout.ContinueOnFailure {
+		onFailure = "continue"
+	}
+	lines = append(lines, fmt.Sprintf("  on failure: %s", onFailure))
+
+	return strings.Join(lines, "\n")
+}
+
+// rolloutState tracks the results of a rollout as instances are deployed
+type rolloutState struct {
+	results  map[string]*deployResult
+	selected map[string]bool
+	failed   bool
+	stopped  string
+	lock     sync.Mutex
+}
+
+// skipReason returns why the instance should be skipped, an empty string if it
+// can be deployed or ok false if it is waiting on dependencies
+func (s *rolloutState) skipReason(instance *Instance) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped != "" {
+		return s.stopped, true
+	}
+
+	for _, dependency := range instance.DependsOn {
+		if !s.selected[dependency] {
+			continue
+		}
+		result, ok := s.results[dependency]
+		if !ok {
+			return "", false
+		}
+		if result.status() != "OK" {
+			return fmt.Sprintf("Dependency '%s' did not succeed", dependency), true
+		}
+	}
+
+	return "", true
+}
+
+// record stores the result of an instance deployment
+func (s *rolloutState) record(result *deployResult) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.results[result.instance.Name] = result
+	if result.err != nil {
+		s.failed = true
+	}
+}
+
+// status returns whether any deployment has failed and the reason the
+// rollout was stopped, if it was
+func (s *rolloutState) status() (bool, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.failed, s.stopped
+}
+
+// stop prevents any further deployments from starting
+func (s *rolloutState) stop(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped == "" {
+		s.stopped = reason
+	}
+}
+
+// deployRollout deploys the instances of an environment according to its
+// rollout config, running at most 'parallelism' deployments at once.  Results
+// are returned in the order the instances were deployed.
+func (d *Deploy) deployRollout(ctx context.Context, environment *Environment, rollout Rollout, instances []*Instance, parallelism int) []*deployResult {
+
+	state := &rolloutState{
+		results:  make(map[string]*deployResult),
+		selected: make(map[string]bool),
+	}
+	for _, instance := range instances {
+		state.selected[instance.Name] = true
+	}
+
+	var results []*deployResult
+	phases := planRollout(rollout, instances)
+	for _, phase := range phases {
+
+		if phase.name != "" {
+			d.log.Info("Starting {} rollout of {} instance(s) in environment '{}'", phase.name, len(phase.instances), environment.Name)
+		}
+		results = append(results, d.deployPhase(ctx, environment, phase, state, rollout.ContinueOnFailure, parallelism)...)
+
+		// Wait and/or confirm before continuing after the canary
+		failed, stopped := state.status()
+		if !phase.canary || stopped != "" || (failed && !rollout.ContinueOnFailure) {
+			continue
+		}
+		if rollout.Canary.Pause != "" {
+			pause, _ := time.ParseDuration(rollout.Canary.Pause)
+			d.log.Info("Canary deployment complete, pausing for {} before continuing", pause)
+			select {
+			case <-time.After(pause):
+			case <-ctx.Done():
+				state.stop(errInterrupted.Error())
+				continue
+			}
+		}
+		if rollout.Canary.Confirm {
+			proceed, _ := d.stim.PromptBool("Canary deployment complete. Continue rollout?", d.stim.ConfigGetBool("noprompt") || d.stim.IsAutomated(), false)
+			if !proceed {
+				state.stop("Rollout stopped after canary")
+			}
+		}
+	}
+
+	return results
+}
+
+// deployPhase deploys the instances of a single rollout phase.  Instances are
+// started as soon as their dependencies have succeeded and a slot is free.
+func (d *Deploy) deployPhase(ctx context.Context, environment *Environment, phase *rolloutPhase, state *rolloutState, continueOnFailure bool, parallelism int) []*deployResult {
+
+	var results []*deployResult
+	var resultsLock sync.Mutex
+	addResult := func(result *deployResult) {
+		result.phase = phase.name
+		state.record(result)
+		resultsLock.Lock()
+		results = append(results, result)
+		resultsLock.Unlock()
+	}
+
+	pending := append([]*Instance{}, phase.instances...)
+	done := make(chan *deployResult)
+	running := 0
+
+	for len(pending) > 0 || running > 0 {
+
+		if ctx.Err() != nil {
+			state.stop(errInterrupted.Error())
+		}
+
+		// Start any instances that are ready, in order
+		for i := 0; i < len(pending) && running < parallelism; {
+			instance := pending[i]
+			reason, ready := state.skipReason(instance)
+			if !ready {
+				i++
+				continue
+			}
+			pending = append(pending[:i], pending[i+1:]...)
+			if reason != "" {
+				addResult(&deployResult{instance: instance, skipped: true, reason: reason})
+				continue
+			}
+
+			running++
+			go func(instance *Instance) {
+				start := time.Now()
+				err := d.Deploy(ctx, environment, instance)
+				done <- &deployResult{instance: instance, err: err, duration: time.Since(start)}
+			}(instance)
+		}
+
+		if running == 0 {
+			// Anything left is waiting on instances outside of this phase
+			for _, instance := range pending {
+				addResult(&deployResult{instance: instance, skipped: true, reason: "Dependencies were not deployed"})
+			}
+			break
+		}
+
+		result := <-done
+		running--
+		if result.err != nil {
+			d.log.Warn("Deployment to '{}' failed: {}", result.instance.Name, result.err)
+			if !continueOnFailure {
+				state.stop(fmt.Sprintf("Deployment to '%s' failed", result.instance.Name))
+			}
+		}
+		addResult(result)
+	}
+
+	return results
+}
@@ -0,0 +1,62 @@
+package deploy
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// phaseNames returns the phases as 'name: instance,instance' strings
+func phaseNames(phases []*rolloutPhase) []string {
+	var result []string
+	for _, phase := range phases {
+		var names []string
+		for _, instance := range phase.instances {
+			names = append(names, instance.Name)
+		}
+		result = append(result, phase.name+": "+strings.Join(names, ","))
+	}
+	return result
+}
+
+func TestPlanRollout(t *testing.T) {
+	instances := []*Instance{
+		{Name: "eu-west-1", DependsOn: []string{"us-east-1"}},
+		{Name: "us-east-1"},
+		{Name: "us-west-2"},
+		{Name: "ap-south-1"},
+		{Name: "ca-central-1"},
+	}
+
+	phases := planRollout(Rollout{}, instances)
+	assert.DeepEqual(t, []string{": us-east-1,eu-west-1,us-west-2,ap-south-1,ca-central-1"}, phaseNames(phases))
+
+	rollout := Rollout{
+		Canary:    Canary{Instances: []string{"us-west-2"}},
+		BatchSize: 2,
+		Order:     []string{"ca-central-1", "eu-west-1"},
+	}
+	phases = planRollout(rollout, instances)
+	assert.DeepEqual(t, []string{
+		"canary: us-west-2",
+		"batch 1: ca-central-1,us-east-1",
+		"batch 2: eu-west-1,ap-south-1",
+	}, phaseNames(phases))
+
+	// Dependencies outside of the deployed instances are ignored
+	phases = planRollout(Rollout{}, instances[:1])
+	assert.DeepEqual(t, []string{": eu-west-1"}, phaseNames(phases))
+}
+
+func TestDependencyCycle(t *testing.T) {
+	instances := []*Instance{
+		{Name: "a", DependsOn: []string{"b"}},
+		{Name: "b", DependsOn: []string{"c"}},
+		{Name: "c"},
+	}
+	assert.Assert(t, dependencyCycle(instances) == nil, "Unexpected dependency cycle")
+
+	instances[2].DependsOn = []string{"a"}
+	assert.DeepEqual(t, []string{"a", "b", "c", "a"}, dependencyCycle(instances))
+}
@@ -0,0 +1,108 @@
+package deploy
+
+import (
+	"reflect"
+	"strings"
+)
+
+const jsonSchemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// configSchema generates a JSON Schema for the deployment config file based on
+// the config types, so that editors can validate and autocomplete the config
+func configSchema() map[string]interface{} {
+
+	definitions := make(map[string]interface{})
+	root := typeSchema(reflect.TypeOf(Config{}), definitions)
+
+	schema := map[string]interface{}{
+		"$schema":     jsonSchemaVersion,
+		"title":       "stim deploy config",
+		"definitions": definitions,
+	}
+	for k, v := range root {
+		schema[k] = v
+	}
+
+	return schema
+}
+
+// typeSchema returns the JSON Schema for the given type
+// Structs are added to definitions and referenced by name
+func typeSchema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), definitions)
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := definitions[name]; !ok {
+
+			// Reserve the name first in case the type references itself
+			definitions[name] = nil
+
+			properties := make(map[string]interface{})
+			structProperties(t, properties, definitions)
+			definitions[name] = map[string]interface{}{
+				"type":                 "object",
+				"properties":           properties,
+				"additionalProperties": false,
+			}
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + name}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem(), definitions),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem(), definitions),
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+
+	// Anything else (ex. interface{}) can be any value
+	return map[string]interface{}{}
+}
+
+// structProperties adds the schema of each YAML field of the struct to properties
+func structProperties(t reflect.Type, properties map[string]interface{}, definitions map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		// Skip unexported fields
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+
+		// Inlined structs have their fields merged into the parent
+		if len(tag) > 1 && tag[1] == "inline" {
+			inlineType := field.Type
+			if inlineType.Kind() == reflect.Ptr {
+				inlineType = inlineType.Elem()
+			}
+			structProperties(inlineType, properties, definitions)
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		properties[name] = typeSchema(field.Type, definitions)
+	}
+}
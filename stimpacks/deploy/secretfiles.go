@@ -0,0 +1,187 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+)
+
+// containerSecretsDir is the tmpfs in the deploy container which secret
+// files are written to
+const containerSecretsDir = "/stim/secrets"
+
+// containerFilesReady is created in the deploy container once the secret
+// files and kubeconfig have been written
+const containerFilesReady = containerSecretsDir + "/.ready"
+
+// SecretFile describes keys of a Vault secret which are written to files
+// instead of being set as environment variables
+type SecretFile struct {
+	SecretPath string            `yaml:"secretPath"`
+	Files      map[string]string `yaml:"files"`
+}
+
+// validateSecretFiles ensures the secret files of a spec are valid
+func (d *Deploy) validateSecretFiles(secretFiles []*SecretFile, secretFilesPath configPath) {
+
+	for i, s := range secretFiles {
+		secretFilePath := secretFilesPath.with(i)
+		if s.SecretPath == "" {
+			d.addConfigError(secretFilePath.with("secretPath"), "Secret file secretPath is required")
+		}
+		if len(s.Files) == 0 {
+			d.addConfigError(secretFilePath.with("files"), "Secret file must have at least one file")
+		}
+		for name, key := range s.Files {
+			// The name is also the environment variable set to the file path
+			if !variableName.MatchString(name) {
+				d.addConfigError(secretFilePath.with("files", name), "Invalid secret file name '%s'. Must be a valid environment variable name", name)
+			}
+			if key == "" {
+				d.addConfigError(secretFilePath.with("files", name), "Secret key for file '%s' is required", name)
+			}
+		}
+	}
+}
+
+// mergeSecretFiles is used to merge secret file configs at the various levels
+// they can be set at.  Files are written in order, so a file set at more than
+// one level has the value of the most specific level.
+func mergeSecretFiles(instance []*SecretFile, environment []*SecretFile, global []*SecretFile) []*SecretFile {
+
+	result := append([]*SecretFile{}, global...)
+	result = append(result, environment...)
+	result = append(result, instance...)
+
+	return result
+}
+
+// secretFileNames returns the unique names of all secret files of the spec
+func (s *Spec) secretFileNames() []string {
+
+	var names []string
+	for _, secretFile := range s.SecretFiles {
+		for name := range secretFile.Files {
+			if !utils.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// secretFile is the content of a secret file read from Vault
+type secretFile struct {
+	name    string
+	content []byte
+}
+
+// readSecretFiles reads the secret files of the instance from Vault, in the
+// order they are written
+func (d *Deploy) readSecretFiles(instance *Instance) ([]*secretFile, error) {
+
+	var files []*secretFile
+	for _, s := range instance.Spec.SecretFiles {
+		secret, err := d.stim.Vault().ReadKV(s.SecretPath)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unable to read secret '%s' for secret files. %v", s.SecretPath, err))
+		}
+
+		names := make([]string, 0, len(s.Files))
+		for name := range s.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, ok := secret[s.Files[name]]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("Key '%s' not found in Vault secret '%s'", s.Files[name], s.SecretPath))
+			}
+			content, err := secretFileContent(name, value)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, &secretFile{name: name, content: content})
+		}
+	}
+
+	return files, nil
+}
+
+// secretFileEnvs returns the environment variables pointing at the secret
+// files of the instance, using dir as the directory the files are seen in by
+// the deployment
+func secretFileEnvs(instance *Instance, dir string) []string {
+
+	var envs []string
+	for _, name := range instance.Spec.secretFileNames() {
+		envs = append(envs, fmt.Sprintf("%s=%s", name, path.Join(dir, name)))
+	}
+
+	return envs
+}
+
+// writeSecretFiles reads the secret files of the instance from Vault and
+// writes them to dir.  Returns the environment variables pointing at the
+// files.
+func (d *Deploy) writeSecretFiles(instance *Instance, dir string) ([]string, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to create secret files directory. %v", err))
+	}
+
+	files, err := d.readSecretFiles(instance)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if err := writeSecretFile(dir, f.name, f.content); err != nil {
+			return nil, err
+		}
+	}
+
+	return secretFileEnvs(instance, dir), nil
+}
+
+// secretFileContent returns the content of a secret file.  String values are
+// written as is, other values as JSON.
+func secretFileContent(name string, value interface{}) ([]byte, error) {
+
+	if s, ok := value.(string); ok {
+		return []byte(s), nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to encode secret file '%s'. %v", name, err))
+	}
+
+	return encoded, nil
+}
+
+// writeSecretFile writes a single secret file only readable by the owner
+func writeSecretFile(dir string, name string, content []byte) error {
+
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to write secret file '%s'. %v", name, err))
+	}
+	defer file.Close()
+
+	// The file may already exist from a less specific level
+	if err := file.Chmod(0600); err != nil {
+		return errors.New(fmt.Sprintf("Unable to write secret file '%s'. %v", name, err))
+	}
+	if _, err := file.Write(content); err != nil {
+		return errors.New(fmt.Sprintf("Unable to write secret file '%s'. %v", name, err))
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestWriteSecretFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stim-deploy")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NilError(t, writeSecretFile(dir, "TLS_KEY", []byte("-----BEGIN KEY-----\n")))
+	content, err := ioutil.ReadFile(filepath.Join(dir, "TLS_KEY"))
+	assert.NilError(t, err)
+	assert.Equal(t, "-----BEGIN KEY-----\n", string(content), "Values not Equal")
+
+	info, err := os.Stat(filepath.Join(dir, "TLS_KEY"))
+	assert.NilError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Values not Equal")
+
+	// Existing files are replaced and made private
+	assert.NilError(t, os.Chmod(filepath.Join(dir, "TLS_KEY"), 0644))
+	content, err = secretFileContent("TLS_KEY", map[string]interface{}{"a": "b"})
+	assert.NilError(t, err)
+	assert.NilError(t, writeSecretFile(dir, "TLS_KEY", content))
+	content, err = ioutil.ReadFile(filepath.Join(dir, "TLS_KEY"))
+	assert.NilError(t, err)
+	assert.Equal(t, `{"a":"b"}`, string(content), "Values not Equal")
+	info, err = os.Stat(filepath.Join(dir, "TLS_KEY"))
+	assert.NilError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Values not Equal")
+}
+
+func TestSecretFileNames(t *testing.T) {
+	spec := &Spec{SecretFiles: mergeSecretFiles(
+		[]*SecretFile{{SecretPath: "secret/instance", Files: map[string]string{"TLS_KEY": "key"}}},
+		nil,
+		[]*SecretFile{{SecretPath: "secret/global", Files: map[string]string{"TLS_KEY": "key", "TLS_CERT": "cert"}}},
+	)}
+
+	assert.Equal(t, "secret/instance", spec.SecretFiles[1].SecretPath, "Values not Equal")
+	assert.DeepEqual(t, []string{"TLS_CERT", "TLS_KEY"}, spec.secretFileNames())
+}
@@ -0,0 +1,42 @@
+package deploy
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// validateLabels ensures the instance labels are valid Kubernetes label keys
+// and values so that they can be matched by a label selector
+func (d *Deploy) validateLabels(instanceLabels map[string]string, labelsPath configPath) {
+	for key, value := range instanceLabels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			d.addConfigError(labelsPath.with(key), "Invalid label key '%s'. %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			d.addConfigError(labelsPath.with(key), "Invalid value '%s' for label '%s'. %s", value, key, strings.Join(errs, "; "))
+		}
+	}
+}
+
+// filterInstances returns the instances whose labels match the selector, in
+// config order
+func filterInstances(selector labels.Selector, instances []*Instance) []*Instance {
+	matched := []*Instance{}
+	for _, instance := range instances {
+		if selector.Matches(labels.Set(instance.Labels)) {
+			matched = append(matched, instance)
+		}
+	}
+	return matched
+}
+
+// instanceNames returns the names of the instances
+func instanceNames(instances []*Instance) []string {
+	names := make([]string, len(instances))
+	for i, instance := range instances {
+		names[i] = instance.Name
+	}
+	return names
+}
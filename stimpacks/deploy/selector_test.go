@@ -0,0 +1,46 @@
+package deploy
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestFilterInstances(t *testing.T) {
+	instances := []*Instance{
+		{Name: "us-east-1", Labels: map[string]string{"region": "us", "tier": "edge"}},
+		{Name: "us-west-2", Labels: map[string]string{"region": "us", "tier": "api", "canary": "true"}},
+		{Name: "eu-west-1", Labels: map[string]string{"region": "eu", "tier": "edge"}},
+		{Name: "ap-south-1"},
+	}
+
+	tests := []struct {
+		selector string
+		expected []string
+	}{
+		{"region=us", []string{"us-east-1", "us-west-2"}},
+		{"region==us", []string{"us-east-1", "us-west-2"}},
+		{"region!=us", []string{"eu-west-1", "ap-south-1"}},
+		{"tier in (edge, api)", []string{"us-east-1", "us-west-2", "eu-west-1"}},
+		{"region notin (us)", []string{"eu-west-1", "ap-south-1"}},
+		{"canary", []string{"us-west-2"}},
+		{"!canary", []string{"us-east-1", "eu-west-1", "ap-south-1"}},
+		{"region in (us,eu), tier=edge", []string{"us-east-1", "eu-west-1"}},
+		{"region=ap", []string{}},
+	}
+	for _, test := range tests {
+		selector, err := labels.Parse(test.selector)
+		assert.NilError(t, err, test.selector)
+		assert.DeepEqual(t, test.expected, instanceNames(filterInstances(selector, instances)))
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	d := &Deploy{}
+	d.validateLabels(map[string]string{"example.com/tier": "edge", "region": ""}, originPath(originStim, 0, 0).with("labels"))
+	assert.Equal(t, len(d.config.errors), 0)
+
+	d.validateLabels(map[string]string{"bad key": "edge", "tier": "a b"}, originPath(originStim, 0, 0).with("labels"))
+	assert.Equal(t, len(d.config.errors), 2)
+}
@@ -1,38 +1,104 @@
 package deploy
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/PremiereGlobal/stim/pkg/env"
+	"github.com/PremiereGlobal/stim/pkg/shell"
 	"github.com/PremiereGlobal/stim/stim"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
-// startDeployShell starts an instance deployment using the command shell
-func (d *Deploy) startDeployShell(instance *Instance) {
+// startDeployShell starts an instance deployment using the command shell,
+// which runs the given shell command.  Output is streamed as the command
+// runs, or the command is attached to the terminal in interactive mode
+func (d *Deploy) startDeployShell(ctx context.Context, environment *Environment, instance *Instance, command string) error {
 
 	envs := make([]string, len(instance.Spec.EnvironmentVars))
 	for i, e := range instance.Spec.EnvironmentVars {
 		envs[i] = fmt.Sprintf("%s=%s", e.Name, e.Value)
 	}
+	envs = append(envs, instance.awsEnvs...)
+	envs = append(envs, instance.secretEnvs...)
 
 	d.log.Debug("Setting working directory {}", d.config.Deployment.fullDirectoryPath)
-	e := d.stim.Env(&stim.EnvConfig{
-		EnvVars: envs,
-		Kubernetes: &stim.EnvConfigKubernetes{
-			Cluster:          instance.Spec.Kubernetes.Cluster,
-			ServiceAccount:   instance.Spec.Kubernetes.ServiceAccount,
-			DefaultNamespace: "default"},
+	envConfig := &stim.EnvConfig{
+		EnvVars:    envs,
+		Kubernetes: d.envConfigKubernetes(instance),
 		Vault: &stim.EnvConfigVault{
 			SecretItems: instance.Spec.Secrets,
 		},
 		WorkDir: d.config.Deployment.fullDirectoryPath,
 		Tools:   instance.Spec.Tools,
-	})
-
-	d.log.Debug("Running script ./{}", d.config.Deployment.Script)
-	out, err := e.Run("./" + d.config.Deployment.Script)
+	}
+	e, err := d.stim.Env(envConfig)
 	if err != nil {
-		d.log.Fatal("Error running command: {}", err)
+		return err
+	}
+	defer e.Close()
+	instance.toolVersions = envConfig.ToolVersions
+
+	// Secret files are written to the environment directory, which is removed on close
+	if len(instance.Spec.SecretFiles) > 0 {
+		secretsDir := filepath.Join(e.GetPath(), "secrets")
+		defer os.RemoveAll(secretsDir)
+		secretEnvs, err := d.writeSecretFiles(instance, secretsDir)
+		if err != nil {
+			return err
+		}
+		e.AddEnvVars(secretEnvs...)
+	}
+
+	streams := env.Streams{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr, Interactive: true}
+	closeOutput := func() {}
+	if !d.interactiveShell() {
+		stdout, stderr, closeStreams, err := d.deployOutput(environment, instance)
+		if err != nil {
+			return err
+		}
+		streams = env.Streams{Stdout: stdout, Stderr: stderr}
+		closeOutput = closeStreams
+	}
+
+	d.log.Debug("Running command: {}", command)
+	d.log.Info("--- START Stim deploy - shell output ({}) ---", instance.Name)
+	err = e.RunStreams(ctx, command, streams)
+	closeOutput()
+	d.log.Info("--- END Stim deploy - shell output ({}) ---", instance.Name)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if exitErr, ok := err.(*shell.ExitError); ok {
+		return &scriptError{instance: instance.Name, exitCode: exitErr.ExitCode, detail: strings.TrimSpace(exitErr.Stderr)}
+	} else if err != nil {
+		return errors.New(fmt.Sprintf("Error running command: %v", err))
+	}
+
+	return nil
+}
+
+// interactiveShell returns true if shell deployments should be attached to
+// the terminal, which requires --tty, stim to be running in a terminal and
+// only one deployment to run at a time
+func (d *Deploy) interactiveShell() bool {
+
+	if !d.stim.ConfigGetBool("deploy.tty") {
+		return false
+	}
+
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) || !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		d.log.Debug("Not running in a terminal, ignoring --tty for shell deployments")
+		return false
+	}
+
+	if d.getParallelism() > 1 {
+		d.log.Warn("Shell deployments can not be interactive when deploying in parallel, ignoring --tty")
+		return false
 	}
 
-	d.log.Info(out)
+	return true
 }
@@ -0,0 +1,209 @@
+package deploy
+
+import (
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/PremiereGlobal/stim/stim"
+)
+
+// deploySnapshot is a record of the resolved, non-secret inputs of a
+// successful instance deployment, which is used to roll back to it
+type deploySnapshot struct {
+	DeployFile string            `json:"deployFile,omitempty"`
+	Dirty      bool              `json:"dirty,omitempty"`
+	Image      *snapshotImage    `json:"image,omitempty"`
+	Tools      map[string]string `json:"tools,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	Secrets    map[string]int    `json:"secrets,omitempty"`
+}
+
+// snapshotImage is the deploy image used by a deployment
+type snapshotImage struct {
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// makeSnapshot records the inputs of a successful instance deployment.
+// Secret values are never recorded, only the versions of key-value version 2
+// secrets.
+func (d *Deploy) makeSnapshot(instance *Instance, deployMethod int) *deploySnapshot {
+
+	snapshot := &deploySnapshot{
+		Tools:   make(map[string]string),
+		Env:     make(map[string]string),
+		Secrets: make(map[string]int),
+	}
+
+	configFile, err := filepath.Abs(d.config.configFilePath)
+	if err == nil {
+		if root, err := gitRoot(filepath.Dir(configFile)); err == nil {
+			snapshot.DeployFile, _ = relativePath(root, configFile)
+			snapshot.Dirty = gitDirty(root)
+		}
+	}
+
+	if deployMethod == DEPLOY_METHOD_DOCKER {
+		snapshot.Image = &snapshotImage{
+			Repo:   instance.container.Repo,
+			Tag:    instance.container.Tag,
+			Digest: pick(instance.imageDigest, instance.container.Digest),
+		}
+	}
+
+	for name, tool := range instance.Spec.Tools {
+		if tool.Unset {
+			continue
+		}
+		if version := pick(instance.toolVersions[name], tool.Version); version != "" {
+			snapshot.Tools[name] = version
+		}
+	}
+
+	for _, e := range instance.Spec.EnvironmentVars {
+		if instance.origins.envVar(e.Name) == originStim || e.isSecret() {
+			continue
+		}
+		snapshot.Env[e.Name] = e.Value
+	}
+
+	// Secret versions are only known if they were pinned when deploying
+	for _, s := range instance.Spec.Secrets {
+		if instance.origins.secret(s) != originStim && s.Version > 0 {
+			snapshot.Secrets[s.SecretPath] = int(s.Version)
+		}
+	}
+
+	return snapshot
+}
+
+// pinSecretVersions sets the version of each key-value version 2 secret of
+// the instance to the version that will be read, so that the versions recorded
+// in the deploy snapshot are the ones used.  Secrets whose version can't be
+// determined (ex. without access to the secret metadata) are left as they are.
+func (d *Deploy) pinSecretVersions(instance *Instance) {
+
+	pinned := false
+	for _, s := range instance.Spec.Secrets {
+		if instance.origins.secret(s) == originStim {
+			continue
+		}
+		version, err := d.stim.Vault().ResolveKVVersion(s.SecretPath, int(s.Version))
+		if err != nil {
+			d.log.Debug("Unable to determine the version of secret '{}' for '{}': {}", s.SecretPath, instance.Name, err)
+			continue
+		}
+		if version > 0 && float64(version) != s.Version {
+			s.Version = float64(version)
+			pinned = true
+		}
+	}
+
+	if pinned {
+		d.updateSecretConfig(instance)
+	}
+}
+
+// applySnapshot sets the inputs recorded in the snapshot on the instance, so
+// that it is deployed the same way as the snapshot's deployment
+func (d *Deploy) applySnapshot(instance *Instance, snapshot *deploySnapshot) {
+
+	names := make(map[string]bool)
+	for _, e := range instance.Spec.EnvironmentVars {
+		names[e.Name] = true
+		if value, ok := snapshot.Env[e.Name]; ok && instance.origins.envVar(e.Name) != originStim {
+			e.Value = value
+			instance.undefer(&e.Value)
+			if e.ValueFrom != nil && instance.resolver != nil {
+				e.resolved = true
+				instance.resolver.setValue(e.Name, value)
+			}
+		}
+	}
+	missing := []string{}
+	for name := range snapshot.Env {
+		if !names[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		instance.Spec.EnvironmentVars = append(instance.Spec.EnvironmentVars, &EnvironmentVar{Name: name, Value: snapshot.Env[name], resolved: true})
+		instance.origins.envVars[name] = itemOrigin{level: originInstance, source: "rollback"}
+	}
+
+	tools := make(map[string]stim.EnvTool)
+	for name, tool := range instance.Spec.Tools {
+		tools[name] = tool
+	}
+	for name, version := range snapshot.Tools {
+		tools[name] = stim.EnvTool{Version: version}
+	}
+	instance.Spec.Tools = tools
+
+	// Secret paths may reference valueFrom values from the snapshot
+	if instance.resolver != nil {
+		if err := instance.resolveDeferred(); err != nil {
+			d.log.Warn("Unable to expand the config of '{}' with the snapshot values: {}", instance.Name, err)
+		}
+	}
+
+	for _, s := range instance.Spec.Secrets {
+		if version, ok := snapshot.Secrets[s.SecretPath]; ok && instance.origins.secret(s) != originStim {
+			s.Version = float64(version)
+		}
+	}
+	d.updateSecretConfig(instance)
+
+	if snapshot.Image != nil {
+		instance.container.Repo = snapshot.Image.Repo
+		instance.container.Tag = snapshot.Image.Tag
+		instance.undefer(&instance.container.Tag)
+		instance.container.Digest = snapshot.Image.Digest
+	}
+}
+
+// updateSecretConfig regenerates the SECRET_CONFIG environment variable after
+// the secrets of the instance have been changed
+func (d *Deploy) updateSecretConfig(instance *Instance) {
+	secretConfig, _ := d.makeSecretConfig(instance)
+	for _, e := range instance.Spec.EnvironmentVars {
+		if e.Name == "SECRET_CONFIG" {
+			e.Value = secretConfig
+		}
+	}
+}
+
+// gitRoot returns the top-level directory of the git repo containing dir
+func gitRoot(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitDirty returns true if the git repo has uncommitted changes
+func gitDirty(dir string) bool {
+	cmd := exec.Command("git", "status", "--porcelain")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	return err == nil && strings.TrimSpace(string(out)) != ""
+}
+
+// relativePath returns the path of target relative to base, resolving any
+// symlinks first as git reports the resolved repo path
+func relativePath(base string, target string) (string, error) {
+	if resolved, err := filepath.EvalSymlinks(base); err == nil {
+		base = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	}
+	return filepath.Rel(base, target)
+}
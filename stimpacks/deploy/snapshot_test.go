@@ -0,0 +1,61 @@
+package deploy
+
+import (
+	"testing"
+
+	"github.com/PremiereGlobal/stim/stim"
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	"gotest.tools/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	secret := &v2e.SecretItem{SecretPath: "secret/app", Version: 3, SecretMaps: map[string]string{"PASSWORD": "password"}}
+	kubeSecret := &v2e.SecretItem{SecretPath: "secret/kube", SecretMaps: map[string]string{"USER_TOKEN": "user-token"}}
+	instance := &Instance{
+		Name: "us-east",
+		Spec: &Spec{
+			Tools: map[string]stim.EnvTool{"helm": {Version: "3.1"}, "kubectl": {}, "vault": {Unset: true}},
+			EnvironmentVars: []*EnvironmentVar{
+				{Name: "REPLICAS", Value: "3"},
+				{Name: "API_KEY", Value: "abc", ValueFrom: &ValueFrom{Vault: &VaultKeySource{Path: "secret/api", Key: "key"}}},
+				{Name: "VAULT_TOKEN", Value: "s.token"},
+				{Name: "SECRET_CONFIG", Value: ""},
+			},
+			Secrets: []*v2e.SecretItem{secret, kubeSecret},
+		},
+		container:    Container{Repo: "premiereglobal/kube-vault-deploy", Tag: "0.4.0"},
+		toolVersions: map[string]string{"kubectl": "1.17.4"},
+		imageDigest:  "sha256:abc",
+	}
+	instance.origins = newSpecOrigins()
+	instance.origins.add(&Spec{EnvironmentVars: instance.Spec.EnvironmentVars[:2], Secrets: []*v2e.SecretItem{secret}}, originInstance)
+
+	d := &Deploy{}
+	snapshot := d.makeSnapshot(instance, DEPLOY_METHOD_DOCKER)
+	assert.DeepEqual(t, map[string]string{"REPLICAS": "3"}, snapshot.Env)
+	assert.DeepEqual(t, map[string]string{"helm": "3.1", "kubectl": "1.17.4"}, snapshot.Tools)
+	assert.DeepEqual(t, map[string]int{"secret/app": 3}, snapshot.Secrets)
+	assert.DeepEqual(t, &snapshotImage{Repo: "premiereglobal/kube-vault-deploy", Tag: "0.4.0", Digest: "sha256:abc"}, snapshot.Image)
+
+	// Roll back to different inputs
+	snapshot = &deploySnapshot{
+		Env:     map[string]string{"REPLICAS": "2", "REGION": "us", "VAULT_TOKEN": "old"},
+		Tools:   map[string]string{"helm": "3.0"},
+		Secrets: map[string]int{"secret/app": 2, "secret/kube": 1},
+		Image:   &snapshotImage{Repo: "premiereglobal/kube-vault-deploy", Digest: "sha256:def"},
+	}
+	d.applySnapshot(instance, snapshot)
+
+	env := map[string]string{}
+	for _, e := range instance.Spec.EnvironmentVars {
+		env[e.Name] = e.Value
+	}
+	assert.Equal(t, "2", env["REPLICAS"], "Values not Equal")
+	assert.Equal(t, "us", env["REGION"], "Values not Equal")
+	assert.Equal(t, "s.token", env["VAULT_TOKEN"], "Values not Equal")
+	assert.Assert(t, env["SECRET_CONFIG"] != "")
+	assert.Equal(t, "3.0", instance.Spec.Tools["helm"].Version, "Values not Equal")
+	assert.Equal(t, float64(2), secret.Version, "Values not Equal")
+	assert.Equal(t, float64(0), kubeSecret.Version, "Values not Equal")
+	assert.Equal(t, "premiereglobal/kube-vault-deploy@sha256:def", d.containerImage(instance), "Values not Equal")
+}
@@ -0,0 +1,125 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+)
+
+// validationResult is the machine-readable result of validating a deployment config
+type validationResult struct {
+	File   string         `json:"file"`
+	Valid  bool           `json:"valid"`
+	Errors []*configError `json:"errors"`
+}
+
+// Validate is the entrypoint to the "deploy validate" command
+// It reports all problems found in the deployment config and exits non-zero
+// if there are any
+func (d *Deploy) Validate() {
+
+	d.log = d.stim.GetLogger()
+
+	output := d.stim.ConfigGetString("deploy.validate.output")
+	if !utils.Contains([]string{"table", "json"}, output) {
+		d.log.Fatal("Invalid output format '{}'.  Must be one of ['table','json']", output)
+	}
+
+	if d.stim.ConfigGetBool("deploy.validate.schema") {
+		d.writeJSON(configSchema())
+		return
+	}
+
+	d.loadConfig(true)
+
+	// Only check secret access if the config itself is valid as the secret
+	// paths may depend on values with errors
+	if len(d.config.errors) == 0 && !d.stim.ConfigGetBool("deploy.validate.skip-vault") {
+		d.checkSecretAccess()
+	}
+
+	result := &validationResult{
+		File:   d.config.configFilePath,
+		Valid:  len(d.config.errors) == 0,
+		Errors: d.config.errors,
+	}
+	if result.Errors == nil {
+		result.Errors = []*configError{}
+	}
+
+	if output == "json" {
+		d.writeJSON(result)
+	} else {
+		for _, err := range result.Errors {
+			fmt.Println(err)
+		}
+		if result.Valid {
+			fmt.Printf("%s is valid\n", result.File)
+		} else {
+			fmt.Printf("\nFound %d error(s) in %s\n", len(result.Errors), result.File)
+		}
+	}
+
+	if !result.Valid {
+		os.Exit(1)
+	}
+}
+
+// checkSecretAccess ensures the current Vault token can read every secret
+// path used by the deployment config
+func (d *Deploy) checkSecretAccess() {
+
+	vault := d.stim.Vault()
+
+	// Map each API path to be checked back to the config which requires it
+	type secretUse struct {
+		secretPath string
+		path       configPath
+	}
+	uses := make(map[string]secretUse)
+	var apiPaths []string
+
+	for i, environment := range d.config.Environments {
+		for j, instance := range environment.Instances {
+			for _, s := range instance.Spec.Secrets {
+				// Paths referencing valueFrom values are only known when deploying
+				if instance.resolver != nil && instance.resolver.deferredReference(s.SecretPath) {
+					continue
+				}
+				apiPath, err := vault.SecretDataPath(s.SecretPath)
+				if err != nil {
+					d.log.Fatal("Error looking up Vault mounts: {}", err)
+				}
+				if _, ok := uses[apiPath]; ok {
+					continue
+				}
+				uses[apiPath] = secretUse{secretPath: s.SecretPath, path: originPath(instance.origins.secret(s), i, j).with("secrets")}
+				apiPaths = append(apiPaths, apiPath)
+			}
+		}
+	}
+
+	readable, err := vault.Filter(apiPaths, []string{"read", "root"})
+	if err != nil {
+		d.log.Fatal("Error checking Vault token capabilities: {}", err)
+	}
+
+	for _, apiPath := range apiPaths {
+		if !utils.Contains(readable, apiPath) {
+			use := uses[apiPath]
+			d.addConfigError(use.path, "Secret path '%s' is not readable with the current Vault token", use.secretPath)
+		}
+	}
+}
+
+// writeJSON writes the given value to stdout as indented JSON
+func (d *Deploy) writeJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		d.log.Fatal("Error writing JSON output: {}", err)
+	}
+}
@@ -0,0 +1,244 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/PremiereGlobal/stim/pkg/utils"
+)
+
+// Git attributes of the deployment directory which can be used as values
+const (
+	gitAttrCommit      = "commit"
+	gitAttrShortCommit = "shortCommit"
+	gitAttrBranch      = "branch"
+	gitAttrTag         = "tag"
+	gitAttrDirty       = "dirty"
+)
+
+// ValueFrom describes where the value of an environment variable is read
+// from.  Exactly one source must be set.
+type ValueFrom struct {
+	File    string          `yaml:"file"`
+	Command string          `yaml:"command"`
+	Git     string          `yaml:"git"`
+	Env     *EnvValueSource `yaml:"env"`
+	Vault   *VaultKeySource `yaml:"vault"`
+}
+
+// EnvValueSource reads a value from an environment variable of stim
+type EnvValueSource struct {
+	Name    string  `yaml:"name"`
+	Default *string `yaml:"default"`
+}
+
+// VaultKeySource reads a value from a single key of a Vault secret
+type VaultKeySource struct {
+	Path string `yaml:"path"`
+	Key  string `yaml:"key"`
+}
+
+// sources returns the names of the sources which are set
+func (v *ValueFrom) sources() []string {
+	var sources []string
+	if v.File != "" {
+		sources = append(sources, "file")
+	}
+	if v.Command != "" {
+		sources = append(sources, "command")
+	}
+	if v.Git != "" {
+		sources = append(sources, "git")
+	}
+	if v.Env != nil {
+		sources = append(sources, "env")
+	}
+	if v.Vault != nil {
+		sources = append(sources, "vault")
+	}
+	return sources
+}
+
+// isSecret returns true if the value is read from Vault and should not be shown
+func (v *ValueFrom) isSecret() bool {
+	return v != nil && v.Vault != nil
+}
+
+// describe describes the source for plans, as values are only read when
+// deploying
+func (v *ValueFrom) describe() string {
+	switch {
+	case v.File != "":
+		return fmt.Sprintf("<file %s>", v.File)
+	case v.Command != "":
+		return fmt.Sprintf("<output of '%s'>", v.Command)
+	case v.Git != "":
+		return fmt.Sprintf("<git %s>", v.Git)
+	case v.Env != nil:
+		return fmt.Sprintf("<env %s>", v.Env.Name)
+	case v.Vault != nil:
+		return fmt.Sprintf("<vault %s:%s>", v.Vault.Path, v.Vault.Key)
+	}
+	return ""
+}
+
+// validateEnvVars ensures the environment variables of a spec are valid
+func (d *Deploy) validateEnvVars(envVars []*EnvironmentVar, envPath configPath) {
+
+	for k, e := range envVars {
+		if e.ValueFrom == nil {
+			continue
+		}
+		valueFromPath := envPath.with(k, "valueFrom")
+		if e.Value != "" {
+			d.addConfigError(envPath.with(k), "Environment variable '%s' can not have both a value and valueFrom", e.Name)
+		}
+		if sources := e.ValueFrom.sources(); len(sources) != 1 {
+			d.addConfigError(valueFromPath, "Environment variable '%s' valueFrom must have exactly one of ['file','command','git','env','vault']", e.Name)
+		}
+		if e.ValueFrom.Git != "" && !utils.Contains([]string{gitAttrCommit, gitAttrShortCommit, gitAttrBranch, gitAttrTag, gitAttrDirty}, e.ValueFrom.Git) {
+			d.addConfigError(valueFromPath.with("git"), "Invalid git attribute '%s'. Must be one of ['commit','shortCommit','branch','tag','dirty']", e.ValueFrom.Git)
+		}
+		if e.ValueFrom.Env != nil && e.ValueFrom.Env.Name == "" {
+			d.addConfigError(valueFromPath.with("env", "name"), "Environment variable name is required")
+		}
+		if e.ValueFrom.Vault != nil && (e.ValueFrom.Vault.Path == "" || e.ValueFrom.Vault.Key == "") {
+			d.addConfigError(valueFromPath.with("vault"), "Vault path and key are required")
+		}
+	}
+}
+
+// resolveValueFrom reads the value of each environment variable of the
+// instance which uses valueFrom and expands the config values referencing them.
+// It is only called for the instances being deployed.
+func (d *Deploy) resolveValueFrom(instance *Instance) error {
+
+	if instance.resolver == nil {
+		return nil
+	}
+
+	for _, e := range instance.Spec.EnvironmentVars {
+		if e.ValueFrom == nil || e.resolved {
+			continue
+		}
+
+		d.log.Debug("Reading the value of environment variable '{}' for '{}'", e.Name, instance.Name)
+		value, err := d.readValueFrom(e.ValueFrom)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to read the value of environment variable '%s': %v", e.Name, err))
+		}
+		e.Value = value
+		e.resolved = true
+		instance.resolver.setValue(e.Name, value)
+	}
+
+	if err := instance.resolveDeferred(); err != nil {
+		return err
+	}
+
+	// Secret paths may have referenced valueFrom variables
+	d.updateSecretConfig(instance)
+
+	return nil
+}
+
+// readValueFrom reads the value from the source
+func (d *Deploy) readValueFrom(valueFrom *ValueFrom) (string, error) {
+
+	dir := d.config.Deployment.fullDirectoryPath
+
+	switch {
+	case valueFrom.File != "":
+		file := valueFrom.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+
+	case valueFrom.Command != "":
+		cmd := exec.Command("/bin/sh", "-c", valueFrom.Command)
+		cmd.Dir = dir
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Command '%s' failed. %v", valueFrom.Command, err))
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+
+	case valueFrom.Git != "":
+		return gitAttribute(dir, valueFrom.Git)
+
+	case valueFrom.Env != nil:
+		if value, ok := os.LookupEnv(valueFrom.Env.Name); ok {
+			return value, nil
+		}
+		if valueFrom.Env.Default != nil {
+			return *valueFrom.Env.Default, nil
+		}
+		return "", errors.New(fmt.Sprintf("Environment variable '%s' is not set and has no default", valueFrom.Env.Name))
+
+	case valueFrom.Vault != nil:
+		secret, err := d.stim.Vault().ReadKV(valueFrom.Vault.Path)
+		if err != nil {
+			return "", err
+		}
+		value, ok := secret[valueFrom.Vault.Key]
+		if !ok {
+			return "", errors.New(fmt.Sprintf("Key '%s' not found in Vault secret '%s'", valueFrom.Vault.Key, valueFrom.Vault.Path))
+		}
+		return fmt.Sprintf("%v", value), nil
+	}
+
+	return "", nil
+}
+
+// gitAttribute returns an attribute of the git repository of the given directory
+func gitAttribute(dir string, attribute string) (string, error) {
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Unable to read git %s of '%s'. %v", attribute, dir, err))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	switch attribute {
+	case gitAttrCommit:
+		return git("rev-parse", "HEAD")
+	case gitAttrShortCommit:
+		return git("rev-parse", "--short", "HEAD")
+	case gitAttrBranch:
+		return git("rev-parse", "--abbrev-ref", "HEAD")
+	case gitAttrTag:
+		// Commits without a tag have an empty tag
+		tag, err := git("describe", "--tags", "--exact-match", "HEAD")
+		if err != nil {
+			if _, err := git("rev-parse", "HEAD"); err != nil {
+				return "", err
+			}
+			return "", nil
+		}
+		return tag, nil
+	case gitAttrDirty:
+		status, err := git("status", "--porcelain")
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(status != ""), nil
+	}
+
+	return "", errors.New(fmt.Sprintf("Unknown git attribute '%s'", attribute))
+}
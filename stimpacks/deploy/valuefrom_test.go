@@ -0,0 +1,85 @@
+package deploy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PremiereGlobal/stim/stim"
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	"gotest.tools/assert"
+)
+
+func TestReadValueFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stim-deploy")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte("1.2.3\n"), 0644))
+
+	d := &Deploy{}
+	d.config.Deployment.fullDirectoryPath = dir
+
+	value, err := d.readValueFrom(&ValueFrom{File: "VERSION"})
+	assert.NilError(t, err)
+	assert.Equal(t, "1.2.3", value, "Values not Equal")
+
+	value, err = d.readValueFrom(&ValueFrom{Command: "cat VERSION | cut -d. -f1"})
+	assert.NilError(t, err)
+	assert.Equal(t, "1", value, "Values not Equal")
+
+	os.Setenv("STIM_TEST_VALUE_FROM", "set")
+	defer os.Unsetenv("STIM_TEST_VALUE_FROM")
+	value, err = d.readValueFrom(&ValueFrom{Env: &EnvValueSource{Name: "STIM_TEST_VALUE_FROM"}})
+	assert.NilError(t, err)
+	assert.Equal(t, "set", value, "Values not Equal")
+
+	fallback := "fallback"
+	value, err = d.readValueFrom(&ValueFrom{Env: &EnvValueSource{Name: "STIM_TEST_VALUE_FROM_UNSET", Default: &fallback}})
+	assert.NilError(t, err)
+	assert.Equal(t, "fallback", value, "Values not Equal")
+
+	_, err = d.readValueFrom(&ValueFrom{Env: &EnvValueSource{Name: "STIM_TEST_VALUE_FROM_UNSET"}})
+	assert.ErrorContains(t, err, "is not set and has no default")
+}
+
+func TestResolveValueFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stim-deploy")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte("1.2.3\n"), 0644))
+
+	instance := &Instance{
+		Name: "us-east",
+		Spec: &Spec{
+			Kubernetes: Kubernetes{Cluster: "prod-us-east"},
+			EnvironmentVars: []*EnvironmentVar{
+				{Name: "VERSION", ValueFrom: &ValueFrom{File: "VERSION"}},
+				{Name: "RELEASE", Value: "app-${VERSION}"},
+			},
+			Secrets: []*v2e.SecretItem{{SecretPath: "secret/${RELEASE}"}},
+		},
+		origins: newSpecOrigins(),
+	}
+	instance.origins.add(instance.Spec, originInstance)
+
+	d := &Deploy{stim: stim.New()}
+	d.log = d.stim.GetLogger()
+	d.config.Deployment.fullDirectoryPath = dir
+	d.interpolateInstance(&Environment{Name: "prod"}, instance, 0, 0)
+	assert.Equal(t, len(d.config.errors), 0)
+
+	// Values are not read until the instance is deployed
+	assert.Equal(t, "app-${VERSION}", instance.Spec.EnvironmentVars[1].Value, "Values not Equal")
+	assert.Equal(t, "secret/${RELEASE}", instance.Spec.Secrets[0].SecretPath, "Values not Equal")
+
+	assert.NilError(t, d.resolveValueFrom(instance))
+	assert.Equal(t, "1.2.3", instance.Spec.EnvironmentVars[0].Value, "Values not Equal")
+	assert.Equal(t, "app-1.2.3", instance.Spec.EnvironmentVars[1].Value, "Values not Equal")
+	assert.Equal(t, "secret/app-1.2.3", instance.Spec.Secrets[0].SecretPath, "Values not Equal")
+
+	// Read errors fail the deployment of the instance
+	instance.Spec.EnvironmentVars = []*EnvironmentVar{{Name: "MISSING", ValueFrom: &ValueFrom{File: "MISSING"}}}
+	d.interpolateInstance(&Environment{Name: "prod"}, instance, 0, 0)
+	assert.ErrorContains(t, d.resolveValueFrom(instance), "Unable to read the value of environment variable 'MISSING'")
+}
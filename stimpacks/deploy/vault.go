@@ -1,7 +1,16 @@
 package deploy
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/PremiereGlobal/stim/pkg/aws"
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	"github.com/hashicorp/vault/api"
 )
 
 // makeSecretConfig generates a secret config json string based on the instance configuration
@@ -21,3 +30,104 @@ func (d *Deploy) makeSecretConfig(instance *Instance) (string, error) {
 
 	return secretConfigString, nil
 }
+
+// resolveLeasedSecrets reads the instance secrets which are not in a
+// key-value mount (ex. database or AWS credentials) so that their Vault leases
+// are revoked at the end of the deployment run.  Their values are passed to the
+// deployment as environment variables and they are removed from SECRET_CONFIG
+// so they are not read again.
+func (d *Deploy) resolveLeasedSecrets(ctx context.Context, instance *Instance) error {
+
+	keep := []*v2e.SecretItem{}
+	for _, s := range instance.Spec.Secrets {
+		mountType, err := d.stim.Vault().MountType(s.SecretPath)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to determine the mount of secret '%s' for '%s'. %v", s.SecretPath, instance.Name, err))
+		}
+		if mountType == "" || mountType == "kv" || mountType == "generic" {
+			keep = append(keep, s)
+			continue
+		}
+
+		secret, err := d.stim.Vault().GetSecret(s.SecretPath)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to read secret '%s' for '%s'. %v", s.SecretPath, instance.Name, err))
+		}
+		envs, err := d.leasedSecretEnvs(s, secret)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to read secret '%s' for '%s'. %v", s.SecretPath, instance.Name, err))
+		}
+
+		if s.TTL != 0 {
+			if !secret.Renewable {
+				return errors.New(fmt.Sprintf("Cannot set the TTL of secret '%s' as its lease is not renewable", s.SecretPath))
+			}
+			if _, err := d.stim.Vault().RenewLease(secret.LeaseID, time.Duration(s.TTL)*time.Second); err != nil {
+				return errors.New(fmt.Sprintf("Unable to renew the lease of secret '%s' for '%s'. %v", s.SecretPath, instance.Name, err))
+			}
+		}
+
+		// IAM user credentials take a moment to become active
+		if mountType == "aws" {
+			if err := d.waitForLeasedAWSCredentials(ctx, secret); err != nil {
+				return errors.New(fmt.Sprintf("AWS credentials from secret '%s' did not become active. %v", s.SecretPath, err))
+			}
+		}
+
+		instance.secretEnvs = append(instance.secretEnvs, envs...)
+	}
+
+	if len(keep) != len(instance.Spec.Secrets) {
+		instance.Spec.Secrets = keep
+		d.updateSecretConfig(instance)
+	}
+
+	return nil
+}
+
+// leasedSecretEnvs tracks the lease of a secret read for a deployment and
+// returns the environment variables set from it by the secret config
+func (d *Deploy) leasedSecretEnvs(item *v2e.SecretItem, secret *api.Secret) ([]string, error) {
+
+	if secret == nil {
+		return nil, errors.New("Secret not found")
+	}
+	if secret.LeaseID != "" {
+		d.trackLease(secret.LeaseID)
+	}
+
+	names := make([]string, 0, len(item.SecretMaps))
+	for name := range item.SecretMaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	envs := make([]string, len(names))
+	for i, name := range names {
+		value, ok := secret.Data[item.SecretMaps[name]].(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Key '%s' not found in secret", item.SecretMaps[name]))
+		}
+		envs[i] = fmt.Sprintf("%s=%s", name, value)
+	}
+
+	return envs, nil
+}
+
+// waitForLeasedAWSCredentials waits for AWS credentials from a Vault AWS
+// secrets engine to become active.  STS credentials are active immediately.
+func (d *Deploy) waitForLeasedAWSCredentials(ctx context.Context, secret *api.Secret) error {
+
+	accessKey, _ := secret.Data["access_key"].(string)
+	secretKey, _ := secret.Data["secret_key"].(string)
+	sessionToken, _ := secret.Data["security_token"].(string)
+	if sessionToken != "" {
+		return nil
+	}
+
+	a, err := aws.New(&aws.Config{AccessKey: accessKey, SecretKey: secretKey, Region: defaultAWSRegion, Log: d.stim.GetLogger()})
+	if err != nil {
+		return err
+	}
+	return a.WaitForActiveCredsContext(ctx)
+}
@@ -0,0 +1,29 @@
+package deploy
+
+import (
+	"testing"
+
+	v2e "github.com/PremiereGlobal/vault-to-envs/pkg/vaulttoenvs"
+	"github.com/hashicorp/vault/api"
+	"gotest.tools/assert"
+)
+
+func TestLeasedSecretEnvs(t *testing.T) {
+	d := &Deploy{}
+	item := &v2e.SecretItem{SecretPath: "database/creds/app", SecretMaps: map[string]string{"DB_USER": "username", "DB_PASSWORD": "password"}}
+	secret := &api.Secret{LeaseID: "database/creds/app/abc123", Data: map[string]interface{}{"username": "v-app", "password": "hunter2"}}
+
+	envs, err := d.leasedSecretEnvs(item, secret)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"DB_PASSWORD=hunter2", "DB_USER=v-app"}, envs)
+	assert.DeepEqual(t, []string{"database/creds/app/abc123"}, d.leases.ids)
+
+	// The lease is tracked even if the secret can't be used, so it is still revoked
+	item.SecretMaps["DB_HOST"] = "host"
+	_, err = d.leasedSecretEnvs(item, &api.Secret{LeaseID: "database/creds/app/def456", Data: secret.Data})
+	assert.ErrorContains(t, err, "Key 'host' not found")
+	assert.DeepEqual(t, []string{"database/creds/app/abc123", "database/creds/app/def456"}, d.leases.ids)
+
+	_, err = d.leasedSecretEnvs(item, nil)
+	assert.ErrorContains(t, err, "Secret not found")
+}
@@ -0,0 +1,254 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PremiereGlobal/stim/pkg/kubernetes"
+	"github.com/PremiereGlobal/stim/pkg/utils"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// defaultVerifyTimeout is how long to wait for rollouts to complete when
+	// the verify timeout is not set
+	defaultVerifyTimeout = 5 * time.Minute
+
+	// defaultNamespace is used when neither the verify resource nor the
+	// kubeconfig context set a namespace
+	defaultNamespace = "default"
+)
+
+// verifyPollInterval is how often the rollout status is checked
+var verifyPollInterval = 2 * time.Second
+
+// Verify describes the Kubernetes workloads whose rollout is checked after the
+// deployment script succeeds
+type Verify struct {
+	Timeout   string            `yaml:"timeout" json:"timeout,omitempty"`
+	Resources []*VerifyResource `yaml:"resources" json:"resources"`
+}
+
+// VerifyResource selects the workloads of a kind, either by name or by label
+// selector
+type VerifyResource struct {
+	Kind      string `yaml:"kind" json:"kind"`
+	Name      string `yaml:"name" json:"name,omitempty"`
+	Selector  string `yaml:"selector" json:"selector,omitempty"`
+	Namespace string `yaml:"namespace" json:"namespace,omitempty"`
+}
+
+// String describes the resource for log messages
+func (r *VerifyResource) String() string {
+	namespace := pick(r.Namespace, "<default>")
+	if r.Name != "" {
+		return fmt.Sprintf("%s %s/%s", r.Kind, namespace, r.Name)
+	}
+	return fmt.Sprintf("%s %s/[%s]", r.Kind, namespace, r.Selector)
+}
+
+// verifyError is returned when the deployment script succeeded but the
+// rollout of the verified workloads did not complete
+type verifyError struct {
+	instance string
+	message  string
+}
+
+// Error implements the error interface
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("Rollout verification for '%s' failed. %s", e.instance, e.message)
+}
+
+// validateVerify ensures the verify config is valid.  Selectors are validated
+// after variable references are expanded.
+func (d *Deploy) validateVerify(verify *Verify, verifyPath configPath) {
+
+	if verify == nil {
+		return
+	}
+
+	if verify.Timeout != "" {
+		if timeout, err := time.ParseDuration(verify.Timeout); err != nil || timeout <= 0 {
+			d.addConfigError(verifyPath.with("timeout"), "Invalid verify timeout '%s'. Must be a positive duration (ex. 5m)", verify.Timeout)
+		}
+	}
+	if len(verify.Resources) == 0 {
+		d.addConfigError(verifyPath.with("resources"), "At least one resource to verify is required")
+	}
+	for i, r := range verify.Resources {
+		resourcePath := verifyPath.with("resources", i)
+		if !utils.Contains(kubernetes.WorkloadKinds, r.Kind) {
+			d.addConfigError(resourcePath.with("kind"), "Invalid kind '%s'. Must be one of %s", r.Kind, strings.Join(kubernetes.WorkloadKinds, ", "))
+		}
+		if (r.Name == "") == (r.Selector == "") {
+			d.addConfigError(resourcePath, "Exactly one of name or selector is required")
+		}
+	}
+}
+
+// interpolateVerify expands variable references in the verify config of the
+// instance, which is copied as it may be shared with other instances
+func (d *Deploy) interpolateVerify(instance *Instance, environmentIndex int, instanceIndex int) {
+
+	if instance.Spec.Verify == nil {
+		return
+	}
+
+	verifyPath := originPath(originStim, environmentIndex, instanceIndex).with("verify")
+	verify := &Verify{Timeout: instance.Spec.Verify.Timeout, Resources: make([]*VerifyResource, len(instance.Spec.Verify.Resources))}
+	for k, r := range instance.Spec.Verify.Resources {
+		resource := *r
+		selectorDeferred := false
+		for _, field := range []*string{&resource.Name, &resource.Selector, &resource.Namespace} {
+			deferred, err := instance.interpolate(field, true)
+			if err != nil {
+				d.addConfigError(verifyPath.with("resources", k), "Error in verify resource: %v", err)
+			}
+			selectorDeferred = selectorDeferred || (deferred && field == &resource.Selector)
+		}
+		if resource.Selector != "" && !selectorDeferred {
+			if _, err := labels.Parse(resource.Selector); err != nil {
+				d.addConfigError(verifyPath.with("resources", k, "selector"), "Invalid selector '%s'. %v", resource.Selector, err)
+			}
+		}
+		verify.Resources[k] = &resource
+	}
+	instance.Spec.Verify = verify
+}
+
+// verifyRollout waits for the rollout of the workloads in the verify config of
+// the instance to complete.  If a rollout fails or does not complete before the
+// verify timeout, the container statuses and events of the pods that are not
+// ready are logged.
+func (d *Deploy) verifyRollout(ctx context.Context, instance *Instance) error {
+
+	verify := instance.Spec.Verify
+	if verify == nil {
+		return nil
+	}
+
+	kubeDir, err := ioutil.TempDir("", "stim-kube")
+	if err != nil {
+		return &verifyError{instance: instance.Name, message: fmt.Sprintf("Unable to create kubeconfig directory. %v", err)}
+	}
+	defer os.RemoveAll(kubeDir)
+	kc, err := d.stim.KubeConfig(filepath.Join(kubeDir, "kubeconfig"), d.envConfigKubernetes(instance))
+	if err != nil {
+		return &verifyError{instance: instance.Name, message: err.Error()}
+	}
+	k, err := kubernetes.New(kc)
+	if err != nil {
+		return &verifyError{instance: instance.Name, message: fmt.Sprintf("Unable to load kubeconfig. %v", err)}
+	}
+	namespace, err := kc.Namespace()
+	if err != nil || namespace == "" {
+		namespace = defaultNamespace
+	}
+
+	timeout := defaultVerifyTimeout
+	if verify.Timeout != "" {
+		timeout, _ = time.ParseDuration(verify.Timeout)
+	}
+	verifyCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	d.log.Info("Verifying rollout for '{}' (timeout {})", instance.Name, timeout)
+
+	messages := make(map[string]string)
+	for {
+		statuses, pending, failed := d.rolloutStatuses(k, verify.Resources, namespace)
+
+		// Only log progress when it changes
+		for _, s := range statuses {
+			if messages[s.String()] != s.Message {
+				messages[s.String()] = s.Message
+				d.log.Info("{}: {}", s, s.Message)
+			}
+		}
+
+		if len(failed) > 0 {
+			d.logDiagnostics(k, failed)
+			return &verifyError{instance: instance.Name, message: fmt.Sprintf("Rollout of %s failed", describeStatuses(failed))}
+		}
+		if len(pending) == 0 {
+			d.log.Info("Rollout verified for '{}'", instance.Name)
+			return nil
+		}
+
+		select {
+		case <-verifyCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			notDone := []*kubernetes.RolloutStatus{}
+			for _, s := range statuses {
+				if !s.Done {
+					notDone = append(notDone, s)
+				}
+			}
+			d.logDiagnostics(k, notDone)
+			return &verifyError{instance: instance.Name, message: fmt.Sprintf("Timed out after %s waiting for %s", timeout, strings.Join(pending, ", "))}
+		case <-time.After(verifyPollInterval):
+		}
+	}
+}
+
+// rolloutStatuses returns the rollout status of the verified workloads, a
+// description of each workload that has not completed its rollout (or was not
+// found) and the statuses of the rollouts which have failed
+func (d *Deploy) rolloutStatuses(k *kubernetes.Kubernetes, resources []*VerifyResource, namespace string) ([]*kubernetes.RolloutStatus, []string, []*kubernetes.RolloutStatus) {
+
+	statuses := []*kubernetes.RolloutStatus{}
+	pending := []string{}
+	failed := []*kubernetes.RolloutStatus{}
+
+	for _, r := range resources {
+		resourceStatuses, err := k.RolloutStatuses(r.Kind, pick(r.Namespace, namespace), r.Name, r.Selector)
+		if err != nil {
+			d.log.Debug("Unable to get the rollout status of {}: {}", r, err)
+			pending = append(pending, r.String())
+			continue
+		}
+		if len(resourceStatuses) == 0 {
+			d.log.Debug("No {} found", r)
+			pending = append(pending, r.String())
+			continue
+		}
+		for _, s := range resourceStatuses {
+			statuses = append(statuses, s)
+			if s.Failed {
+				failed = append(failed, s)
+			} else if !s.Done {
+				pending = append(pending, s.String())
+			}
+		}
+	}
+
+	return statuses, pending, failed
+}
+
+// logDiagnostics logs the pod diagnostics of the given workloads
+func (d *Deploy) logDiagnostics(k *kubernetes.Kubernetes, statuses []*kubernetes.RolloutStatus) {
+	for _, s := range statuses {
+		diagnostics, err := k.PodDiagnostics(s)
+		if err != nil {
+			d.log.Warn("Unable to get pod diagnostics for {}: {}", s, err)
+			continue
+		}
+		d.log.Warn("Rollout of {} did not complete:\n{}", s, strings.TrimRight(diagnostics, "\n"))
+	}
+}
+
+// describeStatuses returns a comma separated list of the workloads
+func describeStatuses(statuses []*kubernetes.RolloutStatus) string {
+	names := make([]string, len(statuses))
+	for i, s := range statuses {
+		names[i] = s.String()
+	}
+	return strings.Join(names, ", ")
+}
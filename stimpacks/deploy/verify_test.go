@@ -0,0 +1,41 @@
+package deploy
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestValidateVerify(t *testing.T) {
+	d := &Deploy{}
+	d.validateVerify(&Verify{
+		Timeout: "5x",
+		Resources: []*VerifyResource{
+			{Kind: "Deployment", Name: "api"},
+			{Kind: "DaemonSet", Selector: "app=agent", Namespace: "monitoring"},
+			{Kind: "ReplicaSet", Name: "api"},
+			{Kind: "StatefulSet", Name: "db", Selector: "app=db"},
+		},
+	}, configPath{"spec", "verify"})
+
+	messages := make([]string, len(d.config.errors))
+	for i, err := range d.config.errors {
+		messages[i] = err.Path + ": " + err.Message
+	}
+	assert.DeepEqual(t, []string{
+		"spec.verify.timeout: Invalid verify timeout '5x'. Must be a positive duration (ex. 5m)",
+		"spec.verify.resources[2].kind: Invalid kind 'ReplicaSet'. Must be one of Deployment, StatefulSet, DaemonSet",
+		"spec.verify.resources[3]: Exactly one of name or selector is required",
+	}, messages)
+}
+
+func TestFailureExitCode(t *testing.T) {
+	verify := &deployResult{err: &verifyError{instance: "a"}}
+	script := &deployResult{err: &scriptError{instance: "b", exitCode: 1}}
+	timeout := &deployResult{err: &timeoutError{instance: "c"}}
+
+	assert.Equal(t, exitCodeVerifyFailure, failureExitCode([]*deployResult{verify}))
+	assert.Equal(t, exitCodeScriptFailure, failureExitCode([]*deployResult{verify, script}))
+	assert.Equal(t, exitCodeScriptFailure, failureExitCode([]*deployResult{script, verify}))
+	assert.Equal(t, exitCodeTimeout, failureExitCode([]*deployResult{script, timeout, verify}))
+}
@@ -2,11 +2,7 @@ package kubernetes
 
 import (
 	"github.com/PremiereGlobal/stim/pkg/kubernetes"
-	"github.com/PremiereGlobal/stim/pkg/utils"
-
 	// "github.com/davecgh/go-spew/spew"
-	"sort"
-	"strings"
 )
 
 func (k *Kubernetes) configureContext() error {
@@ -41,7 +37,7 @@ func (k *Kubernetes) configureContext() error {
 		saFilter = k.stim.ConfigGetString("kube.config.serviceaccountfilter") //TODO: depreciated config should be removed
 	}
 
-	filteredServiceAccounts, err := k.filterServiceAccounts(kubePath+"/"+cluster, saFilter)
+	filteredServiceAccounts, err := k.filterServiceAccounts(cluster, saFilter)
 	if err != nil {
 		return err
 	}
@@ -113,32 +109,6 @@ func (k *Kubernetes) configureContext() error {
 	return nil
 }
 
-func (k *Kubernetes) filterServiceAccounts(path string, saFilter string) ([]string, error) {
-	serviceAccounts, err := k.vault.ListSecrets(path)
-	k.stim.Fatal(err)
-	regexFilteredServiceAccounts, err := utils.Filter(serviceAccounts, saFilter)
-	k.stim.Fatal(err)
-
-	if !k.stim.ConfigGetBool("kube.config.filter-by-token") {
-		return regexFilteredServiceAccounts, nil
-	}
-
-	kubeKeyName := k.stim.ConfigGetString("kube.config.keyname")
-	var paths []string
-	for _, serviceAccount := range regexFilteredServiceAccounts {
-		paths = append(paths, path+"/"+serviceAccount+"/"+kubeKeyName)
-	}
-
-	filteredPaths, err := k.vault.Filter(paths, []string{"read"})
-	k.stim.Fatal(err)
-
-	var tokenFilteredServiceAccounts []string
-	for _, filteredPath := range filteredPaths {
-		sa := strings.TrimSuffix(filteredPath, "/"+kubeKeyName)
-		sa = strings.TrimPrefix(sa, path+"/")
-		tokenFilteredServiceAccounts = append(tokenFilteredServiceAccounts, sa)
-	}
-
-	sort.Strings(tokenFilteredServiceAccounts)
-	return tokenFilteredServiceAccounts, nil
+func (k *Kubernetes) filterServiceAccounts(cluster string, saFilter string) ([]string, error) {
+	return k.stim.KubeServiceAccounts(cluster, saFilter, k.stim.ConfigGetBool("kube.config.filter-by-token"))
 }